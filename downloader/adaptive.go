@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxAutoWorkers は --workers=auto で増やせる上限
+	maxAutoWorkers = 256
+	// adaptiveInterval ごとに全体のスループットを測って同時実行数を見直す
+	adaptiveInterval = 2 * time.Second
+	// スループットがこの割合以上増えたときだけ「上がった」とみなす
+	adaptiveGain = 1.05
+	// 最初の応答までの時間が最小値のこの倍を超えたら混雑とみなす
+	latencyFactor = 3
+)
+
+// WorkerCount is the value of --workers: a fixed number of workers, or
+// "auto" to adapt the number to the servers.
+type WorkerCount struct {
+	N    uint
+	Auto bool
+}
+
+func ParseWorkerCount(s string) (WorkerCount, error) {
+	if s == "auto" {
+		return WorkerCount{Auto: true}, nil
+	}
+	n, err := parseUint(s)
+	if err != nil {
+		return WorkerCount{}, fmt.Errorf(`want a number or "auto": %w`, err)
+	}
+	return WorkerCount{N: n}, nil
+}
+
+func (w WorkerCount) String() string {
+	if w.Auto {
+		return "auto"
+	}
+	return strconv.FormatUint(uint64(w.N), 10)
+}
+
+func (w WorkerCount) MarshalYAML() (any, error) {
+	if w.Auto {
+		return "auto", nil
+	}
+	return w.N, nil
+}
+
+func (w *WorkerCount) UnmarshalYAML(node *yaml.Node) error {
+	v, err := ParseWorkerCount(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*w = v
+	return nil
+}
+
+// AdaptiveLimiter limits the number of concurrent downloads and adjusts
+// the limit from the Event stream with AIMD. Every adaptiveInterval the
+// limit grows while the aggregate throughput keeps rising, and it is
+// halved on 429/503 responses, timeouts or a rising time to first byte.
+//
+// Until the first overload, the limit doubles instead of growing by one,
+// so that a fast mirror that takes a hundred workers gets there quickly.
+type AdaptiveLimiter struct {
+	minLimit, maxLimit int
+	now                func() time.Time
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	// slowStart は最初に混雑を検出するまで倍々で増やす
+	slowStart bool
+
+	// 今の区間に受信したバイト数と、前の区間のスループット
+	windowStart time.Time
+	bytes       int64
+	prevRate    float64
+	// received はダウンロード中のURLごとの受信済みバイト数
+	received map[string]int64
+
+	// started は最初の進捗を待っているURLの開始時刻
+	started     map[string]time.Time
+	minLatency  time.Duration
+	latency     time.Duration
+	lastChanged time.Time
+}
+
+// NewAdaptiveLimiter starts with start concurrent downloads and adjusts
+// the limit between 1 and maxLimit.
+func NewAdaptiveLimiter(start, maxLimit int) *AdaptiveLimiter {
+	l := &AdaptiveLimiter{
+		minLimit:  1,
+		maxLimit:  maxLimit,
+		now:       time.Now,
+		limit:     min(max(start, 1), maxLimit),
+		slowStart: true,
+		received:  make(map[string]int64),
+		started:   make(map[string]time.Time),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Limit returns the current number of concurrent downloads allowed.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// acquire blocks until a download may start. ok is false if ctx is done.
+func (l *AdaptiveLimiter) acquire(ctx context.Context) (ok bool) {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		if ctx.Err() != nil {
+			return false
+		}
+		l.cond.Wait()
+	}
+	l.active++
+	return true
+}
+
+func (l *AdaptiveLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (l *AdaptiveLimiter) HandleEvent(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.windowStart.IsZero() {
+		l.windowStart, l.lastChanged = now, now
+	}
+
+	switch e := event.(type) {
+	case EventStart:
+		l.received[e.URL] = 0
+		l.started[e.URL] = now
+	case EventProgress:
+		// リトライで最初から受信し直すと受信済みのバイト数が減る
+		if prev := l.received[e.URL]; e.Current >= prev {
+			l.bytes += e.Current - prev
+		} else {
+			l.bytes += e.Current
+		}
+		l.received[e.URL] = e.Current
+		if start, ok := l.started[e.URL]; ok {
+			delete(l.started, e.URL)
+			l.sampleLatency(now.Sub(start))
+		}
+	case EventRetry:
+		// バックオフで待った時間を応答時間に含めない
+		delete(l.started, e.URL)
+		if overloaded(e.Err) {
+			l.decrease(now)
+		}
+	case EventEnd:
+		l.finish(e.URL)
+	case EventAbort:
+		l.finish(e.URL)
+	case EventUnchanged:
+		l.finish(e.URL)
+	case EventDiskFull:
+		l.finish(e.URL)
+	}
+
+	if now.Sub(l.windowStart) >= adaptiveInterval {
+		l.adjust(now)
+	}
+}
+
+func (l *AdaptiveLimiter) finish(url string) {
+	delete(l.received, url)
+	delete(l.started, url)
+}
+
+func (l *AdaptiveLimiter) sampleLatency(d time.Duration) {
+	if l.minLatency == 0 || d < l.minLatency {
+		l.minLatency = d
+	}
+	if l.latency == 0 {
+		l.latency = d
+	} else {
+		l.latency = (7*l.latency + 3*d) / 10
+	}
+}
+
+// adjust は区間のスループットを前の区間と比べて同時実行数を変える
+func (l *AdaptiveLimiter) adjust(now time.Time) {
+	rate := float64(l.bytes) / now.Sub(l.windowStart).Seconds()
+	rising := rate > l.prevRate*adaptiveGain
+	l.windowStart, l.bytes, l.prevRate = now, 0, rate
+
+	switch {
+	case l.minLatency > 0 && l.latency > latencyFactor*l.minLatency:
+		l.decrease(now)
+	// 上限まで使っていないなら、増やしても速くならない
+	case rising && len(l.received) >= l.limit:
+		l.increase(now)
+	}
+}
+
+func (l *AdaptiveLimiter) increase(now time.Time) {
+	if l.slowStart {
+		l.limit *= 2
+	} else {
+		l.limit++
+	}
+	l.limit = min(l.limit, l.maxLimit)
+	l.lastChanged = now
+	l.cond.Broadcast()
+}
+
+// decrease は同時実行数を半分にする。同じ混雑で続けて減らさないよう、1区間に1回まで
+func (l *AdaptiveLimiter) decrease(now time.Time) {
+	if now.Sub(l.lastChanged) < adaptiveInterval && !l.slowStart {
+		return
+	}
+	l.slowStart = false
+	l.limit = max(l.limit/2, l.minLimit)
+	l.lastChanged = now
+	// 減らす前のスループットと比べるといつまでも増やせないため、次の区間から測り直す
+	l.windowStart, l.bytes, l.prevRate = now, 0, 0
+	// 混雑が解消したかは新しい応答時間で判断する
+	l.latency = 0
+}
+
+// overloaded reports whether err shows that the server or the network is
+// overloaded, rather than a problem of the download itself.
+func overloaded(err error) bool {
+	var status *HTTPStatusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusTooManyRequests || status.Code == http.StatusServiceUnavailable
+	}
+	return errors.As(err, new(*RequestTimeoutError)) ||
+		errors.As(err, new(*ConnectTimeoutError)) ||
+		errors.As(err, new(*StallError))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewAdaptiveLimiter(2, 5)
+	l.now = func() time.Time { return now }
+
+	urls := []string{"a", "b", "c", "d", "e"}
+	received := int64(0)
+	// progress は1区間に全URLで合わせて rate バイト/秒受信し、区間を終える
+	progress := func(rate int64) {
+		received += rate * int64(adaptiveInterval/time.Second)
+		for _, url := range urls {
+			l.HandleEvent(EventProgress{URL: url, Current: received / int64(len(urls))})
+		}
+		now = now.Add(adaptiveInterval)
+		l.HandleEvent(EventProgress{URL: urls[0], Current: received / int64(len(urls))})
+	}
+	for _, url := range urls {
+		l.HandleEvent(EventStart{URL: url})
+	}
+
+	steps := []struct {
+		name  string
+		do    func()
+		limit int
+	}{
+		// 混雑するまでは倍々で増やし、上限で止まる
+		{"rising", func() { progress(1000) }, 4},
+		{"rising again", func() { progress(2000) }, 5},
+		{"at max", func() { progress(4000) }, 5},
+		{"503", func() {
+			l.HandleEvent(EventRetry{URL: "a", Err: &HTTPStatusError{Code: http.StatusServiceUnavailable}})
+		}, 2},
+		// 同じ混雑で続けては減らさない
+		{"429 right after", func() {
+			l.HandleEvent(EventRetry{URL: "b", Err: &HTTPStatusError{Code: http.StatusTooManyRequests}})
+		}, 2},
+		{"not overloaded", func() {
+			l.HandleEvent(EventRetry{URL: "b", Err: &HTTPStatusError{Code: http.StatusNotFound}})
+		}, 2},
+		// 混雑の後は1つずつ増やす
+		{"rising after overload", func() { progress(1000) }, 3},
+		{"flat", func() { progress(1000) }, 3},
+		{"timeout", func() {
+			now = now.Add(adaptiveInterval)
+			l.HandleEvent(EventRetry{URL: "c", Err: fmt.Errorf("mirror: %w", &StallError{Timeout: time.Second})})
+		}, 1},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := l.Limit(); got != step.limit {
+			t.Fatalf("%s: limit = %d, want %d", step.name, got, step.limit)
+		}
+	}
+}
+
+func TestAdaptiveLimiter_Latency(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewAdaptiveLimiter(4, 8)
+	l.now = func() time.Time { return now }
+
+	// 最初の応答まで 10ms かかっていたものが 100ms に延びる
+	for i, latency := range []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond} {
+		url := fmt.Sprint(i)
+		l.HandleEvent(EventStart{URL: url})
+		now = now.Add(latency)
+		l.HandleEvent(EventProgress{URL: url, Current: 1})
+	}
+	now = now.Add(adaptiveInterval)
+	l.HandleEvent(EventProgress{URL: "0", Current: 2})
+
+	if got := l.Limit(); got != 2 {
+		t.Errorf("limit = %d, want 2 after the latency rose", got)
+	}
+}
+
+func TestDownloadController_AdaptiveWorkers(t *testing.T) {
+	var running, peak atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	var tasks []Task
+	for i := range 8 {
+		tasks = append(tasks, *NewTask(fmt.Sprintf("%s/%d", ts.URL, i)))
+	}
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	l := NewAdaptiveLimiter(2, 16)
+	dc := NewDownloadController(NewSliceSource(tasks...), &defaultPolicy, pub, NewFileSaver(t.TempDir(), NewOSFS()), 1, WithAdaptiveWorkers(l))
+
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.count(EventTypeEnd); got != len(tasks) {
+		t.Errorf("%d downloads ended, want %d", got, len(tasks))
+	}
+	// 区間が経過していないので初期値のまま
+	if got := peak.Load(); got != 2 {
+		t.Errorf("peak concurrency = %d, want 2", got)
+	}
+}
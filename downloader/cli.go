@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 終了ステータス
+const (
+	exitOK = 0
+	// exitFailure はダウンロードや検証の一部が失敗したこと
+	exitFailure = 1
+	// exitUsage は引数や設定の誤り、または入力を読めなかったこと
+	exitUsage = 2
+	// exitTotalFailure はダウンロードや検証が全て失敗したこと
+	exitTotalFailure = 3
+)
+
+// failureStatus は total 件のうち failed 件が失敗したときの終了ステータス
+func failureStatus(failed, total int) int {
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed >= total:
+		return exitTotalFailure
+	default:
+		return exitFailure
+	}
+}
+
+// command is a subcommand of the CLI.
+type command struct {
+	name string
+	// args はヘルプに表示する、フラグに続く引数
+	args    string
+	summary string
+	// help はヘルプに表示する説明と終了ステータス
+	help string
+	// flags はヘルプと補完に使うフラグを返す
+	flags func() *flag.FlagSet
+	run   func(args []string, stdout, stderr io.Writer) int
+}
+
+func downloadFlags(name string) func() *flag.FlagSet {
+	return func() *flag.FlagSet {
+		flags, _ := newFlagSet(name)
+		return flags
+	}
+}
+
+// commands は help に表示する順に並ぶ
+func commands() []command {
+	return []command{
+		{
+			name:    "get",
+			args:    "[URL...]",
+			summary: "download URLs (the default command)",
+			help: `Downloads the URLs given as arguments, in --input-file and in --metalink.
+With --journal, the tasks and their results are recorded for the status and
+resume commands.
+
+With --fail-fast, the first failure cancels the downloads in progress and
+skips the rest.
+
+Exit status: 0 if every download succeeded, 1 if some failed, 3 if all
+failed, 2 on invalid flags or configuration.`,
+			flags: downloadFlags("get"),
+			run:   runDownloadCommand("get"),
+		},
+		{
+			name:    "watch",
+			args:    "[URL...]",
+			summary: "download URLs again every --interval and keep versions of changed files",
+			help: `Checks the URLs every --interval with conditional requests, replacing a
+file only when its content has changed and keeping --keep-versions previous
+versions of it. Runs until interrupted.
+
+Exit status: 0 when interrupted, 1 if some downloads were failing when it
+stopped, 3 if all were, 2 on invalid flags or configuration.`,
+			flags: downloadFlags("watch"),
+			run:   runDownloadCommand("watch"),
+		},
+		{
+			name:    "resume",
+			args:    "JOURNAL",
+			summary: "restart the downloads of a journal that did not complete",
+			help: `Downloads again the tasks of JOURNAL that failed, were canceled or were
+interrupted, with the flags of the run that wrote it. Flags given to resume
+are added after them, overriding them. The results are appended to JOURNAL.
+
+Exit status: 0 if every download succeeded or nothing was left to resume,
+1 if some failed, 3 if all failed, 2 if the journal cannot be read or on
+invalid flags.`,
+			flags: downloadFlags("resume"),
+			run:   runResume,
+		},
+		{
+			name:    "serve",
+			args:    "[URL...]",
+			summary: "run as a daemon accepting downloads over an HTTP API",
+			help: `Downloads the given URLs and keeps running, accepting more on --listen:
+
+  GET    /status          the state of every download, as JSON
+  POST   /downloads       queue the URLs of the body, in the format of --input-file
+  DELETE /downloads?url=  cancel a download
+
+The API has no authentication; do not listen on a public address. The
+first interrupt stops accepting downloads and waits for the ones in
+progress.
+
+Exit status: 0 if every download succeeded, 1 if some failed, 3 if all
+failed, 2 on invalid flags or configuration.`,
+			flags: downloadFlags("serve"),
+			run:   runDownloadCommand("serve"),
+		},
+		{
+			name:    "status",
+			args:    "JOURNAL | --addr ADDR",
+			summary: "show the downloads of a journal or a running serve",
+			help: `Shows how many downloads of JOURNAL completed, and lists the ones that did
+not. With --addr, shows every download of the serve command listening on
+ADDR instead.
+
+Exit status: 0 if nothing failed or is left unfinished, 1 otherwise, 2 if
+the journal or the server cannot be read.`,
+			flags: func() *flag.FlagSet {
+				flags, _ := newStatusFlagSet()
+				return flags
+			},
+			run: runStatus,
+		},
+		{
+			name:    "verify",
+			args:    "[CHECKSUMS...]",
+			summary: "check files against checksum lists or Metalink hashes",
+			help: `Hashes the files listed in CHECKSUMS, in the format of sha256sum ("HEX  NAME")
+or the BSD one ("SHA256 (NAME) = HEX"), and the files of --metalink, and
+compares them with the expected digests. MD5, SHA-1 and SHA-2 are supported.
+A NAME that is a URL stands for the file it was downloaded to in
+--output-dir. "-" reads the list from stdin.
+
+Exit status: 0 if every file matches, 1 if some are missing or differ, 3 if
+all are, 2 if a list cannot be read.`,
+			flags: func() *flag.FlagSet {
+				flags, _ := newVerifyFlagSet()
+				return flags
+			},
+			run: runVerify,
+		},
+		{
+			name:    "completion",
+			args:    "bash|zsh|fish",
+			summary: "print a shell completion script",
+			help: `Prints the completion script for the shell, e.g.
+
+  source <(downloader completion bash)
+  downloader completion zsh > "${fpath[1]}/_downloader"
+  downloader completion fish > ~/.config/fish/completions/downloader.fish`,
+			run: runCompletion,
+		},
+		{
+			name:    "help",
+			args:    "[COMMAND]",
+			summary: "show the help of a command",
+			run:     runHelp,
+		},
+	}
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// runCLI runs the command named by the first argument, and returns the exit
+// status. Arguments that do not start with a command are those of get, as
+// before the commands were introduced.
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "-h", "-help", "--help":
+			printUsage(stdout)
+			return exitOK
+		}
+		if c, ok := lookupCommand(args[0]); ok {
+			return c.run(args[1:], stdout, stderr)
+		}
+	}
+	return runDownloadCommand("get")(args, stdout, stderr)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: downloader [COMMAND] [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands() {
+		fmt.Fprintf(w, "  %-11s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Without a command, the arguments are those of get. Run "downloader help COMMAND"
+or "downloader COMMAND --help" for the flags of a command.`)
+}
+
+func printCommandHelp(w io.Writer, c command) {
+	fmt.Fprintf(w, "Usage: downloader %s", c.name)
+	if c.flags != nil {
+		fmt.Fprint(w, " [flags]")
+	}
+	fmt.Fprintf(w, " %s\n\n", c.args)
+	if c.help != "" {
+		fmt.Fprintln(w, c.help)
+	} else {
+		fmt.Fprintln(w, strings.ToUpper(c.summary[:1])+c.summary[1:]+".")
+	}
+	if c.flags != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Flags:")
+		flags := c.flags()
+		flags.SetOutput(w)
+		flags.PrintDefaults()
+	}
+}
+
+func runHelp(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stdout)
+		return exitOK
+	}
+	c, ok := lookupCommand(args[0])
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+	printCommandHelp(stdout, c)
+	return exitOK
+}
+
+// commandError は name のコマンドの引数や設定の誤りを表示し、終了ステータスを返す。
+// -h や --help ならヘルプを表示する。
+func commandError(name string, err error, stdout, stderr io.Writer) int {
+	if errors.Is(err, flag.ErrHelp) {
+		c, _ := lookupCommand(name)
+		printCommandHelp(stdout, c)
+		return exitOK
+	}
+	fmt.Fprintln(stderr, err)
+	if errors.As(err, new(*usageError)) {
+		fmt.Fprintf(stderr, "Run \"downloader %s --help\" for usage.\n", name)
+	}
+	return exitUsage
+}
+
+func runDownloadCommand(name string) func(args []string, stdout, stderr io.Writer) int {
+	return func(args []string, stdout, stderr io.Writer) int {
+		config, err := NewConfigFromArgs(append([]string{name}, args...), os.Getenv)
+		if err != nil {
+			return commandError(name, err, stdout, stderr)
+		}
+		return runDownload(config, stdout, stderr)
+	}
+}
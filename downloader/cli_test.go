@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunCLI_Usage(t *testing.T) {
+	tests := map[string]struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		"help":            {args: []string{"--help"}, code: exitOK, stdout: "Commands:"},
+		"help command":    {args: []string{"help", "resume"}, code: exitOK, stdout: "Usage: downloader resume [flags] JOURNAL"},
+		"command help":    {args: []string{"verify", "-h"}, code: exitOK, stdout: "-metalink"},
+		"get flags":       {args: []string{"get", "--help"}, code: exitOK, stdout: "-journal"},
+		"unknown help":    {args: []string{"help", "fetch"}, code: exitUsage, stderr: `unknown command "fetch"`},
+		"bad flag":        {args: []string{"watch", "--journal", "j"}, code: exitUsage, stderr: `Run "downloader watch --help" for usage.`},
+		"bad default":     {args: []string{"--no-such-flag"}, code: exitUsage, stderr: `Run "downloader get --help" for usage.`},
+		"status args":     {args: []string{"status"}, code: exitUsage, stderr: "give either a journal or --addr"},
+		"resume args":     {args: []string{"resume"}, code: exitUsage, stderr: "exactly one journal must be given"},
+		"verify args":     {args: []string{"verify"}, code: exitUsage, stderr: "no checksum list or metalink given"},
+		"missing journal": {args: []string{"status", filepath.Join(t.TempDir(), "none")}, code: exitUsage, stderr: "journal:"},
+		"shell":           {args: []string{"completion", "tcsh"}, code: exitUsage, stderr: `unknown shell "tcsh"`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCLI(tt.args, &stdout, &stderr)
+			if code != tt.code {
+				t.Errorf("exit status = %d, want %d\nstderr: %s", code, tt.code, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.stdout) {
+				t.Errorf("stdout %q does not contain %q", stdout.String(), tt.stdout)
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("stderr %q does not contain %q", stderr.String(), tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRunCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCLI([]string{"completion", shell}, &stdout, &stderr); code != exitOK {
+				t.Fatalf("exit status = %d: %s", code, stderr.String())
+			}
+			for _, want := range append(commandNames(), "journal", "keep-versions", "listen", "metalink") {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("completion does not contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+// TestRunCLI_Resume は get で失敗したダウンロードを resume でやり直す
+func TestRunCLI_Resume(t *testing.T) {
+	var healthy atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	// 利用者の設定を読まないようにする
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	out := filepath.Join(dir, "out")
+	run := func(want int, args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if code := runCLI(args, &stdout, &stderr); code != want {
+			t.Fatalf("%v: exit status = %d, want %d\nstdout: %s\nstderr: %s", args, code, want, stdout.String(), stderr.String())
+		}
+		return stdout.String()
+	}
+
+	run(exitFailure, "get", "--journal", journal, "--output-dir", out, "--netrc=false",
+		"--retry-limit", "2", "--retry-delay-min", "1ms", "--retry-delay-max", "1ms",
+		ts.URL+"/stable", ts.URL+"/flaky")
+	if got := run(exitFailure, "status", journal); !strings.Contains(got, "1 done, 0 unchanged, 1 failed") {
+		t.Errorf("status after get:\n%s", got)
+	}
+
+	healthy.Store(true)
+	run(exitOK, "resume", journal)
+	b, err := os.ReadFile(NewFileSaver(out, NewOSFS()).Path(ts.URL + "/flaky"))
+	if err != nil || string(b) != "content of /flaky" {
+		t.Errorf("resumed download = %q, %v", b, err)
+	}
+	if got := run(exitOK, "status", journal); !strings.Contains(got, "runs: 2") || !strings.Contains(got, "2 done") {
+		t.Errorf("status after resume:\n%s", got)
+	}
+	run(exitOK, "resume", journal)
+}
+
+func TestRunCLI_ResumeOrder(t *testing.T) {
+	var (
+		healthy atomic.Bool
+		mu      sync.Mutex
+		order   []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		order = append(order, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	paths := []string{"/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8"}
+	args := []string{"get", "--journal", journal, "--output-dir", filepath.Join(dir, "out"), "--netrc=false", "--workers", "1", "--retry-limit", "1"}
+	for _, p := range paths {
+		args = append(args, ts.URL+p)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := runCLI(args, &stdout, &stderr); code != exitTotalFailure {
+		t.Fatalf("get: exit status = %d, want %d\nstderr: %s", code, exitTotalFailure, stderr.String())
+	}
+
+	// 1つずつダウンロードするので、記録した順に再開する
+	healthy.Store(true)
+	if code := runCLI([]string{"resume", journal}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("resume: exit status = %d, want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+	if !slices.Equal(order, paths) {
+		t.Errorf("resumed in %v, want %v", order, paths)
+	}
+}
+
+func TestRunCLI_TotalFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"--output-dir", t.TempDir(), "--netrc=false", "--retry-limit", "1", "--fail-fast", ts.URL + "/a", ts.URL + "/b"}, &stdout, &stderr)
+	if code != exitTotalFailure {
+		t.Errorf("exit status = %d, want %d\nstdout: %s\nstderr: %s", code, exitTotalFailure, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "gave up after 1 attempt\n") {
+		t.Errorf("stdout does not show the attempts:\n%s", stdout.String())
+	}
+}
+
+func TestRunCLI_NotFound(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	out := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"--output-dir", out, "--netrc=false", ts.URL + "/missing"}, &stdout, &stderr)
+	if code != exitTotalFailure {
+		t.Errorf("exit status = %d, want %d\nstdout: %s\nstderr: %s", code, exitTotalFailure, stdout.String(), stderr.String())
+	}
+	// 404 はリトライせず、エラーページも保存しない
+	if got := requests.Load(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 0 {
+		t.Errorf("files are saved for a 404: %v", entries)
+	}
+}
+
+func TestRunCLI_DryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+	input := filepath.Join(home, "urls.txt")
+	if err := os.WriteFile(input, []byte(ts.URL+"/ok\nnot a url\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		args []string
+		code int
+	}{
+		"ok":          {[]string{ts.URL + "/ok"}, exitOK},
+		"some failed": {[]string{ts.URL + "/ok", ts.URL + "/missing"}, exitFailure},
+		"all failed":  {[]string{ts.URL + "/missing"}, exitTotalFailure},
+		"bad input":   {[]string{"--input-file", input}, exitUsage},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"--dry-run", "--netrc=false"}, tt.args...)
+			if code := runCLI(args, &stdout, &stderr); code != tt.code {
+				t.Errorf("exit status = %d, want %d\nstdout: %s\nstderr: %s", code, tt.code, stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunCLI_InputFile(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	run := func(content string, want int) string {
+		t.Helper()
+		input := filepath.Join(t.TempDir(), "urls.txt")
+		if err := os.WriteFile(input, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		code := runCLI([]string{"--output-dir", t.TempDir(), "--netrc=false", "--input-file", input, ts.URL + "/a"}, &stdout, &stderr)
+		if code != want {
+			t.Fatalf("exit status = %d, want %d\nstdout: %s\nstderr: %s", code, want, stdout.String(), stderr.String())
+		}
+		return stderr.String()
+	}
+
+	// 不正な行があれば、前の行のURLもダウンロードしない
+	stderr := run(ts.URL+"/b\nnot a url\n", exitUsage)
+	if !strings.Contains(stderr, "line 2: invalid URL") || requests.Load() != 0 {
+		t.Errorf("%d requests, stderr:\n%s", requests.Load(), stderr)
+	}
+
+	stderr = run(ts.URL+"/b\n"+ts.URL+"/a\n"+ts.URL+"/b#x\n", exitOK)
+	if !strings.Contains(stderr, "skipping duplicate URL "+ts.URL+"/a") || !strings.Contains(stderr, "skipping duplicate URL "+ts.URL+"/b#x") {
+		t.Errorf("duplicates are not reported:\n%s", stderr)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+}
+
+func TestRunCLI_TraceError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"--output-dir", t.TempDir(), "--netrc=false", "--trace-otlp", collector.URL, ts.URL + "/a"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit status = %d, want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+	// スパンを送れなかったことは渡した stderr に書く
+	if !strings.Contains(stderr.String(), "503") {
+		t.Errorf("stderr does not report the trace export error:\n%s", stderr.String())
+	}
+}
+
+func TestRunCLI_Stdout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(mirrorContent))
+	}))
+	defer ts.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", home)
+
+	// ボディは渡した stdout に、結果は stderr に書く
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"-O", "-", "--netrc=false", ts.URL + "/a"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("exit status = %d, want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+	if stdout.String() != mirrorContent {
+		t.Errorf("stdout = %q, want %q", stdout.String(), mirrorContent)
+	}
+	if !strings.Contains(stderr.String(), "Stored 1 files to stdout.") {
+		t.Errorf("stderr does not show the result:\n%s", stderr.String())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// runCompletion implements the completion command.
+func runCompletion(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+		c, _ := lookupCommand("completion")
+		printCommandHelp(stdout, c)
+		return exitOK
+	}
+	if len(args) != 1 {
+		return commandError("completion", &usageError{fmt.Errorf("give one shell: %s", strings.Join(completionShells, ", "))}, stdout, stderr)
+	}
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(stdout, commands())
+	case "zsh":
+		writeZshCompletion(stdout, commands())
+	case "fish":
+		writeFishCompletion(stdout, commands())
+	default:
+		return commandError("completion", &usageError{fmt.Errorf("unknown shell %q: want %s", args[0], strings.Join(completionShells, ", "))}, stdout, stderr)
+	}
+	return exitOK
+}
+
+// completionFlag はシェルに依らない補完のためのフラグの情報
+type completionFlag struct {
+	name  string
+	usage string
+	// value は値を取るフラグ
+	value bool
+}
+
+// option はシェルに渡すオプションの表記。1文字のものは "-O" のように書く
+func (f completionFlag) option() string {
+	if len(f.name) == 1 {
+		return "-" + f.name
+	}
+	return "--" + f.name
+}
+
+func completionFlags(c command) []completionFlag {
+	if c.flags == nil {
+		return nil
+	}
+	var flags []completionFlag
+	c.flags().VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, value: !ok || !b.IsBoolFlag()})
+	})
+	return append(flags, completionFlag{name: "help", usage: "show the help of the command"})
+}
+
+// completionWords は決まった値を取る引数の候補を返す。それ以外はURLかファイル名を補完する
+func completionWords(c command) []string {
+	switch c.name {
+	case "completion":
+		return completionShells
+	case "help":
+		return commandNames()
+	}
+	return nil
+}
+
+// takesURLs はURLを引数に取るコマンド
+func takesURLs(c command) bool {
+	return strings.Contains(c.args, "URL")
+}
+
+func commandNames() []string {
+	var names []string
+	for _, c := range commands() {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer, cmds []command) {
+	get, _ := lookupCommand("get")
+	fmt.Fprintf(w, `# bash completion for downloader
+_downloader() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	local cmd=${COMP_WORDS[1]} flags words
+	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	case $cmd in
+`, strings.Join(commandNames(), " "))
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t%s)\n", c.name)
+		if words := completionWords(c); words != nil {
+			fmt.Fprintf(w, "\t\twords=%q ;;\n", strings.Join(words, " "))
+			continue
+		}
+		fmt.Fprintf(w, "\t\tflags=%q ;;\n", bashFlags(c))
+	}
+	// コマンドを省略した場合は get のフラグ
+	fmt.Fprintf(w, "\t*)\n\t\tflags=%q ;;\n", bashFlags(get))
+	fmt.Fprint(w, `	esac
+	if [[ -n $words ]]; then
+		[[ $COMP_CWORD -eq 2 ]] && COMPREPLY=($(compgen -W "$words" -- "$cur"))
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	fi
+}
+complete -o default -F _downloader downloader
+`)
+}
+
+func bashFlags(c command) string {
+	var opts []string
+	for _, f := range completionFlags(c) {
+		opts = append(opts, f.option())
+	}
+	return strings.Join(opts, " ")
+}
+
+func writeZshCompletion(w io.Writer, cmds []command) {
+	fmt.Fprint(w, `#compdef downloader
+
+_downloader() {
+	local -a commands
+	commands=(
+`)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t\t%s\n", zshQuote(c.name+":"+c.summary))
+	}
+	fmt.Fprint(w, `	)
+	if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+		_describe -t commands command commands
+		return
+	fi
+
+	local cmd=get
+	if [[ $words[2] != -* ]]; then
+		cmd=$words[2]
+		shift words
+		(( CURRENT-- ))
+	fi
+	case $cmd in
+`)
+	// コマンドを省略した場合は get として補完する
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t%s)\n\t\t_arguments", c.name)
+		for _, f := range completionFlags(c) {
+			spec := f.option()
+			if f.value && len(f.name) > 1 {
+				spec += "="
+			}
+			spec += "[" + zshEscape(f.usage) + "]"
+			if f.value {
+				spec += ":" + f.name + ":_files"
+			}
+			fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote(spec))
+		}
+		switch {
+		case completionWords(c) != nil:
+			fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote("1:"+c.name+":("+strings.Join(completionWords(c), " ")+")"))
+		case takesURLs(c):
+			fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote("*:URL:_urls"))
+		default:
+			fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote("*:file:_files"))
+		}
+		fmt.Fprint(w, "\n\t\t;;\n")
+	}
+	fmt.Fprint(w, `	esac
+}
+
+_downloader "$@"
+`)
+}
+
+// zshEscape は _arguments の説明で特別な意味を持つ文字をエスケープする
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeFishCompletion(w io.Writer, cmds []command) {
+	get, _ := lookupCommand("get")
+	fmt.Fprintf(w, `# fish completion for downloader
+set -l commands %s
+complete -c downloader -f
+`, strings.Join(commandNames(), " "))
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c downloader -n \"not __fish_seen_subcommand_from $commands\" -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+	// コマンドを省略した場合は get のフラグ
+	writeFishFlags(w, "__fish_use_subcommand", get)
+	for _, c := range cmds {
+		cond := "__fish_seen_subcommand_from " + c.name
+		writeFishFlags(w, cond, c)
+		switch {
+		case completionWords(c) != nil:
+			fmt.Fprintf(w, "complete -c downloader -n %s -a %s\n", fishQuote(cond), fishQuote(strings.Join(completionWords(c), " ")))
+		case !takesURLs(c):
+			fmt.Fprintf(w, "complete -c downloader -n %s -F\n", fishQuote(cond))
+		}
+	}
+}
+
+func writeFishFlags(w io.Writer, cond string, c command) {
+	for _, f := range completionFlags(c) {
+		opt := "-l " + f.name
+		if len(f.name) == 1 {
+			opt = "-s " + f.name
+		}
+		if f.value {
+			opt += " -r -F"
+		}
+		fmt.Fprintf(w, "complete -c downloader -n %s %s -d %s\n", fishQuote(cond), opt, fishQuote(f.usage))
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
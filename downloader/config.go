@@ -1,40 +1,1064 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/no-yan/multierr"
+	"github.com/no-yan/tmp/downloader/internal/backoff"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultOutputDir = "out"
 	defaultWorkers   = 4
 	defaultTimeout   = 30 * time.Second
+
+	envPrefix      = "DOWNLOADER_"
+	envListSep     = ";"
+	configDirName  = "downloader"
+	configFileName = "config.yaml"
 )
 
 type Config struct {
+	// command は get, watch, serve のいずれかのサブコマンド
+	command   string
 	outputDir string
 	workers   uint
-	timeout   time.Duration
-	tasks     Tasks
+	// autoWorkers は同時実行数を自動で調整する。workers はその初期値になる
+	autoWorkers bool
+	timeout     time.Duration
+	// totalTimeout は実行全体の制限時間で、0なら無制限
+	totalTimeout time.Duration
+	stallTimeout time.Duration
+	minSpeed     speedSettings
+	// maxFileSize と maxTotal はバイト数の上限で、0なら無制限
+	maxFileSize int64
+	maxTotal    int64
+	tasks       Tasks
+	inputFiles  []string
+	metalinks   []string
+	slowMirror  speedSettings
+	policy      backoff.Policy
+	header      http.Header
+	hostLimits  map[string]uint
+	transport   TransportConfig
+	s3          S3Config
+	// cookies は読み込む、cookieJar は終了時に書き出すCookieファイル
+	cookies   string
+	cookieJar string
+	netrc     bool
+	netrcFile string
+	mirror    bool
+	recursive bool
+	crawl     CrawlConfig
+	hooks     HookConfig
+	trace     TraceConfig
+	warc      WARCConfig
+	// har は全ての試行を書き出すHARファイル
+	har      string
+	watch    WatchConfig
+	schedule SchedulePolicy
+	window   int
+	// pipe は各ダウンロードのボディを標準入力に流すコマンド
+	pipe string
+	tui  bool
+	// failFast は最初に失敗したダウンロードで残りをキャンセルする
+	failFast bool
+
+	// 読み込んだ設定ファイルのパス。見つからなかった場合は空文字
+	configFile  string
+	printConfig bool
+	dryRun      bool
+	// stdout は "-O -" で、ただ一つのダウンロードを標準出力に書く
+	stdout bool
+	// duplicates は引数のうち他のURLと同じだったもの
+	duplicates []Duplicate
+	// args は指定されたフラグで、ジャーナルに記録して resume で使う
+	args []string
+	// journal はタスクと結果を記録するファイル
+	journal string
+	// listen は serve のHTTP APIのアドレス
+	listen string
 }
 
 func NewConfig(outputDir string, workers uint, timeout time.Duration, tasks Tasks) *Config {
 	return &Config{
-		outputDir: outputDir,
-		workers:   workers,
-		timeout:   timeout,
-		tasks:     tasks,
+		outputDir:  outputDir,
+		workers:    workers,
+		timeout:    timeout,
+		tasks:      tasks,
+		policy:     defaultPolicy,
+		header:     make(http.Header),
+		hostLimits: make(map[string]uint),
+		transport:  defaultTransportConfig(),
+		s3:         defaultS3Config(),
+		crawl:      defaultCrawlConfig(),
+		hooks:      defaultHookConfig(),
+		warc:       defaultWARCConfig(),
+		watch:      defaultWatchConfig(),
+		schedule:   ScheduleFIFO,
+		window:     defaultScheduleWindow,
+	}
+}
+
+// downloadCommands はダウンロードの設定を読むサブコマンド
+var downloadCommands = []string{"get", "watch", "serve"}
+
+// commandFlags は設定のレイヤーに含めない、その場限りのフラグ。
+// コマンドにないフラグは nil になる。
+type commandFlags struct {
+	configPath  *string
+	printConfig *bool
+	dryRun      *bool
+	output      *string
+	journal     *string
+	listen      *string
+}
+
+// usageError は引数の構文の誤りで、ヘルプの案内を添えて表示する
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+// NewConfigFromArgs builds the effective configuration from the layers
+// file < env (DOWNLOADER_*) < flags, later layers overriding earlier ones.
+//
+// args may start with one of the download commands: get (the default),
+// watch, which re-checks the URLs every --interval, or serve.
+func NewConfigFromArgs(args []string, getenv func(string) string) (*Config, error) {
+	command := "get"
+	if len(args) > 0 && slices.Contains(downloadCommands, args[0]) {
+		command, args = args[0], args[1:]
+	}
+
+	flags, cf := newFlagSet(command)
+	if err := flags.Parse(args); err != nil {
+		return nil, &usageError{err}
+	}
+
+	s := defaultSettings()
+
+	path, err := findConfigFile(*cf.configPath, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := s.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.loadEnv(flags, getenv); err != nil {
+		return nil, err
+	}
+	if err := s.loadFlags(flags); err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	tasks, dups, err := NewTasks(flags.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	config := s.config(tasks)
+	config.command = command
+	config.duplicates = dups
+	config.configFile = path
+	config.args = recordedArgs(flags)
+	config.printConfig = *cf.printConfig
+
+	switch command {
+	case "get":
+		if *cf.output != "" {
+			if err := s.validateStdout(*cf.output, tasks, *cf.journal); err != nil {
+				return nil, err
+			}
+		}
+		config.dryRun = *cf.dryRun
+		config.stdout = *cf.output == "-"
+		config.journal = *cf.journal
+	case "watch":
+		if err := s.validateWatch(); err != nil {
+			return nil, err
+		}
+	case "serve":
+		if err := s.validateServe(); err != nil {
+			return nil, err
+		}
+		config.listen = *cf.listen
+	}
+	return config, nil
+}
+
+// newFlagSet defines the flags of a download command. Flags that only make
+// sense for one command are defined only for it.
+func newFlagSet(command string) (*flag.FlagSet, *commandFlags) {
+	// ヘルプとエラーの表示は呼び出し側で行う
+	flags := flag.NewFlagSet("downloader "+command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+
+	cf := &commandFlags{}
+	cf.configPath = flags.String("config", "", "path to config file (default: $XDG_CONFIG_HOME/downloader/config.yaml)")
+	cf.printConfig = flags.Bool("print-config", false, "print the effective configuration and exit")
+	switch command {
+	case "get":
+		cf.dryRun = flags.Bool("dry-run", false, "probe every URL and print what would be downloaded, without downloading")
+		cf.output = flags.String("O", "", `write the download to this file; only "-" (stdout) is supported, for a single URL`)
+		cf.journal = flags.String("journal", "", "record the tasks and their results in this file, for status and resume")
+	case "watch":
+		wt := defaultWatchConfig()
+		flags.Duration("interval", wt.Interval, "time between the starts of two checks of the URLs")
+		flags.Int("keep-versions", wt.Keep, "number of previous versions kept when a file changes")
+	case "serve":
+		cf.listen = flags.String("listen", defaultListenAddr, "address of the HTTP API")
+	}
+	if command != "serve" {
+		flags.Bool("tui", false, "show a full-screen dashboard with controls for each download")
+	}
+	flags.String("pipe", "", "stream each download into the stdin of this command; {url} is replaced")
+	flags.Var(new(listFlag), "input-file", `read URLs from file, one per line; "-" reads stdin (repeatable)`)
+	flags.Var(new(listFlag), "metalink", "read tasks and their mirrors from a Metalink v4 file (repeatable)")
+	flags.Int64("slow-mirror-speed", 0, "switch to the next mirror below this many bytes/s (0 disables)")
+	flags.Duration("slow-mirror-window", defaultSlowMirrorWindow, "period over which --slow-mirror-speed is measured")
+	flags.String("output-dir", defaultOutputDir, "output directory")
+	flags.String("workers", strconv.Itoa(defaultWorkers), `number of concurrent downloads, or "auto" to adjust it to the throughput`)
+	flags.Duration("request-timeout", defaultTimeout, "time limit for the response header of each attempt")
+	flags.Duration("total-timeout", 0, "time limit of the whole run (0 means unlimited)")
+	flags.Duration("connect-timeout", defaultConnectTimeout, "time limit for establishing a connection")
+	flags.Duration("stall-timeout", defaultStallTimeout, "retry when no data arrives for this long (0 disables)")
+	flags.Int64("min-speed", 0, "retry when the transfer stays below this many bytes/s (0 disables)")
+	flags.Duration("min-speed-window", defaultMinSpeedWindow, "period over which --min-speed is measured")
+	flags.Int64("max-filesize", 0, "abort files larger than this many bytes (0 means unlimited)")
+	flags.Int64("max-total", 0, "stop accepting files once this many bytes in total are downloaded (0 means unlimited)")
+	flags.Duration("retry-delay-min", defaultPolicy.DelayMin, "minimum delay between retries")
+	flags.Duration("retry-delay-max", defaultPolicy.DelayMax, "maximum delay between retries")
+	flags.Uint("retry-limit", defaultPolicy.RetryLimit, "maximum number of attempts per URL")
+	if command != "watch" && command != "serve" {
+		flags.Bool("fail-fast", false, "cancel the remaining downloads when one fails")
+	}
+	flags.Var(new(listFlag), "header", `extra request header "Name: value" (repeatable)`)
+	flags.String("cookies", "", "load cookies from this Netscape-format file")
+	flags.String("cookie-jar", "", "save cookies to this Netscape-format file when done")
+	flags.Bool("netrc", true, "send credentials from .netrc to matching hosts")
+	flags.String("netrc-file", "", "path to .netrc (default: $NETRC or ~/.netrc)")
+	flags.Var(new(listFlag), "host-limit", `max concurrent downloads per host "host=n" (repeatable)`)
+	hc := defaultHookConfig()
+	flags.String("on-complete", "", "command run for each downloaded file; {path} and {url} are replaced")
+	flags.String("on-error", "", "command run for each aborted URL; {url} and {error} are replaced")
+	flags.Int("hook-concurrency", hc.Concurrency, "max number of hooks running at once")
+	flags.Duration("hook-timeout", hc.Timeout, "time limit of a single hook")
+	flags.String("trace-otlp", "", "send a trace of the downloads to this OTLP/HTTP endpoint, e.g. http://localhost:4318")
+	flags.String("trace-file", "", "append a trace of the downloads to this file as OTLP JSON lines")
+	flags.String("har", "", "write every HTTP attempt, including retried ones, to this HAR file")
+	wc := defaultWARCConfig()
+	flags.Bool("warc", false, "save the downloads with their HTTP headers as WARC 1.1 files in the output directory")
+	flags.String("warc-prefix", wc.Prefix, "file name prefix of the WARC files")
+	flags.Bool("warc-gzip", wc.Gzip, "compress each WARC record with gzip")
+	flags.Int64("warc-max-size", wc.MaxSize, "start a new WARC file beyond this many bytes (0 means never)")
+	flags.String("schedule", string(ScheduleFIFO), "order of downloads: fifo, priority, smallest-first or largest-first")
+	flags.Int("schedule-window", defaultScheduleWindow, "number of tasks read ahead to pick from, unless fifo")
+	flags.Bool("mirror", false, "skip files unchanged since the last run, using ETag/Last-Modified")
+
+	cc := defaultCrawlConfig()
+	flags.Bool("recursive", false, "follow href/src links in downloaded HTML")
+	flags.Int("max-depth", cc.MaxDepth, "maximum link depth in recursive mode")
+	flags.Bool("same-host", cc.SameHost, "only follow links to the hosts of the given URLs")
+	flags.Var(new(listFlag), "include", "only follow links matching this regexp (repeatable)")
+	flags.Var(new(listFlag), "exclude", "do not follow links matching this regexp (repeatable)")
+	flags.Bool("robots", cc.Robots, "respect robots.txt in recursive mode")
+
+	dt := defaultTransportConfig()
+	flags.String("proxy", "", "proxy URL (http, https, socks5); defaults to $HTTPS_PROXY/$HTTP_PROXY")
+	flags.String("ca-cert", "", "PEM file with additional CA certificates")
+	flags.String("client-cert", "", "PEM client certificate for mTLS")
+	flags.String("client-key", "", "PEM private key for --client-cert")
+	flags.Bool("insecure-skip-verify", false, "skip TLS certificate verification")
+	flags.Int("max-idle-conns", dt.MaxIdleConns, "max idle connections in the pool")
+	flags.Int("max-idle-conns-per-host", dt.MaxIdleConnsPerHost, "max idle connections per host")
+	flags.Int("max-conns-per-host", dt.MaxConnsPerHost, "max connections per host (0 means unlimited)")
+	flags.Bool("http2", dt.HTTP2, "attempt HTTP/2")
+	flags.Var(new(listFlag), "resolve", `resolve "host:port" to addr, as in "host:port:addr" (repeatable)`)
+
+	flags.String("s3-endpoint", "", "URL of an S3-compatible server for s3:// URLs (default: AWS)")
+	flags.String("s3-region", defaultS3Region, "region used to sign s3:// requests")
+	flags.Bool("s3-path-style", false, "address s3:// objects as endpoint/bucket/key instead of bucket.endpoint/key")
+
+	return flags, cf
+}
+
+// recordedArgs は指定されたフラグを、resume で同じ設定を再現できる形で返す。
+// 認証情報を含むものはジャーナルに残さない
+func recordedArgs(flags *flag.FlagSet) []string {
+	var args []string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "journal" || f.Name == "print-config" || f.Name == "dry-run" {
+			return
+		}
+		values := []string{f.Value.String()}
+		if l, ok := f.Value.(*listFlag); ok {
+			values = *l
+		}
+		for _, v := range values {
+			if secretArg(f.Name, v) {
+				continue
+			}
+			args = append(args, "--"+f.Name+"="+v)
+		}
+	})
+	return args
+}
+
+// secretArg reports whether the value of a flag carries credentials.
+func secretArg(name, value string) bool {
+	switch name {
+	case "header":
+		header, _, _ := strings.Cut(value, ":")
+		switch http.CanonicalHeaderKey(strings.TrimSpace(header)) {
+		case "Authorization", "Proxy-Authorization", "Cookie":
+			return true
+		}
+	case "proxy":
+		u, err := url.Parse(value)
+		return err != nil || u.User != nil
+	}
+	return false
+}
+
+// WriteTo dumps the effective configuration in the config file format.
+func (c *Config) WriteTo(w io.Writer) (int64, error) {
+	s := settings{
+		InputFiles:     c.inputFiles,
+		Metalinks:      c.metalinks,
+		SlowMirror:     c.slowMirror,
+		OutputDir:      c.outputDir,
+		Workers:        WorkerCount{N: c.workers, Auto: c.autoWorkers},
+		RequestTimeout: c.timeout,
+		TotalTimeout:   c.totalTimeout,
+		StallTimeout:   c.stallTimeout,
+		MinSpeed:       c.minSpeed,
+		MaxFileSize:    c.maxFileSize,
+		MaxTotal:       c.maxTotal,
+		Hooks:          c.hooks,
+		Trace:          c.trace,
+		WARC:           c.warc,
+		HAR:            c.har,
+		Watch:          c.watch,
+		Schedule:       c.schedule,
+		ScheduleWindow: c.window,
+		Mirror:         c.mirror,
+		Pipe:           c.pipe,
+		TUI:            c.tui,
+		Recursive:      c.recursive,
+		Crawl:          c.crawl,
+		FailFast:       c.failFast,
+		Retry: retrySettings{
+			DelayMin: c.policy.DelayMin,
+			DelayMax: c.policy.DelayMax,
+			Limit:    c.policy.RetryLimit,
+		},
+		Headers:   make(map[string]string),
+		Hosts:     make(map[string]hostSettings),
+		Transport: c.transport,
+		S3:        c.s3,
+		Cookies:   c.cookies,
+		CookieJar: c.cookieJar,
+		Netrc:     c.netrc,
+		NetrcFile: c.netrcFile,
+	}
+	for name := range c.header {
+		s.Headers[name] = c.header.Get(name)
+	}
+	for host, n := range c.hostLimits {
+		s.Hosts[host] = hostSettings{MaxConnections: n}
+	}
+
+	var buf bytes.Buffer
+	if c.configFile != "" {
+		fmt.Fprintf(&buf, "# config file: %s\n", c.configFile)
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(s); err != nil {
+		return 0, err
+	}
+	enc.Close()
+
+	return buf.WriteTo(w)
+}
+
+// settings は設定ファイルの形式で、各レイヤーを重ねるための中間表現
+type settings struct {
+	InputFiles     []string                `yaml:"input-files,omitempty"`
+	Metalinks      []string                `yaml:"metalinks,omitempty"`
+	SlowMirror     speedSettings           `yaml:"slow-mirror"`
+	OutputDir      string                  `yaml:"output-dir"`
+	Workers        WorkerCount             `yaml:"workers"`
+	RequestTimeout time.Duration           `yaml:"request-timeout"`
+	TotalTimeout   time.Duration           `yaml:"total-timeout"`
+	StallTimeout   time.Duration           `yaml:"stall-timeout"`
+	MinSpeed       speedSettings           `yaml:"min-speed"`
+	MaxFileSize    int64                   `yaml:"max-filesize"`
+	MaxTotal       int64                   `yaml:"max-total"`
+	Hooks          HookConfig              `yaml:"hooks"`
+	Trace          TraceConfig             `yaml:"trace"`
+	WARC           WARCConfig              `yaml:"warc"`
+	HAR            string                  `yaml:"har,omitempty"`
+	Watch          WatchConfig             `yaml:"watch"`
+	Schedule       SchedulePolicy          `yaml:"schedule"`
+	ScheduleWindow int                     `yaml:"schedule-window"`
+	Mirror         bool                    `yaml:"mirror"`
+	Pipe           string                  `yaml:"pipe,omitempty"`
+	TUI            bool                    `yaml:"tui"`
+	Recursive      bool                    `yaml:"recursive"`
+	Crawl          CrawlConfig             `yaml:"crawl"`
+	FailFast       bool                    `yaml:"fail-fast"`
+	Retry          retrySettings           `yaml:"retry"`
+	Headers        map[string]string       `yaml:"headers,omitempty"`
+	Hosts          map[string]hostSettings `yaml:"hosts,omitempty"`
+	Transport      TransportConfig         `yaml:"transport"`
+	S3             S3Config                `yaml:"s3"`
+	Cookies        string                  `yaml:"cookies,omitempty"`
+	CookieJar      string                  `yaml:"cookie-jar,omitempty"`
+	Netrc          bool                    `yaml:"netrc"`
+	NetrcFile      string                  `yaml:"netrc-file,omitempty"`
+}
+
+type retrySettings struct {
+	DelayMin time.Duration `yaml:"delay-min"`
+	DelayMax time.Duration `yaml:"delay-max"`
+	Limit    uint          `yaml:"limit"`
+}
+
+type speedSettings struct {
+	Speed  int64         `yaml:"speed"`
+	Window time.Duration `yaml:"window"`
+}
+
+type hostSettings struct {
+	MaxConnections uint `yaml:"max-connections"`
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		OutputDir:      defaultOutputDir,
+		Workers:        WorkerCount{N: defaultWorkers},
+		RequestTimeout: defaultTimeout,
+		StallTimeout:   defaultStallTimeout,
+		MinSpeed:       speedSettings{Window: defaultMinSpeedWindow},
+		Retry: retrySettings{
+			DelayMin: defaultPolicy.DelayMin,
+			DelayMax: defaultPolicy.DelayMax,
+			Limit:    defaultPolicy.RetryLimit,
+		},
+		Headers:        make(map[string]string),
+		Hosts:          make(map[string]hostSettings),
+		SlowMirror:     speedSettings{Window: defaultSlowMirrorWindow},
+		Hooks:          defaultHookConfig(),
+		WARC:           defaultWARCConfig(),
+		Watch:          defaultWatchConfig(),
+		Schedule:       ScheduleFIFO,
+		ScheduleWindow: defaultScheduleWindow,
+		Transport:      defaultTransportConfig(),
+		S3:             defaultS3Config(),
+		Netrc:          true,
+		Crawl:          defaultCrawlConfig(),
+	}
+}
+
+func (s *settings) config(tasks Tasks) *Config {
+	workers := s.Workers.N
+	if s.Workers.Auto {
+		workers = defaultWorkers
+	}
+	c := NewConfig(s.OutputDir, workers, s.RequestTimeout, tasks)
+	c.autoWorkers = s.Workers.Auto
+	c.policy = backoff.Policy{
+		DelayMin:   s.Retry.DelayMin,
+		DelayMax:   s.Retry.DelayMax,
+		RetryLimit: s.Retry.Limit,
+	}
+	for name, value := range s.Headers {
+		c.header.Set(name, value)
+	}
+	for host, h := range s.Hosts {
+		c.hostLimits[host] = h.MaxConnections
+	}
+	c.inputFiles = s.InputFiles
+	c.metalinks = s.Metalinks
+	c.slowMirror = s.SlowMirror
+	c.totalTimeout = s.TotalTimeout
+	c.stallTimeout = s.StallTimeout
+	c.minSpeed = s.MinSpeed
+	c.maxFileSize = s.MaxFileSize
+	c.maxTotal = s.MaxTotal
+	c.transport = s.Transport
+	c.s3 = s.S3
+	c.cookies = s.Cookies
+	c.cookieJar = s.CookieJar
+	c.netrc = s.Netrc
+	c.netrcFile = s.NetrcFile
+	c.hooks = s.Hooks
+	c.trace = s.Trace
+	c.warc = s.WARC
+	c.har = s.HAR
+	c.watch = s.Watch
+	c.schedule = s.Schedule
+	c.window = s.ScheduleWindow
+	c.mirror = s.Mirror
+	c.pipe = s.Pipe
+	c.tui = s.TUI
+	c.recursive = s.Recursive
+	c.crawl = s.Crawl
+	c.failFast = s.FailFast
+	return c
+}
+
+// loadFile はファイルに書かれたキーだけを上書きする
+func (s *settings) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	// 同じヘッダーが大文字小文字違いで重複しないよう正規化する
+	headers := make(map[string]string, len(s.Headers))
+	for name, value := range s.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	s.Headers = headers
+	if s.Hosts == nil {
+		s.Hosts = make(map[string]hostSettings)
+	}
+	return nil
+}
+
+func (s *settings) loadEnv(flags *flag.FlagSet, getenv func(string) string) error {
+	m := multierr.New()
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if commandOnly(f.Name) {
+			return
+		}
+		name := envName(f.Name)
+		value := getenv(name)
+		if value == "" {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(*listFlag); ok {
+			values = strings.Split(value, envListSep)
+			s.clearList(f.Name)
+		}
+		for _, v := range values {
+			if err := s.set(f.Name, strings.TrimSpace(v)); err != nil {
+				m.Add(fmt.Errorf("env %s: %w", name, err))
+			}
+		}
+	})
+
+	return m.Err()
+}
+
+func (s *settings) loadFlags(flags *flag.FlagSet) error {
+	m := multierr.New()
+
+	flags.Visit(func(f *flag.Flag) {
+		if commandOnly(f.Name) {
+			return
+		}
+
+		values := []string{f.Value.String()}
+		if l, ok := f.Value.(*listFlag); ok {
+			values = *l
+			s.clearList(f.Name)
+		}
+		for _, v := range values {
+			if err := s.set(f.Name, v); err != nil {
+				m.Add(fmt.Errorf("flag --%s: %w", f.Name, err))
+			}
+		}
+	})
+
+	return m.Err()
+}
+
+// clearList empties the list of key, so that a list given in a layer
+// replaces the one of the layers below. Headers and host limits are kept,
+// as they are overridden name by name.
+func (s *settings) clearList(key string) {
+	switch key {
+	case "input-file":
+		s.InputFiles = nil
+	case "metalink":
+		s.Metalinks = nil
+	case "include":
+		s.Crawl.Include = nil
+	case "exclude":
+		s.Crawl.Exclude = nil
+	case "resolve":
+		s.Transport.Resolve = nil
+	}
+}
+
+// set applies a single value given in flag syntax.
+func (s *settings) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "input-file":
+		s.InputFiles = append(s.InputFiles, value)
+	case "metalink":
+		s.Metalinks = append(s.Metalinks, value)
+	case "slow-mirror-speed":
+		s.SlowMirror.Speed, err = strconv.ParseInt(value, 10, 64)
+	case "slow-mirror-window":
+		s.SlowMirror.Window, err = time.ParseDuration(value)
+	case "output-dir":
+		s.OutputDir = value
+	case "workers":
+		s.Workers, err = ParseWorkerCount(value)
+	case "request-timeout":
+		s.RequestTimeout, err = time.ParseDuration(value)
+	case "total-timeout":
+		s.TotalTimeout, err = time.ParseDuration(value)
+	case "connect-timeout":
+		s.Transport.ConnectTimeout, err = time.ParseDuration(value)
+	case "stall-timeout":
+		s.StallTimeout, err = time.ParseDuration(value)
+	case "min-speed":
+		s.MinSpeed.Speed, err = strconv.ParseInt(value, 10, 64)
+	case "min-speed-window":
+		s.MinSpeed.Window, err = time.ParseDuration(value)
+	case "max-filesize":
+		s.MaxFileSize, err = strconv.ParseInt(value, 10, 64)
+	case "max-total":
+		s.MaxTotal, err = strconv.ParseInt(value, 10, 64)
+	case "on-complete":
+		s.Hooks.OnComplete = value
+	case "on-error":
+		s.Hooks.OnError = value
+	case "hook-concurrency":
+		s.Hooks.Concurrency, err = strconv.Atoi(value)
+	case "hook-timeout":
+		s.Hooks.Timeout, err = time.ParseDuration(value)
+	case "trace-otlp":
+		s.Trace.OTLPEndpoint = value
+	case "trace-file":
+		s.Trace.File = value
+	case "interval":
+		s.Watch.Interval, err = time.ParseDuration(value)
+	case "keep-versions":
+		s.Watch.Keep, err = strconv.Atoi(value)
+	case "har":
+		s.HAR = value
+	case "warc":
+		s.WARC.Enabled, err = strconv.ParseBool(value)
+	case "warc-prefix":
+		s.WARC.Prefix = value
+	case "warc-gzip":
+		s.WARC.Gzip, err = strconv.ParseBool(value)
+	case "warc-max-size":
+		s.WARC.MaxSize, err = strconv.ParseInt(value, 10, 64)
+	case "schedule":
+		s.Schedule = SchedulePolicy(value)
+	case "schedule-window":
+		s.ScheduleWindow, err = strconv.Atoi(value)
+	case "mirror":
+		s.Mirror, err = strconv.ParseBool(value)
+	case "pipe":
+		s.Pipe = value
+	case "tui":
+		s.TUI, err = strconv.ParseBool(value)
+	case "recursive":
+		s.Recursive, err = strconv.ParseBool(value)
+	case "max-depth":
+		s.Crawl.MaxDepth, err = strconv.Atoi(value)
+	case "same-host":
+		s.Crawl.SameHost, err = strconv.ParseBool(value)
+	case "include":
+		s.Crawl.Include = append(s.Crawl.Include, value)
+	case "exclude":
+		s.Crawl.Exclude = append(s.Crawl.Exclude, value)
+	case "robots":
+		s.Crawl.Robots, err = strconv.ParseBool(value)
+	case "retry-delay-min":
+		s.Retry.DelayMin, err = time.ParseDuration(value)
+	case "retry-delay-max":
+		s.Retry.DelayMax, err = time.ParseDuration(value)
+	case "retry-limit":
+		s.Retry.Limit, err = parseUint(value)
+	case "fail-fast":
+		s.FailFast, err = strconv.ParseBool(value)
+	case "header":
+		name, v, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q: want \"Name: value\"", value)
+		}
+		s.Headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(v)
+	case "cookies":
+		s.Cookies = value
+	case "cookie-jar":
+		s.CookieJar = value
+	case "netrc":
+		s.Netrc, err = strconv.ParseBool(value)
+	case "netrc-file":
+		s.NetrcFile = value
+	case "host-limit":
+		host, v, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("invalid host limit %q: want \"host=n\"", value)
+		}
+		n, err := parseUint(v)
+		if err != nil {
+			return fmt.Errorf("invalid host limit %q: %w", value, err)
+		}
+		s.Hosts[strings.TrimSpace(host)] = hostSettings{MaxConnections: n}
+	case "proxy":
+		s.Transport.Proxy = value
+	case "ca-cert":
+		s.Transport.CACert = value
+	case "client-cert":
+		s.Transport.ClientCert = value
+	case "client-key":
+		s.Transport.ClientKey = value
+	case "insecure-skip-verify":
+		s.Transport.InsecureSkipVerify, err = strconv.ParseBool(value)
+	case "max-idle-conns":
+		s.Transport.MaxIdleConns, err = strconv.Atoi(value)
+	case "max-idle-conns-per-host":
+		s.Transport.MaxIdleConnsPerHost, err = strconv.Atoi(value)
+	case "max-conns-per-host":
+		s.Transport.MaxConnsPerHost, err = strconv.Atoi(value)
+	case "http2":
+		s.Transport.HTTP2, err = strconv.ParseBool(value)
+	case "resolve":
+		s.Transport.Resolve = append(s.Transport.Resolve, value)
+	case "s3-endpoint":
+		s.S3.Endpoint = value
+	case "s3-region":
+		s.S3.Region = value
+	case "s3-path-style":
+		s.S3.PathStyle, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	return nil
+}
+
+func (s *settings) validate() error {
+	m := multierr.New()
+
+	if s.OutputDir == "" {
+		m.Add(errors.New("output-dir: must not be empty"))
+	}
+	if !s.Workers.Auto && s.Workers.N < 1 {
+		m.Add(errors.New("workers: must be at least 1"))
+	}
+	if s.RequestTimeout <= 0 {
+		m.Add(fmt.Errorf("request-timeout: must be positive, got %s", s.RequestTimeout))
+	}
+	if s.TotalTimeout < 0 {
+		m.Add(fmt.Errorf("total-timeout: must not be negative, got %s", s.TotalTimeout))
+	}
+	if s.StallTimeout < 0 {
+		m.Add(fmt.Errorf("stall-timeout: must not be negative, got %s", s.StallTimeout))
+	}
+	if s.MinSpeed.Speed < 0 {
+		m.Add(fmt.Errorf("min-speed.speed: must not be negative, got %d", s.MinSpeed.Speed))
+	}
+	if s.MinSpeed.Window <= 0 {
+		m.Add(fmt.Errorf("min-speed.window: must be positive, got %s", s.MinSpeed.Window))
+	}
+	if s.MaxFileSize < 0 {
+		m.Add(fmt.Errorf("max-filesize: must not be negative, got %d", s.MaxFileSize))
+	}
+	if s.MaxTotal < 0 {
+		m.Add(fmt.Errorf("max-total: must not be negative, got %d", s.MaxTotal))
+	}
+	if s.SlowMirror.Speed < 0 {
+		m.Add(fmt.Errorf("slow-mirror.speed: must not be negative, got %d", s.SlowMirror.Speed))
+	}
+	if s.SlowMirror.Window <= 0 {
+		m.Add(fmt.Errorf("slow-mirror.window: must be positive, got %s", s.SlowMirror.Window))
+	}
+	if _, err := ParseSchedulePolicy(string(s.Schedule)); err != nil {
+		m.Add(fmt.Errorf("schedule: %w", err))
+	}
+	if s.ScheduleWindow < 1 {
+		m.Add(errors.New("schedule-window: must be at least 1"))
+	}
+	if s.Pipe != "" {
+		if args, err := splitCommand(s.Pipe); err != nil || len(args) == 0 {
+			m.Add(fmt.Errorf("pipe: invalid command %q", s.Pipe))
+		}
+		if s.Mirror {
+			m.Add(errors.New("pipe: cannot be used with mirror, which compares against saved files"))
+		}
+	}
+	if s.WARC.Enabled {
+		if s.Pipe != "" {
+			m.Add(errors.New("warc: cannot be used with pipe"))
+		}
+		if s.Mirror {
+			m.Add(errors.New("warc: cannot be used with mirror, which compares against saved files"))
+		}
+	}
+	if s.TUI && slices.Contains(s.InputFiles, "-") {
+		m.Add(errors.New("tui: cannot read URLs from stdin, which is used for the keyboard"))
+	}
+	if s.Retry.DelayMin <= 0 {
+		m.Add(fmt.Errorf("retry.delay-min: must be positive, got %s", s.Retry.DelayMin))
+	}
+	if s.Retry.DelayMax < s.Retry.DelayMin {
+		m.Add(fmt.Errorf("retry.delay-max: must not be less than delay-min (%s), got %s", s.Retry.DelayMin, s.Retry.DelayMax))
+	}
+	if s.Retry.Limit < 1 {
+		m.Add(errors.New("retry.limit: must be at least 1"))
+	}
+	for _, name := range sortedKeys(s.Headers) {
+		if !validHeaderName(name) {
+			m.Add(fmt.Errorf("headers: invalid header name %q", name))
+		}
+		if strings.ContainsAny(s.Headers[name], "\r\n") {
+			m.Add(fmt.Errorf("headers: value of %q must not contain newlines", name))
+		}
+	}
+	for _, host := range sortedKeys(s.Hosts) {
+		if host == "" {
+			m.Add(errors.New("hosts: host name must not be empty"))
+		}
+		if s.Hosts[host].MaxConnections < 1 {
+			m.Add(fmt.Errorf("hosts.%s.max-connections: must be at least 1", host))
+		}
+	}
+
+	if err := s.Transport.validate(); err != nil {
+		m.Add(err)
+	}
+	if err := s.S3.validate(); err != nil {
+		m.Add(err)
+	}
+	if err := s.Crawl.validate(); err != nil {
+		m.Add(err)
+	}
+	if err := s.Hooks.validate(); err != nil {
+		m.Add(err)
+	}
+	if err := s.Trace.validate(); err != nil {
+		m.Add(err)
+	}
+	if err := s.WARC.validate(); err != nil {
+		m.Add(err)
+	}
+
+	if err := m.Err(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// validateStdout checks "-O", which makes sense only for a single download
+// written to stdout.
+func (s *settings) validateStdout(output string, tasks Tasks, journal string) error {
+	m := multierr.New()
+
+	if output != "-" {
+		m.Add(fmt.Errorf("-O: only \"-\" (stdout) is supported, got %q", output))
+	}
+	if len(tasks) != 1 || len(s.InputFiles) > 0 || len(s.Metalinks) > 0 {
+		m.Add(errors.New("-O -: exactly one URL must be given as an argument"))
+	}
+	if s.Recursive {
+		m.Add(errors.New("-O -: cannot be used with recursive"))
+	}
+	if s.Mirror {
+		m.Add(errors.New("-O -: cannot be used with mirror"))
+	}
+	if s.Pipe != "" {
+		m.Add(errors.New("-O -: cannot be used with pipe"))
 	}
+	if s.TUI {
+		m.Add(errors.New("-O -: cannot be used with tui"))
+	}
+	if s.WARC.Enabled {
+		m.Add(errors.New("-O -: cannot be used with warc"))
+	}
+	if journal != "" {
+		m.Add(errors.New("-O -: cannot be used with journal, since the output cannot be resumed"))
+	}
+
+	if err := m.Err(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// validateWatch はwatchコマンドで使えない組み合わせを検出する
+func (s *settings) validateWatch() error {
+	m := multierr.New()
+
+	if err := s.Watch.validate(); err != nil {
+		m.Add(err)
+	}
+	if s.Recursive {
+		m.Add(errors.New("watch: cannot be used with recursive"))
+	}
+	if s.Pipe != "" {
+		m.Add(errors.New("watch: cannot be used with pipe, which keeps no previous version"))
+	}
+	if s.WARC.Enabled {
+		m.Add(errors.New("watch: cannot be used with warc"))
+	}
+	if s.FailFast {
+		m.Add(errors.New("watch: cannot be used with fail-fast, since a failed check is retried on the next one"))
+	}
+
+	if err := m.Err(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// validateServe はserveコマンドで使えない組み合わせを検出する
+func (s *settings) validateServe() error {
+	m := multierr.New()
+
+	if s.TUI {
+		m.Add(errors.New("serve: cannot be used with tui"))
+	}
+	if s.FailFast {
+		m.Add(errors.New("serve: cannot be used with fail-fast"))
+	}
+
+	if err := m.Err(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// findConfigFile returns the config file to load, or "" if there is none.
+// An explicitly given file must exist, while the XDG locations are optional.
+func findConfigFile(explicit string, getenv func(string) string) (string, error) {
+	if explicit == "" {
+		explicit = getenv(envPrefix + "CONFIG")
+	}
+	if explicit != "" {
+		if _, err := os.Stat(explicit); err != nil {
+			return "", fmt.Errorf("config file: %w", err)
+		}
+		return explicit, nil
+	}
+
+	var dirs []string
+	if home := getenv("XDG_CONFIG_HOME"); home != "" {
+		dirs = append(dirs, home)
+	} else if home := getenv("HOME"); home != "" {
+		dirs = append(dirs, filepath.Join(home, ".config"))
+	}
+	xdgDirs := getenv("XDG_CONFIG_DIRS")
+	if xdgDirs == "" {
+		xdgDirs = "/etc/xdg"
+	}
+	dirs = append(dirs, filepath.SplitList(xdgDirs)...)
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, configDirName, configFileName)
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("config file: %w", err)
+		}
+	}
+	return "", nil
+}
+
+// commandOnly は設定ファイルや環境変数では指定できない、その場限りのフラグ
+func commandOnly(name string) bool {
+	switch name {
+	case "config", "print-config", "dry-run", "O", "journal", "listen":
+		return true
+	}
+	return false
 }
 
-func NewConfigFromFlags() *Config {
-	outputDir := flag.String("output-dir", defaultOutputDir, "output directory")
-	workers := flag.Uint("workers", defaultWorkers, "number of worker goroutines")
-	timeout := flag.Duration("request-timeout", defaultTimeout, "timeout per request")
+// envName converts a flag name to its environment variable, e.g. "output-dir" -> "DOWNLOADER_OUTPUT_DIR".
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
 
-	flag.Parse()
-	urls := flag.Args()
-	tasks := NewTasks(urls...)
+func parseUint(s string) (uint, error) {
+	n, err := strconv.ParseUint(s, 10, 0)
+	return uint(n), err
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listFlag は繰り返し指定できるフラグ
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, envListSep)
+}
 
-	return NewConfig(*outputDir, *workers, *timeout, tasks)
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrCanceled is the error of a download canceled with Cancel.
+var ErrCanceled = errors.New("canceled")
+
+// runningTask は実行中のダウンロードを止めるための関数を持つ
+type runningTask struct {
+	cancel context.CancelCauseFunc
+	pause  *pauseGate
+}
+
+// Cancel stops the download of url, whether it is running or waiting in the
+// queue. It reports whether there was such a download.
+func (dc *DownloadController) Cancel(url string) bool {
+	if r, ok := dc.runningTask(url); ok {
+		r.cancel(ErrCanceled)
+		return true
+	}
+
+	task, ok := dc.queue.remove(url)
+	if !ok {
+		return false
+	}
+	dc.abort(context.Background(), task, ErrCanceled)
+	return true
+}
+
+// Retry queues again a download that was aborted or canceled. It reports
+// whether url had failed.
+func (dc *DownloadController) Retry(url string) bool {
+	dc.mu.Lock()
+	task, ok := dc.failed[url]
+	delete(dc.failed, url)
+	dc.mu.Unlock()
+	return ok && dc.Add(task)
+}
+
+// Add queues task while Run is running, even if its URL has already been
+// downloaded. It reports whether the task was queued.
+func (dc *DownloadController) Add(task Task) bool {
+	dc.mu.Lock()
+	ctx := dc.ctx
+	dc.mu.Unlock()
+	if ctx == nil {
+		return false
+	}
+
+	// 再帰モードで重複として読み飛ばされないようにする
+	dc.seenMu.Lock()
+	delete(dc.seen, task.url)
+	dc.seenMu.Unlock()
+
+	dc.queue.push(ctx, task)
+	return true
+}
+
+// Prioritize makes the queued download of url the next one to start.
+func (dc *DownloadController) Prioritize(url string) bool {
+	return dc.queue.prioritize(url)
+}
+
+// Pause stops reading the running download of url without canceling it,
+// until Resume is called. It reports whether url was running and not paused.
+func (dc *DownloadController) Pause(url string) bool {
+	r, ok := dc.runningTask(url)
+	if !ok || !r.pause.pause() {
+		return false
+	}
+	dc.pub.Publish(EventPause{URL: url})
+	return true
+}
+
+// Resume continues a download paused with Pause.
+func (dc *DownloadController) Resume(url string) bool {
+	r, ok := dc.runningTask(url)
+	if !ok || !r.pause.resume() {
+		return false
+	}
+	dc.pub.Publish(EventResume{URL: url})
+	return true
+}
+
+// PauseAll pauses every running download and stops starting new ones,
+// until ResumeAll is called. Downloads paused with Pause stay paused after
+// ResumeAll.
+func (dc *DownloadController) PauseAll() bool {
+	if !dc.paused.pause() {
+		return false
+	}
+	dc.queue.setPaused(true)
+	dc.pub.Publish(EventPause{})
+	return true
+}
+
+// ResumeAll ends PauseAll.
+func (dc *DownloadController) ResumeAll() bool {
+	if !dc.paused.resume() {
+		return false
+	}
+	dc.queue.setPaused(false)
+	dc.pub.Publish(EventResume{})
+	return true
+}
+
+// Hold keeps Run from returning when the queue becomes empty, so that
+// failed downloads can still be retried, until release is called. Drain
+// and the cancellation of Run end it as usual.
+func (dc *DownloadController) Hold() (release func()) {
+	dc.queue.hold()
+	return sync.OnceFunc(dc.queue.release)
+}
+
+// abort reports that task failed and keeps it for Retry. A download stopped
+// by Cancel or --fail-fast is reported with the cause of the cancellation
+// rather than the errors it caused.
+func (dc *DownloadController) abort(ctx context.Context, task Task, err error) {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrCanceled) {
+		err = cause
+	}
+	spanFromContext(ctx).SetError(err)
+	dc.setFailed(task)
+	dc.pub.Publish(NewEventAbort(task.url, err))
+	dc.failFast(task.url, err)
+}
+
+// failFast は WithFailFast のとき、url の失敗で実行中のダウンロードをキャンセルし、
+// 新しいダウンロードを始めないようにする
+func (dc *DownloadController) failFast(url string, err error) {
+	if !dc.failFastOn || errors.Is(err, ErrCanceled) {
+		return
+	}
+	dc.failFastOnce.Do(func() {
+		cause := &FailFastError{URL: url}
+		dc.Drain()
+
+		dc.mu.Lock()
+		dc.stopped = cause
+		running := make([]runningTask, 0, len(dc.running))
+		for _, r := range dc.running {
+			running = append(running, r)
+		}
+		dc.mu.Unlock()
+		for _, r := range running {
+			r.cancel(cause)
+		}
+	})
+}
+
+func (dc *DownloadController) setFailed(task Task) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.failed[task.url] = task
+}
+
+// setRunning は実行中のダウンロードを登録する。r がnilなら登録を外す。
+// --fail-fast で止めた後に始まったものはすぐにキャンセルする。
+func (dc *DownloadController) setRunning(url string, r *runningTask) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if r == nil {
+		delete(dc.running, url)
+		return
+	}
+	if dc.stopped != nil {
+		r.cancel(dc.stopped)
+	}
+	dc.running[url] = *r
+}
+
+func (dc *DownloadController) runningTask(url string) (runningTask, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	r, ok := dc.running[url]
+	return r, ok
+}
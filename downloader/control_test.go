@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestDownloadController_Controls(t *testing.T) {
+	started := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		// /a はキャンセルされるまで応答しない
+		if r.URL.Path == "/a" {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer ts.Close()
+
+	var tasks []Task
+	for _, p := range []string{"/a", "/b", "/c", "/d"} {
+		tasks = append(tasks, *NewTask(ts.URL + p))
+	}
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	policy := defaultPolicy
+	// キャンセルされた /a を再試行しないよう、1回だけ試行する
+	policy.RetryLimit = 1
+	dc := NewDownloadController(NewSliceSource(tasks...), &policy, pub, NewFileSaver(t.TempDir(), NewOSFS()), 1, WithReadAhead(10))
+	release := dc.Hold()
+
+	errc := make(chan error)
+	go func() { errc <- dc.Run(context.Background()) }()
+
+	// /a の実行中は残りがキューで待っている
+	if got := <-started; got != "/a" {
+		t.Fatalf("first download = %s, want /a", got)
+	}
+	if !dc.Prioritize(ts.URL + "/d") {
+		t.Error("Prioritize(/d) = false, want true")
+	}
+	if !dc.Cancel(ts.URL + "/c") {
+		t.Error("Cancel(/c) = false, want true")
+	}
+	if !dc.Cancel(ts.URL + "/a") {
+		t.Error("Cancel(/a) = false, want true")
+	}
+	if dc.Retry(ts.URL + "/b") {
+		t.Error("Retry(/b) = true for a download that has not failed")
+	}
+
+	for rec.count(EventTypeEnd) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if !dc.Retry(ts.URL + "/c") {
+		t.Error("Retry(/c) = false, want true")
+	}
+	for rec.count(EventTypeEnd) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	close(started)
+	var order []string
+	for p := range started {
+		order = append(order, p)
+	}
+	if diff := cmp.Diff([]string{"/d", "/b", "/c"}, order); diff != "" {
+		t.Errorf("download order mismatch (-want +got):\n%s", diff)
+	}
+	for _, e := range rec.events {
+		if abort, ok := e.(EventAbort); ok && !errors.Is(abort.Err, ErrCanceled) {
+			t.Errorf("abort of %s: %v, want ErrCanceled", abort.URL, abort.Err)
+		}
+	}
+	if got := rec.count(EventTypeAbort); got != 2 {
+		t.Errorf("%d aborts, want 2", got)
+	}
+}
+
+func TestDownloadController_FailFast(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hang":
+			<-r.Context().Done()
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "done")
+		}
+	}))
+	defer ts.Close()
+
+	var tasks []Task
+	for _, p := range []string{"/hang", "/fail", "/c", "/d"} {
+		tasks = append(tasks, *NewTask(ts.URL + p))
+	}
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	policy := defaultPolicy
+	policy.RetryLimit = 1
+	dc := NewDownloadController(NewSliceSource(tasks...), &policy, pub, NewFileSaver(t.TempDir(), NewOSFS()), 2, WithFailFast())
+
+	done := make(chan error)
+	go func() { done <- dc.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after a download failed")
+	}
+
+	aborts := make(map[string]error)
+	var started []string
+	for _, e := range rec.events {
+		switch e := e.(type) {
+		case EventAbort:
+			aborts[e.URL] = e.Err
+		case EventStart:
+			started = append(started, e.URL)
+		}
+	}
+	if err := aborts[ts.URL+"/fail"]; !errors.As(err, new(*HTTPStatusError)) {
+		t.Errorf("/fail: err = %v, want HTTPStatusError", err)
+	}
+	var failFast *FailFastError
+	if err := aborts[ts.URL+"/hang"]; !errors.As(err, &failFast) || failFast.URL != ts.URL+"/fail" || !errors.Is(err, ErrCanceled) {
+		t.Errorf("/hang: err = %v, want it canceled by the failure of /fail", err)
+	}
+	if len(started) != 2 {
+		t.Errorf("started %v, want only /hang and /fail", started)
+	}
+	if rec.count(EventTypeDrain) != 1 {
+		t.Errorf("%d drain events, want 1", rec.count(EventTypeDrain))
+	}
+}
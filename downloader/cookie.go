@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	netscapeHeader = "# Netscape HTTP Cookie File\n"
+	// httpOnlyPrefix はcurlがHttpOnlyのCookieのドメインに付ける接頭辞
+	httpOnlyPrefix = "#HttpOnly_"
+)
+
+// CookieJar is an http.CookieJar that can be loaded from and saved to a
+// Netscape cookie file, as written by curl, wget and browser extensions.
+//
+// net/http/cookiejar does not list its cookies, so the jar keeps its own
+// copy of every cookie stored to write them out.
+type CookieJar struct {
+	jar *cookiejar.Jar
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[cookieKey]cookieEntry
+}
+
+type cookieKey struct {
+	domain, path, name string
+}
+
+type cookieEntry struct {
+	cookie *http.Cookie
+	// hostOnly なCookieは domain のホストにだけ送る
+	hostOnly bool
+	// expires がゼロならセッションCookie
+	expires time.Time
+}
+
+func NewCookieJar() *CookieJar {
+	// PublicSuffixListがnilでもエラーにはならない
+	jar, _ := cookiejar.New(nil)
+	return &CookieJar{jar: jar, now: time.Now, entries: make(map[cookieKey]cookieEntry)}
+}
+
+// SetCookies implements http.CookieJar.
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := strings.ToLower(u.Hostname())
+	now := j.now()
+	for _, c := range cookies {
+		e := cookieEntry{cookie: c, hostOnly: c.Domain == ""}
+		domain := host
+		if !e.hostOnly {
+			domain = strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+			// cookiejarと同じく、関係のないドメインのCookieは受け付けない
+			if host != domain && !strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+		}
+		p := c.Path
+		if !strings.HasPrefix(p, "/") {
+			p = defaultCookiePath(u.Path)
+		}
+		key := cookieKey{domain: domain, path: p, name: c.Name}
+
+		switch {
+		case c.MaxAge < 0:
+			delete(j.entries, key)
+			continue
+		case c.MaxAge > 0:
+			e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			if !c.Expires.After(now) {
+				delete(j.entries, key)
+				continue
+			}
+			e.expires = c.Expires
+		}
+		j.entries[key] = e
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// defaultCookiePath は RFC 6265 5.1.4 のデフォルトのパス
+func defaultCookiePath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.Count(p, "/") == 1 {
+		return "/"
+	}
+	return path.Dir(p)
+}
+
+// Load reads cookies in the Netscape format. Expired cookies are ignored.
+func (j *CookieJar) Load(r io.Reader) error {
+	now := j.now()
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("line %d: want 7 tab-separated fields, got %d", lineNo, len(fields))
+		}
+		domain, subdomains, p, secure, expiry, name, value := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+		expires, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expiry %q", lineNo, expiry)
+		}
+
+		c := &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     p,
+			Secure:   strings.EqualFold(secure, "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		// 0はセッションCookie
+		if expires != 0 {
+			c.Expires = time.Unix(expires, 0)
+			if !c.Expires.After(now) {
+				continue
+			}
+		}
+		host := strings.TrimPrefix(domain, ".")
+		if strings.EqualFold(subdomains, "TRUE") {
+			c.Domain = host
+		}
+
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		j.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: p}, []*http.Cookie{c})
+	}
+	return sc.Err()
+}
+
+// WriteTo writes the cookies in the Netscape format. Session cookies are
+// written with an expiry of 0.
+func (j *CookieJar) WriteTo(w io.Writer) (int64, error) {
+	j.mu.Lock()
+	keys := make([]cookieKey, 0, len(j.entries))
+	for key := range j.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		ka, kb := keys[a], keys[b]
+		if ka.domain != kb.domain {
+			return ka.domain < kb.domain
+		}
+		if ka.path != kb.path {
+			return ka.path < kb.path
+		}
+		return ka.name < kb.name
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString(netscapeHeader)
+	now := j.now()
+	for _, key := range keys {
+		e := j.entries[key]
+		var expires int64
+		if !e.expires.IsZero() {
+			if !e.expires.After(now) {
+				continue
+			}
+			expires = e.expires.Unix()
+		}
+
+		domain, subdomains := key.domain, "FALSE"
+		if !e.hostOnly {
+			domain, subdomains = "."+domain, "TRUE"
+		}
+		if e.cookie.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, subdomains, key.path, strings.ToUpper(strconv.FormatBool(e.cookie.Secure)), expires, key.name, e.cookie.Value)
+	}
+	j.mu.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+// LoadFile reads the cookie file at path.
+func (j *CookieJar) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cookies: %w", err)
+	}
+	defer f.Close()
+	if err := j.Load(f); err != nil {
+		return fmt.Errorf("cookies %s: %w", path, err)
+	}
+	return nil
+}
+
+// SaveFile writes the cookies to path. The file is readable only by the
+// user, since it may hold login sessions.
+func (j *CookieJar) SaveFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cookie jar: %w", err)
+	}
+	_, err = j.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cookie jar: %w", err)
+	}
+	return nil
+}
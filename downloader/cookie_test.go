@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+const testCookieFile = `# Netscape HTTP Cookie File
+# comment
+
+example.com	FALSE	/	FALSE	0	session	s1
+.example.com	TRUE	/docs	TRUE	4102444800	secure	s2
+#HttpOnly_example.com	FALSE	/	FALSE	4102444800	httponly	s3
+example.com	FALSE	/	FALSE	946684800	expired	s4
+`
+
+func TestCookieJar_Load(t *testing.T) {
+	jar := NewCookieJar()
+	if err := jar.Load(strings.NewReader(testCookieFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"http://example.com/":           "session=s1; httponly=s3",
+		"https://www.example.com/docs/": "secure=s2",
+		"https://example.com/docs/a":    "secure=s2; session=s1; httponly=s3",
+		"http://example.com/docs/a":     "session=s1; httponly=s3",
+	}
+	for rawURL, want := range tests {
+		u, _ := url.Parse(rawURL)
+		req := &http.Request{Header: make(http.Header)}
+		for _, c := range jar.Cookies(u) {
+			req.AddCookie(c)
+		}
+		if got := req.Header.Get("Cookie"); got != want {
+			t.Errorf("%s: Cookie = %q, want %q", rawURL, got, want)
+		}
+	}
+}
+
+func TestCookieJar_WriteTo(t *testing.T) {
+	jar := NewCookieJar()
+	jar.now = func() time.Time { return time.Unix(1_700_000_000, 0) }
+	if err := jar.Load(strings.NewReader(testCookieFile)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://login.example.com/auth/callback")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "token", Value: "t1", MaxAge: 60},
+		{Name: "session", Value: "deleted", Domain: "example.com", Path: "/", MaxAge: -1},
+		{Name: "other", Value: "x", Domain: "other.com"},
+	})
+
+	var b strings.Builder
+	if _, err := jar.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := netscapeHeader +
+		"#HttpOnly_example.com\tFALSE\t/\tFALSE\t4102444800\thttponly\ts3\n" +
+		".example.com\tTRUE\t/docs\tTRUE\t4102444800\tsecure\ts2\n" +
+		"login.example.com\tFALSE\t/auth\tFALSE\t1700000060\ttoken\tt1\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("WriteTo mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCookieJar_Load_Invalid(t *testing.T) {
+	err := NewCookieJar().Load(strings.NewReader("example.com\tFALSE\t/\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("err = %v, want an error on line 1", err)
+	}
+}
+
+// ログインで得たCookieを、同じjarを使う後続のダウンロードが送る
+func TestDownloadWorker_Cookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/file", http.StatusFound)
+		case "/file":
+			if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+				http.Error(w, "login required", http.StatusForbidden)
+				return
+			}
+			io.WriteString(w, "secret")
+		}
+	}))
+	defer ts.Close()
+
+	client := newFetcherClient(t, nil)
+	client.Jar = NewCookieJar()
+	pub := pubsub.NewPublisher[Event]()
+
+	for _, path := range []string{"/login", "/file"} {
+		d := NewDownloadWorker(ts.URL+path, &defaultPolicy, pub, WithClient(client))
+		body, _, err := d.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if string(got) != "secret" {
+			t.Errorf("%s: body = %q, want %q", path, got, "secret")
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/no-yan/multierr"
+	"github.com/no-yan/tmp/downloader/internal/robots"
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultMaxDepth = 5
+	defaultAgent    = "downloader"
+
+	// リンク抽出のためにメモリに保持するHTMLの上限
+	maxPageSize   = 8 << 20
+	maxRobotsSize = 512 << 10
+)
+
+// CrawlConfig is the configuration of the recursive mode.
+type CrawlConfig struct {
+	MaxDepth int      `yaml:"max-depth"`
+	SameHost bool     `yaml:"same-host"`
+	Include  []string `yaml:"include,omitempty"`
+	Exclude  []string `yaml:"exclude,omitempty"`
+	Robots   bool     `yaml:"robots"`
+}
+
+func defaultCrawlConfig() CrawlConfig {
+	return CrawlConfig{
+		MaxDepth: defaultMaxDepth,
+		Robots:   true,
+	}
+}
+
+func (cc CrawlConfig) validate() error {
+	m := multierr.New()
+
+	if cc.MaxDepth < 0 {
+		m.Add(fmt.Errorf("crawl.max-depth: must not be negative, got %d", cc.MaxDepth))
+	}
+	if _, err := compilePatterns(cc.Include); err != nil {
+		m.Add(fmt.Errorf("crawl.include: %w", err))
+	}
+	if _, err := compilePatterns(cc.Exclude); err != nil {
+		m.Add(fmt.Errorf("crawl.exclude: %w", err))
+	}
+
+	return m.Err()
+}
+
+// Crawler decides which links found in downloaded HTML are followed.
+type Crawler struct {
+	maxDepth int
+	sameHost bool
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+
+	hostsMu sync.RWMutex
+	hosts   map[string]bool
+
+	robots      bool
+	client      *http.Client
+	agent       string
+	mu          sync.Mutex
+	robotsCache map[string]*robotsEntry
+}
+
+// robotsEntry は取得済みの robots.txt。mu は同じオリジンへの取得を1回にまとめる
+type robotsEntry struct {
+	mu    sync.Mutex
+	rules *robots.Rules
+}
+
+func NewCrawler(cc CrawlConfig, client *http.Client, agent string) (*Crawler, error) {
+	include, err := compilePatterns(cc.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(cc.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if agent == "" {
+		agent = defaultAgent
+	}
+
+	return &Crawler{
+		maxDepth:    cc.MaxDepth,
+		sameHost:    cc.SameHost,
+		hosts:       make(map[string]bool),
+		include:     include,
+		exclude:     exclude,
+		robots:      cc.Robots,
+		client:      client,
+		agent:       agent,
+		robotsCache: make(map[string]*robotsEntry),
+	}, nil
+}
+
+// AddSeed registers the host of a URL given as input for --same-host.
+func (c *Crawler) AddSeed(seed string) {
+	u, err := url.Parse(seed)
+	if err != nil {
+		return
+	}
+	c.hostsMu.Lock()
+	defer c.hostsMu.Unlock()
+	c.hosts[strings.ToLower(u.Hostname())] = true
+}
+
+func (c *Crawler) sameHostAs(u *url.URL) bool {
+	c.hostsMu.RLock()
+	defer c.hostsMu.RUnlock()
+	return c.hosts[strings.ToLower(u.Hostname())]
+}
+
+// Follow reports whether links of a page at depth are followed.
+func (c *Crawler) Follow(depth int) bool {
+	return depth < c.maxDepth
+}
+
+// Allowed reports whether a discovered link may be downloaded.
+func (c *Crawler) Allowed(ctx context.Context, u *url.URL) bool {
+	if c.sameHost && !c.sameHostAs(u) {
+		return false
+	}
+
+	s := u.String()
+	if len(c.include) > 0 && !matchAny(c.include, s) {
+		return false
+	}
+	if matchAny(c.exclude, s) {
+		return false
+	}
+
+	if c.robots {
+		return c.robotsRules(ctx, u).Allowed(u.RequestURI())
+	}
+	return true
+}
+
+func (c *Crawler) robotsRules(ctx context.Context, u *url.URL) *robots.Rules {
+	origin := u.Scheme + "://" + u.Host
+
+	c.mu.Lock()
+	e, ok := c.robotsCache[origin]
+	if !ok {
+		e = &robotsEntry{}
+		c.robotsCache[origin] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rules != nil {
+		return e.rules
+	}
+	rules := c.fetchRobots(ctx, origin)
+	// キャンセルされたダウンロードで取得できなかった結果は、他のダウンロードに使わない
+	if ctx.Err() == nil {
+		e.rules = rules
+	}
+	return rules
+}
+
+// fetchRobots follows RFC 9309: a missing robots.txt allows everything,
+// while an unreachable one disallows everything.
+func (c *Crawler) fetchRobots(ctx context.Context, origin string) *robots.Rules {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return robots.DisallowAll
+	}
+	req.Header.Set("User-Agent", c.agent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return robots.DisallowAll
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return robots.Parse(io.LimitReader(resp.Body, maxRobotsSize), c.agent)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return robots.AllowAll
+	default:
+		return robots.DisallowAll
+	}
+}
+
+// ExtractLinks returns the absolute http(s) URLs in href and src attributes.
+func ExtractLinks(r io.Reader, base *url.URL) []*url.URL {
+	var links []*url.URL
+
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" && string(key) != "src" {
+					continue
+				}
+				u, err := base.Parse(strings.TrimSpace(string(val)))
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					continue
+				}
+				u.Fragment = ""
+				u.RawFragment = ""
+
+				// <base href>は以降の相対URLの基準になる
+				if string(name) == "base" && string(key) == "href" {
+					base = u
+					continue
+				}
+				links = append(links, u)
+			}
+		}
+	}
+}
+
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageBuffer はlimitを超えた分を捨てるio.Writer
+type pageBuffer struct {
+	buf   strings.Builder
+	limit int
+}
+
+func (p *pageBuffer) Write(b []byte) (int, error) {
+	if rest := p.limit - p.buf.Len(); rest > 0 {
+		p.buf.Write(b[:min(len(b), rest)])
+	}
+	return len(b), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestExtractLinks(t *testing.T) {
+	page := `<html><head><link href="style.css"></head><body>
+<a href="/a#frag">a</a>
+<img src="img/b.png"/>
+<a href="mailto:someone@example.com">mail</a>
+<base href="https://other.example/dir/">
+<a href="c">c</a>
+</body></html>`
+	base, _ := url.Parse("https://example.com/docs/index.html")
+
+	var got []string
+	for _, u := range ExtractLinks(strings.NewReader(page), base) {
+		got = append(got, u.String())
+	}
+
+	want := []string{
+		"https://example.com/docs/style.css",
+		"https://example.com/a",
+		"https://example.com/docs/img/b.png",
+		"https://other.example/dir/c",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExtractLinks() mismatch: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestDownloadController_Recursive(t *testing.T) {
+	mux := http.NewServeMux()
+	html := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/", html(`<a href="/a.html">a</a><a href="/private/x">x</a><a href="/skip.zip">zip</a><a href="http://external.invalid/">ext</a>`))
+	mux.HandleFunc("/a.html", html(`<a href="/">root</a><a href="/b.html">b</a>`))
+	mux.HandleFunc("/b.html", html(`<a href="/c.html">c</a>`))
+	mux.HandleFunc("/c.html", html(`too deep`))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := defaultCrawlConfig()
+	cc.MaxDepth = 2
+	cc.SameHost = true
+	cc.Exclude = []string{`\.zip$`}
+	crawler, err := NewCrawler(cc, http.DefaultClient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	dc := NewDownloadController(NewSliceSource(*NewTask(ts.URL + "/")), &defaultPolicy, pub, saver, 2, WithCrawler(crawler))
+	dc.Run(context.Background())
+
+	var got []string
+	for _, e := range rec.events {
+		if e, ok := e.(EventEnd); ok {
+			got = append(got, strings.TrimPrefix(e.URL, ts.URL))
+		}
+	}
+	slices.Sort(got)
+
+	want := []string{"/", "/a.html", "/b.html"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("downloaded URLs mismatch: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestDownloadController_RecursiveMirror(t *testing.T) {
+	mux := http.NewServeMux()
+	html := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/", html(`<html><a href="/a.html">a</a></html>`))
+	mux.HandleFunc("/a.html", html(`<html><a href="/b.html">b</a></html>`))
+	mux.HandleFunc("/b.html", html(`<html>b</html>`))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := defaultCrawlConfig()
+	cc.Robots = false
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+
+	// 2回目はすべて 304 になるが、保存済みのページからリンクを辿る
+	for run, want := range []EventType{EventTypeEnd, EventTypeUnchanged} {
+		crawler, err := NewCrawler(cc, http.DefaultClient, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &eventRecorder{}
+		pub := pubsub.NewPublisher[Event]()
+		pub.Register(rec)
+		dc := NewDownloadController(NewSliceSource(*NewTask(ts.URL + "/")), &defaultPolicy, pub, saver, 2, WithCrawler(crawler), WithValidatorStore(saver))
+		dc.Run(context.Background())
+
+		if got := rec.count(want); got != 3 {
+			t.Errorf("run %d: %d pages, want 3", run+1, got)
+		}
+	}
+}
+
+func TestCrawler_RobotsCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	}))
+	defer ts.Close()
+
+	cc := defaultCrawlConfig()
+	crawler, err := NewCrawler(cc, http.DefaultClient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(ts.URL + "/a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if crawler.Allowed(ctx, u) {
+		t.Error("allowed without robots.txt")
+	}
+	// キャンセルされた取得の結果は他のダウンロードに使わない
+	if !crawler.Allowed(context.Background(), u) {
+		t.Error("disallowed after a canceled fetch of robots.txt")
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/no-yan/multierr"
 	"github.com/no-yan/tmp/downloader/internal/backoff"
@@ -15,103 +20,684 @@ import (
 
 type Task struct {
 	url string
+	// depth は再帰モードでシードから辿ったリンクの数
+	depth int
+	// priority の大きいタスクほど先に開始する
+	priority int
+	// mirrors は url と同じ内容を返す別のURL
+	mirrors []string
+
+	// スケジューラが使う値。size は不明なとき-1
+	size int64
+	seq  uint64
+	// pinned は Prioritize で優先されたタスクで、後から優先したものほど大きい
+	pinned uint64
 }
 
 func NewTask(url string) *Task {
-	return &Task{url}
+	return &Task{url: url}
 }
 
-type Tasks map[string]Task
+// Tasks are the tasks given as arguments, in the order they were given.
+type Tasks []Task
 
-func NewTasks(urls ...string) Tasks {
-	m := make(Tasks)
+// Duplicate is a URL that was dropped because it normalizes to the same
+// URL as an earlier one.
+type Duplicate struct {
+	URL string
+	Of  string
+}
+
+// NewTasks normalizes urls and drops duplicates. The error lists every
+// malformed URL.
+func NewTasks(urls ...string) (Tasks, []Duplicate, error) {
+	var tasks Tasks
+	raw := make(map[string]string)
+	var dups []Duplicate
+	errs := multierr.New()
 
 	for _, url := range urls {
-		m[url] = *NewTask(url)
+		normalized, err := NormalizeURL(url)
+		if err != nil {
+			errs.Add(fmt.Errorf("%q: %w", url, err))
+			continue
+		}
+		if first, ok := raw[normalized]; ok {
+			dups = append(dups, Duplicate{URL: url, Of: first})
+			continue
+		}
+		raw[normalized] = url
+		tasks = append(tasks, *NewTask(normalized))
 	}
-	return m
+
+	if err := errs.Err(); err != nil {
+		return nil, nil, fmt.Errorf("invalid URLs:\n%w", err)
+	}
+	return tasks, dups, nil
+}
+
+// Source returns the tasks as a TaskSource, in order.
+func (t Tasks) Source() TaskSource {
+	return NewSliceSource(t...)
 }
 
 type Saver interface {
 	Save(r io.Reader, url string) (int64, error)
 }
 
+// pathSaver is a Saver that stores each URL in a file.
+type pathSaver interface {
+	Path(url string) string
+}
+
+// Validators are the cache validators of a downloaded response,
+// sent back as If-None-Match/If-Modified-Since on the next run.
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func validatorsFromHeader(h http.Header) Validators {
+	return Validators{
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+	}
+}
+
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+type ValidatorStore interface {
+	// LoadValidators returns the validators of the previous download of url.
+	// ok is false if url has not been downloaded or its output is gone.
+	LoadValidators(url string) (v Validators, ok bool)
+	StoreValidators(url string, v Validators) error
+}
+
+// ErrNotModified is returned by DownloadWorker.Run when the server answered 304.
+var ErrNotModified = errors.New("not modified")
+
 type DownloadController struct {
-	tasks  map[string]Task
-	policy *backoff.Policy
-	pub    *pubsub.Publisher[Event]
-	sem    chan int
-	wg     *sync.WaitGroup
-	saver  Saver
+	queue      *taskQueue
+	policy     *backoff.Policy
+	pub        *pubsub.Publisher[Event]
+	workers    uint
+	hostSems   map[string]chan int
+	wg         *sync.WaitGroup
+	saver      Saver
+	validators ValidatorStore
+	crawler    *Crawler
+	seen       map[string]bool
+	seenMu     sync.Mutex
+	workerOpts []WorkerOption
+	drain      context.Context
+	limiter    *AdaptiveLimiter
+	tracer     *Tracer
+	limits     *sizeLimits
+	diskFull   sync.Once
+	// failFastOn は最初の失敗で残りのダウンロードを止める
+	failFastOn   bool
+	failFastOnce sync.Once
+
+	// ctx は Run に渡されたもので、Retry で戻したタスクのプローブに使う
+	ctx context.Context
+	mu  sync.Mutex
+	// running は実行中のダウンロードを、failed は Retry できるタスクを保持する
+	running map[string]runningTask
+	failed  map[string]Task
+	// stopped は --fail-fast で止めた原因で、その後に始まったダウンロードもキャンセルする
+	stopped error
+	// paused は全体の一時停止で、すべてのダウンロードに付く
+	paused *pauseGate
+}
+
+type ControllerOption func(*DownloadController)
+
+// WithHostLimits limits the number of concurrent downloads per host.
+// Keys are either "host" or "host:port".
+func WithHostLimits(limits map[string]uint) ControllerOption {
+	return func(dc *DownloadController) {
+		for host, n := range limits {
+			dc.hostSems[host] = make(chan int, n)
+		}
+	}
+}
+
+// WithValidatorStore enables conditional requests: validators of each
+// successful download are saved to store and sent on the next run.
+func WithValidatorStore(store ValidatorStore) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.validators = store
+	}
+}
+
+// WithCrawler makes the controller follow links in downloaded HTML pages.
+func WithCrawler(c *Crawler) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.crawler = c
+	}
+}
+
+// WithSchedule sets the order in which tasks are started. Up to window tasks
+// are read ahead from the source; probe is used by the size-aware policies.
+func WithSchedule(policy SchedulePolicy, window int, probe SizeProber) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.queue.schedule(policy, window, probe)
+	}
+}
+
+// WithDrain makes the controller drain when ctx is done: no new task is
+// started, while the ones in progress run to completion.
+func WithDrain(ctx context.Context) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.drain = ctx
+	}
+}
+
+// WithReadAhead keeps at least n tasks queued ahead of the workers, even
+// with the fifo schedule, so that they can be seen and prioritized.
+func WithReadAhead(n int) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.queue.readAhead(n)
+	}
+}
+
+// WithAdaptiveWorkers replaces the fixed number of workers with l, which
+// adjusts the number of concurrent downloads from the events.
+func WithAdaptiveWorkers(l *AdaptiveLimiter) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.workers = uint(l.maxLimit)
+		dc.limiter = l
+		dc.pub.Register(l)
+	}
+}
+
+// WithTracer traces every task as a span, with a child span per HTTP
+// attempt, and sends the trace context to the servers.
+func WithTracer(t *Tracer) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.tracer = t
+	}
+}
+
+// WithSizeLimits aborts files larger than maxFile bytes and stops accepting
+// files once maxTotal bytes have been downloaded. Zero means no limit.
+func WithSizeLimits(maxFile, maxTotal int64) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.limits.maxFile = maxFile
+		dc.limits.maxTotal = maxTotal
+	}
+}
+
+// WithFailFast makes the first failed download cancel the others and stop
+// new ones from starting. Downloads canceled with Cancel do not count as
+// failures.
+func WithFailFast() ControllerOption {
+	return func(dc *DownloadController) {
+		dc.failFastOn = true
+	}
 }
 
-func NewDownloadController(tasks Tasks, policy *backoff.Policy, publisher *pubsub.Publisher[Event], saver Saver, maxWorkers uint) *DownloadController {
-	sem := make(chan int, maxWorkers)
+// WithWorkerOptions applies opts to every DownloadWorker the controller starts.
+func WithWorkerOptions(opts ...WorkerOption) ControllerOption {
+	return func(dc *DownloadController) {
+		dc.workerOpts = append(dc.workerOpts, opts...)
+	}
+}
+
+func NewDownloadController(source TaskSource, policy *backoff.Policy, publisher *pubsub.Publisher[Event], saver Saver, maxWorkers uint, opts ...ControllerOption) *DownloadController {
 	wg := sync.WaitGroup{}
 
-	return &DownloadController{
-		sem:    sem,
-		policy: policy,
-		pub:    publisher,
-		wg:     &wg,
-		tasks:  tasks,
-		saver:  saver,
+	dc := &DownloadController{
+		workers:  maxWorkers,
+		hostSems: make(map[string]chan int),
+		policy:   policy,
+		pub:      publisher,
+		wg:       &wg,
+		queue:    newTaskQueue(source),
+		saver:    saver,
+		seen:     make(map[string]bool),
+		limits:   &sizeLimits{},
+		running:  make(map[string]runningTask),
+		failed:   make(map[string]Task),
+		paused:   newPauseGate(),
+	}
+	dc.queue.onAdd = func(task Task) {
+		dc.pub.Publish(EventQueued{URL: task.url})
 	}
+	if ss, ok := saver.(spaceSaver); ok {
+		dc.limits.space = ss
+	}
+	for _, opt := range opts {
+		opt(dc)
+	}
+	return dc
 }
 
-func (dc *DownloadController) Run(ctx context.Context) {
-	for url := range dc.tasks {
+// Run downloads every task of the source with a fixed number of workers.
+// It returns the error that stopped reading the source, if any.
+func (dc *DownloadController) Run(ctx context.Context) error {
+	dc.mu.Lock()
+	dc.ctx = ctx
+	dc.mu.Unlock()
+
+	if dc.drain != nil {
+		stop := context.AfterFunc(dc.drain, func() {
+			// 全体がキャンセルされた場合は待つものがない
+			if ctx.Err() == nil {
+				dc.Drain()
+			}
+		})
+		defer stop()
+	}
+
+	for range dc.workers {
 		dc.wg.Add(1)
-		go func(url string) {
+		go func() {
 			defer dc.wg.Done()
+			dc.work(ctx)
+		}()
+	}
 
-			// semaphore
-			dc.sem <- 1
+	dc.wg.Wait()
+	dc.queue.wait()
+	return dc.queue.Err()
+}
+
+// Drain stops starting new tasks. Run returns when the tasks in progress
+// have finished.
+func (dc *DownloadController) Drain() {
+	dc.queue.drain()
+	dc.pub.Publish(EventDrain{})
+}
 
-			d := NewDownloadWorker(url, dc.policy, dc.pub)
-			body, size, err := d.Run(ctx)
-			if err != nil {
-				<-dc.sem
-				dc.pub.PublishWithContext(ctx, NewEventAbort(d.url, err))
-				return
+func (dc *DownloadController) work(ctx context.Context) {
+	for dc.acquireSlot(ctx) {
+		task, ok := dc.queue.next(ctx)
+		if !ok {
+			dc.releaseSlot()
+			return
+		}
+		if dc.crawler != nil && task.depth == 0 {
+			if !dc.markSeen(task.url) {
+				dc.queue.done()
+				dc.releaseSlot()
+				continue
 			}
-			defer body.Close()
-			defer func() { <-dc.sem }()
+			dc.crawler.AddSeed(task.url)
+		}
+		dc.download(ctx, task)
+		dc.queue.done()
+		dc.releaseSlot()
+	}
+}
 
-			tracker := NewProgressTracker(url, d.pub, int64(size))
-			r := io.TeeReader(body, tracker)
+// acquireSlot は --workers=auto のとき、同時実行数の枠が空くまで待つ
+func (dc *DownloadController) acquireSlot(ctx context.Context) bool {
+	if dc.limiter == nil {
+		return true
+	}
+	return dc.limiter.acquire(ctx)
+}
 
-			n, err := dc.saver.Save(r, d.url)
-			if err != nil {
-				dc.pub.PublishWithContext(ctx, NewEventAbort(d.url, err))
-				return
-			}
+func (dc *DownloadController) releaseSlot() {
+	if dc.limiter != nil {
+		dc.limiter.release()
+	}
+}
 
-			d.pub.PublishWithContext(ctx, EventEnd{
-				TotalSize:   int64(size),
-				CurrentSize: n,
-				URL:         d.url,
-			})
-		}(url)
+// markSeen は初めてのURLであればtrueを返す。
+// 重複の排除は再帰モードでのみ行い、入力のURLはメモリに溜めない。
+func (dc *DownloadController) markSeen(url string) bool {
+	dc.seenMu.Lock()
+	defer dc.seenMu.Unlock()
+	if dc.seen[url] {
+		return false
 	}
+	dc.seen[url] = true
+	return true
+}
 
-	dc.wg.Wait()
+func (dc *DownloadController) download(ctx context.Context, task Task) {
+	url := task.url
+
+	ctx, span := dc.tracer.Start(ctx, "download", SpanKindInternal, attr("url.full", url))
+	defer span.End()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	pause := newPauseGate()
+	dc.setRunning(url, &runningTask{cancel: cancel, pause: pause})
+	defer dc.setRunning(url, nil)
+
+	release := dc.acquire(url)
+	defer release()
+
+	d := dc.newWorker(task, pause)
+	body, size, err := d.Run(ctx)
+	defer func() { span.SetAttributes(attr("downloader.attempts", d.attempt)) }()
+	if errors.Is(err, ErrNotModified) {
+		span.SetAttributes(attr("downloader.unchanged", true))
+		dc.pub.PublishWithContext(ctx, EventUnchanged{URL: d.url})
+		// 変わっていないページのリンクも辿るため、保存済みのファイルを読み直す
+		if page := dc.savedPage(task); page != nil {
+			dc.crawl(ctx, task, d.url, page)
+		}
+		return
+	}
+	// 中断されたダウンロードも集計に含めるため、ctxが終了していても通知する
+	if err != nil {
+		dc.abort(ctx, task, err)
+		return
+	}
+	defer body.Close()
+
+	guard, err := dc.limits.start(int64(size))
+	if err != nil {
+		dc.abort(ctx, task, err)
+		return
+	}
+	defer guard.finish()
+
+	tracker := NewProgressTracker(url, d.pub, int64(size))
+	r := io.TeeReader(guard.reader(body), tracker)
+
+	var page *pageBuffer
+	if dc.crawler != nil && dc.crawler.Follow(task.depth) && isHTML(d.contentType) {
+		page = &pageBuffer{limit: maxPageSize}
+		r = io.TeeReader(r, page)
+	}
+
+	src := &sourceReader{r: r}
+	n, change, previous, err := dc.save(src, d)
+	if errors.As(err, new(*DiskFullError)) {
+		// 後続のタスクも同じ理由で失敗するので、新しいタスクを開始しない
+		dc.diskFull.Do(dc.queue.drain)
+		span.SetError(err)
+		dc.setFailed(task)
+		dc.pub.Publish(EventDiskFull{URL: d.url, Err: err})
+		dc.failFast(d.url, err)
+		return
+	}
+	if err != nil {
+		// 受信のエラーはそのまま、書き込みのエラーは SaveError として報告する
+		if src.err == nil {
+			err = &SaveError{Path: dc.path(d.url), Err: err}
+		}
+		dc.abort(ctx, task, err)
+		return
+	}
+
+	if dc.validators != nil {
+		if err := dc.validators.StoreValidators(d.url, d.validators); err != nil {
+			dc.abort(ctx, task, err)
+			return
+		}
+	}
+
+	span.SetAttributes(attr("downloader.bytes", n), attr("downloader.size", int64(size)))
+	if change == ChangeNone {
+		span.SetAttributes(attr("downloader.unchanged", true))
+		dc.pub.PublishWithContext(ctx, EventUnchanged{URL: d.url})
+		return
+	}
+
+	path := dc.path(d.url)
+	if change == ChangeModified {
+		d.pub.PublishWithContext(ctx, EventChanged{URL: d.url, Path: path, Previous: previous})
+	}
+
+	d.pub.PublishWithContext(ctx, EventEnd{
+		TotalSize:   int64(size),
+		CurrentSize: n,
+		URL:         d.url,
+		Path:        path,
+	})
+
+	if page != nil {
+		dc.crawl(ctx, task, d.finalURL, page)
+	}
+}
+
+// save はレスポンスを記録できるSaverにはヘッダーも渡し、前の版と比べられるSaverでは変化を調べる
+func (dc *DownloadController) save(r io.Reader, d *DownloadWorker) (n int64, change Change, previous string, err error) {
+	switch s := dc.saver.(type) {
+	case versionSaver:
+		return s.SaveVersion(r, d.url)
+	case responseSaver:
+		if d.response != nil {
+			n, err = s.SaveResponse(r, d.response)
+			return n, ChangeNew, "", err
+		}
+	}
+	n, err = dc.saver.Save(r, d.url)
+	return n, ChangeNew, "", err
+}
+
+// path はSaverがファイルに保存しない場合は空文字
+func (dc *DownloadController) path(url string) string {
+	if ps, ok := dc.saver.(pathSaver); ok {
+		return ps.Path(url)
+	}
+	return ""
+}
+
+// sourceReader は受信のエラーを覚えておき、保存のエラーと区別できるようにする
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// savedPage は再帰モードで辿るべき保存済みのHTMLを返す。HTMLでなければ nil
+func (dc *DownloadController) savedPage(task Task) *pageBuffer {
+	if dc.crawler == nil || !dc.crawler.Follow(task.depth) {
+		return nil
+	}
+	path := dc.path(task.url)
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	page := &pageBuffer{limit: maxPageSize}
+	if _, err := io.Copy(page, io.LimitReader(f, maxPageSize)); err != nil {
+		return nil
+	}
+	// 304 には Content-Type がないため、内容から判定する
+	head := page.buf.String()
+	if !isHTML(http.DetectContentType([]byte(head[:min(len(head), 512)]))) {
+		return nil
+	}
+	return page
+}
+
+func (dc *DownloadController) crawl(ctx context.Context, parent Task, pageURL string, page *pageBuffer) {
+	base, err := neturl.Parse(pageURL)
+	if err != nil {
+		return
+	}
+
+	for _, link := range ExtractLinks(strings.NewReader(page.buf.String()), base) {
+		if ctx.Err() != nil {
+			return
+		}
+		if !dc.crawler.Allowed(ctx, link) {
+			continue
+		}
+		url, err := NormalizeURL(link.String())
+		if err != nil {
+			continue
+		}
+		task := Task{url: url, depth: parent.depth + 1}
+		if dc.markSeen(task.url) {
+			dc.queue.push(ctx, task)
+		}
+	}
+}
+
+func (dc *DownloadController) newWorker(task Task, pause *pauseGate) *DownloadWorker {
+	opts := append(slices.Clip(dc.workerOpts), withPauses(dc.paused, pause))
+	if len(task.mirrors) > 0 {
+		opts = append(opts, WithMirrors(task.mirrors...))
+	}
+	if dc.validators != nil {
+		if v, ok := dc.validators.LoadValidators(task.url); ok {
+			opts = append(opts, WithConditional(v))
+		}
+	}
+	return NewDownloadWorker(task.url, dc.policy, dc.pub, opts...)
+}
+
+// acquire はホスト単位のセマフォを獲得する
+func (dc *DownloadController) acquire(rawURL string) (release func()) {
+	hostSem := dc.hostSem(rawURL)
+	if hostSem == nil {
+		return func() {}
+	}
+	hostSem <- 1
+
+	return func() { <-hostSem }
+}
+
+func (dc *DownloadController) hostSem(rawURL string) chan int {
+	if len(dc.hostSems) == 0 {
+		return nil
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	if sem, ok := dc.hostSems[u.Host]; ok {
+		return sem
+	}
+	return dc.hostSems[u.Hostname()]
 }
 
 type DownloadWorker struct {
 	url    string
 	policy *backoff.Policy
 	pub    *pubsub.Publisher[Event]
+	header http.Header
+	client *http.Client
+
+	// mirrors は url と同じ内容を返すURLの一覧で、先頭は url
+	mirrors []string
+	// slowSpeed を slowWindow の間下回ったミラーは切り替える
+	slowSpeed  int64
+	slowWindow time.Duration
+
+	// requestTimeout はレスポンスヘッダーを受け取るまで、stallTimeout はボディが途切れてからの制限時間
+	requestTimeout time.Duration
+	stallTimeout   time.Duration
+	// minSpeed を minSpeedWindow の間下回った転送はリトライする
+	minSpeed       int64
+	minSpeedWindow time.Duration
+
+	// pauses のいずれかが一時停止している間はボディを読まない
+	pauses []*pauseGate
+	// acceptsRanges は一時停止中に切断しても続きを要求できること
+	acceptsRanges bool
+
+	backoff *backoff.Backoff
+	// errs は失敗した試行のエラーで、試行の順に並ぶ
+	errs    []error
+	attempt int
+
+	// conditional は前回のダウンロード時のバリデータ、validators は今回のレスポンスのバリデータ
+	conditional Validators
+	validators  Validators
+	contentType string
+	// finalURL はリダイレクト後のURL
+	finalURL string
+	// response はボディを返した最初のレスポンスで、Request はリダイレクト後のリクエスト
+	response *http.Response
+	// har がnilでなければ、全ての試行を記録する
+	har *HARRecorder
 }
 
-func NewDownloadWorker(url string, policy *backoff.Policy, publisher *pubsub.Publisher[Event]) *DownloadWorker {
-	return &DownloadWorker{url: url, policy: policy, pub: publisher}
+type WorkerOption func(*DownloadWorker)
+
+// WithClient makes the worker send requests through client instead of http.DefaultClient.
+func WithClient(client *http.Client) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.client = client
+	}
 }
 
-func (d *DownloadWorker) Run(ctx context.Context) (body io.ReadCloser, contentLength int, err error) {
-	b := d.policy.NewBackoff()
+// WithHeader adds header to every request the worker sends.
+func WithHeader(header http.Header) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.header = header
+	}
+}
 
-	m := multierr.New()
+// WithConditional makes the request conditional on v, so that an unchanged
+// resource results in ErrNotModified instead of a body.
+func WithConditional(v Validators) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.conditional = v
+	}
+}
+
+// WithMirrors adds URLs serving the same content. Each attempt goes to the
+// next mirror, and an interrupted body is continued from another mirror.
+func WithMirrors(urls ...string) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.mirrors = append(d.mirrors, urls...)
+	}
+}
+
+// WithSlowMirror switches to the next mirror when the throughput stays
+// below speed bytes/s for window. It has no effect without mirrors.
+func WithSlowMirror(speed int64, window time.Duration) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.slowSpeed = speed
+		d.slowWindow = window
+	}
+}
+
+// WithTimeouts limits each attempt: request is the time until the response
+// header arrives, and stall is the time the body may go without data.
+// Zero disables either limit.
+func WithTimeouts(request, stall time.Duration) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.requestTimeout = request
+		d.stallTimeout = stall
+	}
+}
+
+// WithMinSpeed retries the transfer when the throughput stays below speed
+// bytes/s for window. Zero speed disables the check.
+func WithMinSpeed(speed int64, window time.Duration) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.minSpeed = speed
+		d.minSpeedWindow = window
+	}
+}
+
+func NewDownloadWorker(url string, policy *backoff.Policy, publisher *pubsub.Publisher[Event], opts ...WorkerOption) *DownloadWorker {
+	d := &DownloadWorker{url: url, policy: policy, pub: publisher, client: http.DefaultClient, mirrors: []string{url}}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+func (d *DownloadWorker) Run(ctx context.Context) (body io.ReadCloser, contentLength int, err error) {
+	d.backoff = d.policy.NewBackoff()
+	d.errs = nil
 
 	d.pub.PublishWithContext(ctx, EventStart{
 		TotalSize:   0,
@@ -119,46 +705,176 @@ func (d *DownloadWorker) Run(ctx context.Context) (body io.ReadCloser, contentLe
 		URL:         d.url,
 	})
 
-	for backoff.Continue(ctx, b) {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
-		if err != nil {
-			return nil, 0, err
+	resp, err := d.open(ctx, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	d.validators = validatorsFromHeader(resp.Header)
+	d.contentType = resp.Header.Get("Content-Type")
+	d.finalURL = resp.Request.URL.String()
+	d.response = resp
+	return newResumableBody(ctx, d, resp.Body), int(resp.ContentLength), nil
+}
+
+// open sends requests with backoff, moving to the next mirror on every
+// attempt, until one returns a body starting at offset. It returns
+// RetryExhaustedError when the attempts run out, and the cause of ctx when
+// ctx is done first.
+func (d *DownloadWorker) open(ctx context.Context, offset int64) (*http.Response, error) {
+	for {
+		// 試行の前に待った時間をスパンに記録する
+		delay := d.backoff.NextTick()
+		if !backoff.Continue(ctx, d.backoff) {
+			break
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			m.Add(err)
+		mirror := d.mirrors[d.attempt%len(d.mirrors)]
+		d.attempt++
 
-			d.pub.PublishWithContext(ctx, EventRetry{
-				TotalSize: 0,
-				URL:       d.url,
-			})
+		resp, err := d.request(ctx, mirror, offset, delay)
+		if err != nil {
+			var reqErr *requestError
+			if errors.As(err, &reqErr) && len(d.mirrors) == 1 {
+				return nil, reqErr.err
+			}
+			// 他にミラーがなければ、試し直しても結果は変わらない
+			var status *HTTPStatusError
+			if errors.As(err, &status) && !status.Retryable() && len(d.mirrors) == 1 {
+				return nil, err
+			}
+			err = d.mirrorError(mirror, err)
+			d.errs = append(d.errs, err)
+			d.publishRetry(ctx, err)
 			continue
 		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return nil, ErrNotModified
+		}
+		d.acceptsRanges = acceptsRanges(resp)
+		return resp, nil
+	}
 
-		// サーバーエラーはリトライを行う
-		if resp.StatusCode >= http.StatusInternalServerError {
+	if ctx.Err() != nil {
+		return nil, causeOf(ctx, ctx.Err())
+	}
+	return nil, &RetryExhaustedError{Attempts: slices.Clone(d.errs)}
+}
 
-			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
-			resp.Body.Close()
-			err := fmt.Errorf("server error (%d):  %s", resp.StatusCode, body)
-			m.Add(err)
+// requestError はリクエストを組み立てられなかったことを表す
+type requestError struct {
+	err error
+}
 
-			d.pub.PublishWithContext(ctx, EventRetry{
-				TotalSize: 0,
-				URL:       d.url,
-			})
-			continue
+func (e *requestError) Error() string { return e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+// request sends one request to mirror and checks that the response can be used.
+// The attempt lasts until the body of the returned response is closed, and
+// is traced as a child of the span in ctx. delay is the backoff before it.
+func (d *DownloadWorker) request(ctx context.Context, mirror string, offset int64, delay time.Duration) (resp *http.Response, err error) {
+	ctx, span := startSpan(ctx, http.MethodGet, SpanKindClient,
+		attr("http.request.method", http.MethodGet),
+		attr("url.full", mirror),
+		attr("downloader.attempt", d.attempt),
+	)
+	if offset > 0 {
+		span.SetAttributes(attr("downloader.range.start", offset))
+	}
+	if delay > 0 {
+		span.SetAttributes(attr("downloader.retry.delay_ms", delay.Milliseconds()))
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	var har *harAttempt
+	defer func() {
+		if err != nil {
+			cancel(nil)
+			span.SetError(err)
+			span.End()
+			har.setError(err)
+			har.finish(nil, 0)
 		}
+	}()
 
-		return resp.Body, int(resp.ContentLength), nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirror, nil)
+	if err != nil {
+		return nil, &requestError{err}
+	}
+	for name, values := range d.header {
+		req.Header[name] = values
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		if d.conditional.ETag != "" {
+			req.Header.Set("If-None-Match", d.conditional.ETag)
+		}
+		if d.conditional.LastModified != "" {
+			req.Header.Set("If-Modified-Since", d.conditional.LastModified)
+		}
+	}
+	span.inject(req)
+	har, req = d.har.start(req)
+
+	var timer *time.Timer
+	if d.requestTimeout > 0 {
+		timer = time.AfterFunc(d.requestTimeout, func() {
+			cancel(&RequestTimeoutError{Timeout: d.requestTimeout})
+		})
+	}
+	resp, err = d.client.Do(req)
+	if timer != nil {
+		timer.Stop()
+	}
+	if errors.As(err, new(*RedirectSchemeError)) {
+		return nil, &requestError{err}
 	}
-
-	err = m.Err()
 	if err != nil {
-		return nil, 0, err
+		return nil, networkError(ctx, err)
+	}
+	span.SetAttributes(attr("http.response.status_code", resp.StatusCode))
+	resp.Body = newAttemptBody(ctx, cancel, resp, d.stallTimeout, span, har)
+
+	// ボディを閉じるとスパンが終わるため、先にエラーを記録する
+	switch {
+	// サーバーエラーと429はリトライを行う
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+		err = &HTTPStatusError{Code: resp.StatusCode, Body: string(body)}
+	// エラーページを保存しない。リトライするかは open が決める
+	case resp.StatusCode >= http.StatusBadRequest:
+		err = &HTTPStatusError{Code: resp.StatusCode}
+	case offset > 0 && !rangeStartsAt(resp, offset):
+		err = fmt.Errorf("cannot resume at byte %d: range requests not supported", offset)
+	}
+	if err != nil {
+		span.SetError(err)
+		har.setError(err)
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// currentMirror は最後にリクエストを送ったミラー
+func (d *DownloadWorker) currentMirror() string {
+	return d.mirrors[(d.attempt-1)%len(d.mirrors)]
+}
+
+func (d *DownloadWorker) mirrorError(mirror string, err error) error {
+	if len(d.mirrors) == 1 {
+		return err
 	}
-	// net/http同様、必ずBodyがCloseできるようにする
-	return io.NopCloser(strings.NewReader("")), 0, nil
+	return fmt.Errorf("%s: %w", mirror, err)
+}
+
+func (d *DownloadWorker) publishRetry(ctx context.Context, err error) {
+	d.pub.PublishWithContext(ctx, EventRetry{
+		TotalSize: 0,
+		URL:       d.url,
+		Err:       err,
+	})
 }
 
 type ProgressTracker struct {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// Probe is what a dry run learns about a task without downloading it.
+type Probe struct {
+	URL           string
+	Status        int
+	ContentLength int64
+	ContentType   string
+	FinalURL      string
+	// Resumable はサーバーがRangeリクエストに対応しているか
+	Resumable bool
+	Path      string
+	Err       error
+}
+
+// Failed reports whether the task would not be downloaded.
+func (p Probe) Failed() bool {
+	return p.Err != nil || p.Status >= http.StatusBadRequest
+}
+
+// DryRun probes every task with a HEAD request, falling back to a GET of
+// the first byte when the server does not allow HEAD.
+type DryRun struct {
+	client  *http.Client
+	header  http.Header
+	saver   Saver
+	workers uint
+	timeout time.Duration
+}
+
+func NewDryRun(client *http.Client, header http.Header, saver Saver, workers uint, timeout time.Duration) *DryRun {
+	return &DryRun{client: client, header: header, saver: saver, workers: workers, timeout: timeout}
+}
+
+// Run probes the tasks of source concurrently and returns the results in
+// the order of the source.
+func (r *DryRun) Run(ctx context.Context, source TaskSource) ([]Probe, error) {
+	var (
+		probes []Probe
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan int, max(r.workers, 1))
+	)
+
+	for {
+		task, ok, err := source.Next(ctx)
+		if ctx.Err() != nil {
+			// 中断された場合は、それまでの結果を返す
+			wg.Wait()
+			return probes, nil
+		}
+		if err != nil || !ok {
+			wg.Wait()
+			return probes, err
+		}
+
+		mu.Lock()
+		i := len(probes)
+		probes = append(probes, Probe{})
+		mu.Unlock()
+
+		sem <- 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			p := r.probe(ctx, task.url)
+			mu.Lock()
+			probes[i] = p
+			mu.Unlock()
+		}()
+	}
+}
+
+func (r *DryRun) probe(ctx context.Context, url string) Probe {
+	p := Probe{URL: url, ContentLength: -1}
+	if ps, ok := r.saver.(pathSaver); ok {
+		p.Path = ps.Path(url)
+	}
+
+	resp, err := r.send(ctx, http.MethodHead, url)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = r.send(ctx, http.MethodGet, url)
+	}
+	if err != nil {
+		p.Err = err
+		return p
+	}
+
+	p.Status = resp.StatusCode
+	p.ContentLength = resp.ContentLength
+	p.ContentType = resp.Header.Get("Content-Type")
+	p.FinalURL = resp.Request.URL.String()
+	p.Resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+	if resp.StatusCode == http.StatusPartialContent {
+		p.Resumable = true
+		p.ContentLength = contentRangeSize(resp.Header.Get("Content-Range"))
+	}
+	return p
+}
+
+// send はボディを読まずに閉じたレスポンスを返す。GETは先頭1バイトだけを要求する。
+func (r *DryRun) send(ctx context.Context, method, url string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// contentRangeSize returns the complete length in "bytes 0-0/1234", or -1.
+func contentRangeSize(contentRange string) int64 {
+	_, size, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// WriteProbes prints probes as a table followed by the total size.
+func WriteProbes(w io.Writer, probes []Probe) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tSIZE\tTYPE\tRESUME\tFILE\tURL")
+
+	var total int64
+	var unknown, failed int
+	for _, p := range probes {
+		if p.Err != nil {
+			failed++
+			fmt.Fprintf(tw, "error\t-\t-\t-\t%s\t%s (%v)\n", p.Path, p.URL, p.Err)
+			continue
+		}
+
+		size := "?"
+		switch {
+		case p.Status >= http.StatusBadRequest:
+			failed++
+			size = "-"
+		case p.ContentLength >= 0:
+			size = fmt.Sprintf("% .1f", decor.SizeB1024(p.ContentLength))
+			total += p.ContentLength
+		default:
+			unknown++
+		}
+		resume := "no"
+		if p.Resumable {
+			resume = "yes"
+		}
+		url := p.URL
+		if p.FinalURL != p.URL {
+			url += " -> " + p.FinalURL
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", p.Status, size, orDash(p.ContentType), resume, p.Path, url)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\nTotal: % .1f in %d files (%d unknown size, %d failed)\n",
+		decor.SizeB1024(total), len(probes), unknown, failed)
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Header().Set("Content-Type", "text/plain")
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(mirrorContent))
+		case "/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(mirrorContent))
+		case "/redirect":
+			http.Redirect(w, r, "/file", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	urls := []string{ts.URL + "/file", ts.URL + "/nohead", ts.URL + "/redirect", ts.URL + "/missing"}
+	tasks := make([]Task, len(urls))
+	for i, u := range urls {
+		tasks[i] = *NewTask(u)
+	}
+
+	dr := NewDryRun(http.DefaultClient, nil, saver, 2, time.Second)
+	probes, err := dr.Run(context.Background(), NewSliceSource(tasks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(mirrorContent))
+	want := []Probe{
+		{URL: urls[0], Status: 200, ContentLength: size, ContentType: "text/plain", FinalURL: urls[0], Resumable: true},
+		{URL: urls[1], Status: 206, ContentLength: size, ContentType: "text/plain", FinalURL: urls[1], Resumable: true},
+		{URL: urls[2], Status: 200, ContentLength: size, ContentType: "text/plain", FinalURL: urls[0], Resumable: true},
+		{URL: urls[3], Status: 404, ContentLength: -1, FinalURL: urls[3]},
+	}
+	for i := range want {
+		want[i].Path = saver.Path(urls[i])
+	}
+	if diff := cmp.Diff(want, probes); diff != "" {
+		t.Errorf("probes mismatch (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteProbes(&buf, probes); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "Total: 29.3 KiB in 4 files (0 unknown size, 1 failed)") {
+		t.Errorf("table does not end with the total:\n%s", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ダウンロードが失敗した理由はこのファイルの型と timeout.go、limit.go の型で表し、
+// errors.As で区別できるようにする。
+
+// HTTPStatusError is an HTTP response that cannot be used as the body.
+// Body is the beginning of a server error response.
+type HTTPStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Retryable() {
+		return fmt.Sprintf("server error (%d):  %s", e.Code, e.Body)
+	}
+	return fmt.Sprintf("client error (%d)", e.Code)
+}
+
+// Retryable reports whether the same request may succeed later. Client
+// errors other than 429 are not retried.
+func (e *HTTPStatusError) Retryable() bool {
+	return e.Code >= http.StatusInternalServerError || e.Code == http.StatusTooManyRequests
+}
+
+// RedirectSchemeError means that an HTTP server redirected to a URL of
+// another scheme, such as file: or s3:. It is not retried.
+type RedirectSchemeError struct {
+	URL string
+}
+
+func (e *RedirectSchemeError) Error() string {
+	return fmt.Sprintf("refused redirect to %s: only http and https are followed", e.URL)
+}
+
+// NetworkError means that an attempt failed below HTTP: the connection could
+// not be made, or broke while the body was being received.
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// networkError は ctx が終了していればその原因を、そうでなければ err を NetworkError として返す
+func networkError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return causeOf(ctx, err)
+	}
+	return &NetworkError{Err: err}
+}
+
+// SaveError means that a download was received but could not be written.
+// Path is empty when the saver does not write to a file.
+type SaveError struct {
+	Path string
+	Err  error
+}
+
+func (e *SaveError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("cannot save: %v", e.Err)
+	}
+	return fmt.Sprintf("cannot save %s: %v", e.Path, e.Err)
+}
+
+func (e *SaveError) Unwrap() error {
+	return e.Err
+}
+
+// RetryExhaustedError means that every attempt allowed by --retry-limit
+// failed. Attempts holds the error of each attempt, in order.
+type RetryExhaustedError struct {
+	Attempts []error
+}
+
+// Error は1行目に試行の回数を、続く行に各試行のエラーを並べる
+func (e *RetryExhaustedError) Error() string {
+	summary := fmt.Sprintf("gave up after %d attempts", len(e.Attempts))
+	if len(e.Attempts) == 1 {
+		summary = "gave up after 1 attempt"
+	}
+	lines := []string{summary}
+	for _, err := range e.Attempts {
+		lines = append(lines, oneLine(err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *RetryExhaustedError) Unwrap() []error {
+	return e.Attempts
+}
+
+// FailFastError is the cause of the downloads canceled by --fail-fast.
+// It matches ErrCanceled, so that they are reported as canceled.
+type FailFastError struct {
+	// URL は最初に失敗したダウンロード
+	URL string
+}
+
+func (e *FailFastError) Error() string {
+	return fmt.Sprintf("canceled after %s failed (--fail-fast)", e.URL)
+}
+
+func (e *FailFastError) Is(target error) bool {
+	return target == ErrCanceled
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/no-yan/tmp/downloader/internal/backoff"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestDownloadWorker_RetryExhausted(t *testing.T) {
+	// 試行ごとに違うステータスを返し、履歴の順序を確かめる
+	codes := []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusTooManyRequests}
+	var n atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(codes[int(n.Add(1)-1)%len(codes)])
+	}))
+	defer ts.Close()
+
+	policy := backoff.Policy{DelayMin: time.Millisecond, DelayMax: time.Millisecond, RetryLimit: uint(len(codes))}
+	d := NewDownloadWorker(ts.URL, &policy, pubsub.NewPublisher[Event]())
+	_, _, err := d.Run(context.Background())
+
+	var exhausted *RetryExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("err = %v, want RetryExhaustedError", err)
+	}
+	if len(exhausted.Attempts) != len(codes) {
+		t.Fatalf("%d attempts, want %d", len(exhausted.Attempts), len(codes))
+	}
+	for i, err := range exhausted.Attempts {
+		var status *HTTPStatusError
+		if !errors.As(err, &status) || status.Code != codes[i] {
+			t.Errorf("attempt %d = %v, want status %d", i+1, err, codes[i])
+		}
+	}
+	// 各試行のエラーも errors.As で取り出せる
+	if !errors.As(err, new(*HTTPStatusError)) {
+		t.Errorf("err = %v, want it to match HTTPStatusError", err)
+	}
+}
+
+func TestDownloadWorker_NetworkError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	policy := backoff.Policy{DelayMin: time.Millisecond, DelayMax: time.Millisecond, RetryLimit: 2}
+	d := NewDownloadWorker(url, &policy, pubsub.NewPublisher[Event]())
+	_, _, err := d.Run(context.Background())
+
+	var netErr *NetworkError
+	if !errors.As(err, &netErr) || !strings.Contains(netErr.Error(), "connection refused") {
+		t.Errorf("err = %v, want NetworkError", err)
+	}
+}
+
+// failingSaver は受信したボディを読み切ってから書き込みに失敗する
+type failingSaver struct{}
+
+func (failingSaver) Save(r io.Reader, url string) (int64, error) {
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return n, err
+	}
+	return n, errors.New("read-only file system")
+}
+
+func TestDownloadController_SaveError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			// サイズを知らせず、受信中に --max-filesize を超える
+			w.(http.Flusher).Flush()
+			io.WriteString(w, strings.Repeat("x", 200))
+			return
+		}
+		io.WriteString(w, "content")
+	}))
+	defer ts.Close()
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	source := NewSliceSource(*NewTask(ts.URL + "/a"), *NewTask(ts.URL + "/large"))
+	dc := NewDownloadController(source, &defaultPolicy, pub, failingSaver{}, 1, WithSizeLimits(100, 0))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(map[string]error)
+	for _, e := range rec.events {
+		if abort, ok := e.(EventAbort); ok {
+			errs[abort.URL] = abort.Err
+		}
+	}
+	if err := errs[ts.URL+"/a"]; !errors.As(err, new(*SaveError)) {
+		t.Errorf("/a: err = %v, want SaveError", err)
+	}
+	// 受信のエラーは保存のエラーにしない
+	if err := errs[ts.URL+"/large"]; errors.As(err, new(*SaveError)) || !errors.As(err, new(*FileTooLargeError)) {
+		t.Errorf("/large: err = %v, want FileTooLargeError", err)
+	}
+}
+
+func TestPrettyError(t *testing.T) {
+	err := &RetryExhaustedError{Attempts: []error{
+		&HTTPStatusError{Code: http.StatusServiceUnavailable},
+		&HTTPStatusError{Code: http.StatusServiceUnavailable},
+		&HTTPStatusError{Code: http.StatusNotFound},
+		&HTTPStatusError{Code: http.StatusServiceUnavailable},
+	}}
+	want := "gave up after 4 attempts\n" +
+		"\t\tserver error (503):   (2 times)\n" +
+		"\t\tclient error (404)\n" +
+		"\t\tserver error (503):  "
+	if got := prettyError(err); got != want {
+		t.Errorf("prettyError() = %q, want %q", got, want)
+	}
+}
@@ -12,6 +12,14 @@ const (
 	EventTypeRetry
 	EventTypeEnd
 	EventTypeAbort
+	EventTypeUnchanged
+	EventTypeHook
+	EventTypeDrain
+	EventTypeDiskFull
+	EventTypeQueued
+	EventTypePause
+	EventTypeResume
+	EventTypeChanged
 )
 
 type EventStart struct {
@@ -37,6 +45,8 @@ func (e EventProgress) Type() EventType {
 type EventRetry struct {
 	TotalSize int64
 	URL       string
+	// Err は失敗した試行のエラー
+	Err error
 }
 
 func (e EventRetry) Type() EventType {
@@ -47,6 +57,8 @@ type EventEnd struct {
 	TotalSize   int64
 	CurrentSize int64
 	URL         string
+	// Path は保存先のファイル。Saverがファイルに保存しない場合は空文字
+	Path string
 }
 
 func (e EventEnd) Type() EventType {
@@ -68,3 +80,85 @@ func NewEventAbort(url string, err error) EventAbort {
 func (e EventAbort) Type() EventType {
 	return EventTypeAbort
 }
+
+// EventUnchanged は条件付きリクエストに304が返り、既存のファイルをそのまま使うことを表す
+type EventUnchanged struct {
+	URL string
+}
+
+func (e EventUnchanged) Type() EventType {
+	return EventTypeUnchanged
+}
+
+// EventHook は完了時/エラー時のフックが終了したことを表す
+type EventHook struct {
+	URL      string
+	Kind     HookKind
+	ExitCode int
+	Err      error
+	// Output は失敗したときのフックの出力の末尾
+	Output string
+}
+
+func (e EventHook) Type() EventType {
+	return EventTypeHook
+}
+
+// EventDrain は新しいダウンロードの開始を止め、実行中のものの完了を待っていることを表す
+type EventDrain struct{}
+
+func (e EventDrain) Type() EventType {
+	return EventTypeDrain
+}
+
+// EventDiskFull はディスクがいっぱいで保存できなかったことを表す。
+// 最初の1件で新しいダウンロードの開始を止める。
+type EventDiskFull struct {
+	URL string
+	Err error
+}
+
+func (e EventDiskFull) Type() EventType {
+	return EventTypeDiskFull
+}
+
+// EventQueued はタスクがキューに入り、開始を待っていることを表す
+type EventQueued struct {
+	URL string
+}
+
+func (e EventQueued) Type() EventType {
+	return EventTypeQueued
+}
+
+// EventPause は URL のダウンロードを一時停止したことを表す。
+// URL が空なら全体を一時停止し、新しいダウンロードも開始しない。
+type EventPause struct {
+	URL string
+}
+
+func (e EventPause) Type() EventType {
+	return EventTypePause
+}
+
+// EventResume は EventPause で止めたものを再開したことを表す
+type EventResume struct {
+	URL string
+}
+
+func (e EventResume) Type() EventType {
+	return EventTypeResume
+}
+
+// EventChanged は監視中のURLの内容が前回の保存から変わったことを表す。
+// 続けて同じURLの EventEnd が通知される。
+type EventChanged struct {
+	URL  string
+	Path string
+	// Previous は前の版を残したファイル。残さない場合は空文字
+	Previous string
+}
+
+func (e EventChanged) Type() EventType {
+	return EventTypeChanged
+}
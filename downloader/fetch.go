@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fetcher retrieves the content of URLs of a scheme other than HTTP.
+// Fetchers are registered to the http.Transport of the client, so that
+// retries, resumption with Range, progress and savers work as for HTTP.
+type Fetcher interface {
+	// Fetch opens the content of u from offset on. A missing object is
+	// reported with an error wrapping fs.ErrNotExist, and a forbidden one
+	// with fs.ErrPermission. Other errors are retried.
+	Fetch(ctx context.Context, u *url.URL, offset int64) (*Object, error)
+}
+
+// Object is the content returned by a Fetcher.
+type Object struct {
+	Body io.ReadCloser
+	// Size は全体の長さで、不明なときは-1
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+// RegisterFetchers makes client handle the schemes of fetchers.
+// client must use an *http.Transport. Redirects from HTTP to any other
+// scheme are refused with RedirectSchemeError, so that a server cannot make
+// the client read local files or sign requests with the user's credentials.
+func RegisterFetchers(client *http.Client, fetchers map[string]Fetcher) error {
+	t, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("cannot register fetchers to %T", client.Transport)
+	}
+	for scheme, f := range fetchers {
+		t.RegisterProtocol(scheme, fetcherTransport{f})
+	}
+	client.CheckRedirect = checkRedirectScheme(client.CheckRedirect)
+	return nil
+}
+
+// checkRedirectScheme は next の前に、HTTPからHTTP以外へのリダイレクトを拒否する。
+// next が nil なら http.Client の既定と同じく10回で止める
+func checkRedirectScheme(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if isHTTPScheme(via[len(via)-1].URL.Scheme) && !isHTTPScheme(req.URL.Scheme) {
+			return &RedirectSchemeError{URL: req.URL.Redacted()}
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+func isHTTPScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// fetcherTransport は Fetcher の結果をHTTPのレスポンスに変換する
+type fetcherTransport struct {
+	f Fetcher
+}
+
+func (t fetcherTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start, end, ok := parseRange(req.Header.Get("Range"))
+	if !ok {
+		start, end = 0, -1
+	}
+
+	obj, err := t.f.Fetch(req.Context(), req.URL, start)
+	// HTTPと同じステータスにして、リトライせずに失敗させる
+	var invalid *invalidURLError
+	switch {
+	case errors.As(err, &invalid):
+		return errorResponse(req, http.StatusBadRequest, err), nil
+	case errors.Is(err, fs.ErrNotExist):
+		return errorResponse(req, http.StatusNotFound, err), nil
+	case errors.Is(err, fs.ErrPermission):
+		return errorResponse(req, http.StatusForbidden, err), nil
+	case err != nil:
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          obj.Body,
+		ContentLength: obj.Size,
+		Request:       req,
+	}
+	if obj.ContentType != "" {
+		resp.Header.Set("Content-Type", obj.ContentType)
+	}
+	if !obj.ModTime.IsZero() {
+		resp.Header.Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if obj.ETag != "" {
+		resp.Header.Set("ETag", obj.ETag)
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	if notModified(req, obj) {
+		obj.Body.Close()
+		resp.Status, resp.StatusCode = "304 Not Modified", http.StatusNotModified
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		return resp, nil
+	}
+
+	if ok {
+		if end < 0 || (obj.Size >= 0 && end >= obj.Size) {
+			end = obj.Size - 1
+		}
+		total := "*"
+		if obj.Size >= 0 {
+			total = strconv.FormatInt(obj.Size, 10)
+		}
+		resp.Status, resp.StatusCode = "206 Partial Content", http.StatusPartialContent
+		resp.ContentLength = -1
+		if end >= start {
+			resp.ContentLength = end - start + 1
+			resp.Body = limitedBody{io.LimitReader(obj.Body, resp.ContentLength), obj.Body}
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, total))
+		} else {
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-/%s", start, total))
+		}
+	}
+
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp, nil
+}
+
+func notModified(req *http.Request, obj *Object) bool {
+	if etag := req.Header.Get("If-None-Match"); etag != "" {
+		return etag == obj.ETag
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	return err == nil && !obj.ModTime.IsZero() && !obj.ModTime.Truncate(time.Second).After(since)
+}
+
+func errorResponse(req *http.Request, status int, err error) *http.Response {
+	msg := err.Error()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+		Request:       req,
+	}
+}
+
+// parseRange parses "bytes=start-" and "bytes=start-end". end is -1 if omitted.
+func parseRange(s string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(s, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// FileFetcher reads file:// URLs from the local file system.
+type FileFetcher struct{}
+
+func (FileFetcher) Fetch(ctx context.Context, u *url.URL, offset int64) (*Object, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, &invalidURLError{u.String(), errors.New("remote hosts are not supported")}
+	}
+
+	f, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", u.Path, fs.ErrNotExist)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Object{
+		Body:        f,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(u.Path)),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+// DataFetcher decodes data: URLs (RFC 2397).
+type DataFetcher struct{}
+
+func (DataFetcher) Fetch(ctx context.Context, u *url.URL, offset int64) (*Object, error) {
+	raw := u.Opaque
+	if u.RawQuery != "" {
+		raw += "?" + u.RawQuery
+	}
+	meta, data, ok := strings.Cut(raw, ",")
+	if !ok {
+		return nil, &invalidURLError{u.String(), errors.New(`data URL without ","`)}
+	}
+
+	content, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, &invalidURLError{u.String(), err}
+	}
+	if m, ok := strings.CutSuffix(meta, ";base64"); ok {
+		meta = m
+		b, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, &invalidURLError{u.String(), err}
+		}
+		content = string(b)
+	}
+	if meta == "" || strings.HasPrefix(meta, ";") {
+		meta = "text/plain" + meta
+	}
+
+	return &Object{
+		Body:        io.NopCloser(strings.NewReader(content[min(offset, int64(len(content))):])),
+		Size:        int64(len(content)),
+		ContentType: meta,
+	}, nil
+}
+
+// invalidURLError はリトライしても直らないURLの誤りで、400として扱う
+type invalidURLError struct {
+	url string
+	err error
+}
+
+func (e *invalidURLError) Error() string { return fmt.Sprintf("invalid URL %q: %v", e.url, e.err) }
+func (e *invalidURLError) Unwrap() error { return e.err }
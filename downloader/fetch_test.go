@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func newFetcherClient(t *testing.T, fetchers map[string]Fetcher) *http.Client {
+	t.Helper()
+	client, err := NewHTTPClient(defaultTransportConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterFetchers(client, fetchers); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestDownloadWorker_Fetchers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte(mirrorContent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := newFetcherClient(t, map[string]Fetcher{"file": FileFetcher{}, "data": DataFetcher{}})
+
+	tests := map[string]struct {
+		url  string
+		want string
+	}{
+		"file":        {"file://" + filepath.ToSlash(path), mirrorContent},
+		"data":        {"data:,Hello%2C%20World%21", "Hello, World!"},
+		"data base64": {"data:text/plain;base64,SGVsbG8sIFdvcmxkIQ==", "Hello, World!"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := &eventRecorder{}
+			pub := pubsub.NewPublisher[Event]()
+			pub.Register(rec)
+
+			d := NewDownloadWorker(tt.url, &defaultPolicy, pub, WithClient(client))
+			body, _, err := d.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(got), tt.want) {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if n := rec.count(EventTypeRetry); n != 0 {
+				t.Errorf("retries = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestDownloadController_FileNotFound(t *testing.T) {
+	client := newFetcherClient(t, map[string]Fetcher{"file": FileFetcher{}})
+	url := "file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "missing"))
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	dc := NewDownloadController(NewSliceSource(*NewTask(url)), &defaultPolicy, pub, saver, 1, WithWorkerOptions(WithClient(client)))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var status *HTTPStatusError
+	for _, e := range rec.events {
+		if e, ok := e.(EventAbort); ok && !errors.As(e.Err, &status) {
+			t.Errorf("err = %v, want HTTPStatusError", e.Err)
+		}
+	}
+	if rec.count(EventTypeAbort) != 1 || status == nil || status.Code != http.StatusNotFound {
+		t.Errorf("%d aborts with %v, want 1 with 404", rec.count(EventTypeAbort), status)
+	}
+	if n := rec.count(EventTypeRetry); n != 0 {
+		t.Errorf("retries = %d, want 0", n)
+	}
+	if _, err := os.Stat(saver.Path(url)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a missing file is saved to %s", saver.Path(url))
+	}
+}
+
+func TestDownloadController_RedirectToFile(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file://"+filepath.ToSlash(secret), http.StatusFound)
+	}))
+	defer ts.Close()
+	client := newFetcherClient(t, map[string]Fetcher{"file": FileFetcher{}})
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	url := ts.URL + "/a"
+	dc := NewDownloadController(NewSliceSource(*NewTask(url)), &defaultPolicy, pub, saver, 1, WithWorkerOptions(WithClient(client)))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// サーバーがローカルのファイルを読ませることはできない
+	var redirect *RedirectSchemeError
+	for _, e := range rec.events {
+		if e, ok := e.(EventAbort); ok {
+			errors.As(e.Err, &redirect)
+		}
+	}
+	if rec.count(EventTypeAbort) != 1 || redirect == nil {
+		t.Errorf("%d aborts with %v, want 1 with RedirectSchemeError", rec.count(EventTypeAbort), redirect)
+	}
+	if n := rec.count(EventTypeRetry); n != 0 {
+		t.Errorf("retries = %d, want 0", n)
+	}
+	if _, err := os.Stat(saver.Path(url)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the redirect target is saved to %s", saver.Path(url))
+	}
+}
+
+func TestFetcherTransport_Range(t *testing.T) {
+	client := newFetcherClient(t, map[string]Fetcher{"data": DataFetcher{}})
+
+	tests := map[string]struct {
+		rangeHeader  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		"whole":    {"", http.StatusOK, "", "0123456789"},
+		"from":     {"bytes=4-", http.StatusPartialContent, "bytes 4-9/10", "456789"},
+		"interval": {"bytes=2-3", http.StatusPartialContent, "bytes 2-3/10", "23"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "data:,0123456789", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Range") != tt.contentRange || string(body) != tt.body {
+				t.Errorf("got %d %q %q, want %d %q %q",
+					resp.StatusCode, resp.Header.Get("Content-Range"), body, tt.status, tt.contentRange, tt.body)
+			}
+		})
+	}
+}
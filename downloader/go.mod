@@ -7,7 +7,15 @@ require (
 	github.com/vbauerster/mpb/v8 v8.9.1
 )
 
-require go.uber.org/goleak v1.3.0 // indirect
+require go.uber.org/goleak v1.3.0
+
+require (
+	golang.org/x/net v0.34.0
+	golang.org/x/term v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/kr/text v0.2.0 // indirect
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HAR 1.2 の形式。ボディは記録しない
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	// Error はリトライの原因になった試行のエラー
+	Error string `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings はミリ秒で、該当しない段階は -1
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HARRecorder collects every HTTP attempt of the workers it is given to,
+// and writes them as a HAR 1.2 log that browser devtools can open.
+type HARRecorder struct {
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func NewHARRecorder() *HARRecorder {
+	return &HARRecorder{}
+}
+
+// WithHAR records every request the worker sends in h.
+func WithHAR(h *HARRecorder) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.har = h
+	}
+}
+
+func (h *HARRecorder) add(e harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, e)
+}
+
+// WriteTo writes the log as JSON, the entries ordered by their start.
+func (h *HARRecorder) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	entries := slices.Clone(h.entries)
+	h.mu.Unlock()
+	slices.SortStableFunc(entries, func(a, b harEntry) int {
+		return a.StartedDateTime.Compare(b.StartedDateTime)
+	})
+	if entries == nil {
+		entries = []harEntry{}
+	}
+
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	b, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "downloader", Version: version},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// WriteFile writes the log to path.
+func (h *HARRecorder) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// harAttempt は1回の試行の時刻を httptrace で記録する。
+// nil の場合は何も記録しない。
+type harAttempt struct {
+	recorder *HARRecorder
+
+	mu    sync.Mutex
+	req   *http.Request
+	times harTimes
+	// remoteAddr は接続先のIPアドレス
+	remoteAddr string
+	err        error
+	done       bool
+}
+
+// harTimes は各段階の時刻で、起きなかった段階はゼロ
+type harTimes struct {
+	start, dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone time.Time
+	gotConn, wroteRequest, firstByte                                       time.Time
+}
+
+// start は req の試行の記録を開始し、時刻を記録するリクエストを返す
+func (h *HARRecorder) start(req *http.Request) (*harAttempt, *http.Request) {
+	if h == nil {
+		return nil, req
+	}
+	a := &harAttempt{recorder: h, req: req, times: harTimes{start: time.Now()}}
+	now := func(t *time.Time) func() {
+		return func() { *t = time.Now() }
+	}
+	trace := &httptrace.ClientTrace{
+		// リダイレクトでは最後のリクエストの時刻が残る
+		GetConn:           func(string) { a.set(func() { a.times = harTimes{start: time.Now()} }) },
+		DNSStart:          func(httptrace.DNSStartInfo) { a.set(now(&a.times.dnsStart)) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { a.set(now(&a.times.dnsDone)) },
+		ConnectStart:      func(string, string) { a.set(now(&a.times.connectStart)) },
+		ConnectDone:       func(string, string, error) { a.set(now(&a.times.connectDone)) },
+		TLSHandshakeStart: func() { a.set(now(&a.times.tlsStart)) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { a.set(now(&a.times.tlsDone)) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			a.set(func() {
+				a.times.gotConn = time.Now()
+				if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+					a.remoteAddr = addr.IP.String()
+				}
+			})
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { a.set(now(&a.times.wroteRequest)) },
+		GotFirstResponseByte: func() { a.set(now(&a.times.firstByte)) },
+	}
+	return a, req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (a *harAttempt) set(f func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f()
+}
+
+// setError records err as the reason the attempt failed.
+func (a *harAttempt) setError(err error) {
+	if a == nil || err == nil {
+		return
+	}
+	a.set(func() { a.err = err })
+}
+
+// finish adds the attempt to the log. resp is nil if no response arrived,
+// and received is the number of body bytes read.
+func (a *harAttempt) finish(resp *http.Response, received int64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done {
+		return
+	}
+	a.done = true
+	end := time.Now()
+
+	req := a.req
+	if resp != nil && resp.Request != nil {
+		req = resp.Request
+	}
+	e := harEntry{
+		StartedDateTime: a.times.start,
+		Time:            ms(a.times.start, end),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings:         a.times.timings(end),
+		ServerIPAddress: a.remoteAddr,
+	}
+	query := req.URL.Query()
+	for _, name := range sortedKeys(query) {
+		for _, v := range query[name] {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	if resp != nil {
+		e.Request.HTTPVersion = resp.Proto
+		e.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content: harContent{
+				Size:     received,
+				MimeType: resp.Header.Get("Content-Type"),
+				Comment:  "body omitted",
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    received,
+		}
+	}
+	if a.err != nil {
+		e.Error = a.err.Error()
+	}
+	a.recorder.add(e)
+}
+
+func (t harTimes) timings(end time.Time) harTimings {
+	// HAR 1.2 で -1（該当なし）にできるのは blocked、dns、connect、ssl だけで、
+	// send、wait、receive は測れなかった場合も 0 にする
+	h := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	// blocked は接続の確立やリクエストの送信を始めるまでの待ち時間
+	for _, next := range []time.Time{t.dnsStart, t.connectStart, t.gotConn} {
+		if !next.IsZero() {
+			h.Blocked = ms(t.start, next)
+			break
+		}
+	}
+	if !t.dnsStart.IsZero() && !t.dnsDone.IsZero() {
+		h.DNS = ms(t.dnsStart, t.dnsDone)
+	}
+	// HAR の connect は TLS のハンドシェイクを含む。接続に失敗した場合はそこまで
+	switch {
+	case !t.connectStart.IsZero() && !t.gotConn.IsZero():
+		h.Connect = ms(t.connectStart, t.gotConn)
+	case !t.connectStart.IsZero() && !t.connectDone.IsZero():
+		h.Connect = ms(t.connectStart, t.connectDone)
+	}
+	if !t.tlsStart.IsZero() && !t.tlsDone.IsZero() {
+		h.SSL = ms(t.tlsStart, t.tlsDone)
+	}
+	if !t.gotConn.IsZero() && !t.wroteRequest.IsZero() {
+		h.Send = ms(t.gotConn, t.wroteRequest)
+	}
+	if !t.wroteRequest.IsZero() && !t.firstByte.IsZero() {
+		h.Wait = ms(t.wroteRequest, t.firstByte)
+	}
+	if !t.firstByte.IsZero() {
+		h.Receive = ms(t.firstByte, end)
+	}
+	return h
+}
+
+func ms(from, to time.Time) float64 {
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for _, name := range sortedKeys(h) {
+		for _, v := range h[name] {
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
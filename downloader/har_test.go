@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/no-yan/tmp/downloader/internal/backoff"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func readHAR(t *testing.T, h *HARRecorder) harLog {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var f harFile
+	if err := json.Unmarshal(buf.Bytes(), &f); err != nil {
+		t.Fatalf("invalid HAR: %v\n%s", err, buf.String())
+	}
+	return f.Log
+}
+
+func TestHARRecorder(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	h := NewHARRecorder()
+	source := NewSliceSource(*NewTask(ts.URL + "/a?v=1"))
+	dc := NewDownloadController(source, &defaultPolicy, pubsub.NewPublisher[Event](), NewFileSaver(t.TempDir(), NewOSFS()), 1,
+		WithWorkerOptions(WithHeader(http.Header{"X-Run": {"test"}}), WithHAR(h)))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	log := readHAR(t, h)
+	if log.Version != "1.2" || log.Creator.Name != "downloader" {
+		t.Errorf("log = %+v", log)
+	}
+	if len(log.Entries) != 2 {
+		t.Fatalf("%d entries, want the failed attempt and the retry", len(log.Entries))
+	}
+	failed, ok := log.Entries[0], log.Entries[1]
+
+	if failed.Response.Status != http.StatusServiceUnavailable || !strings.Contains(failed.Error, "server error (503)") {
+		t.Errorf("failed attempt: status %d, error %q", failed.Response.Status, failed.Error)
+	}
+	if ok.Response.Status != http.StatusOK || ok.Error != "" || ok.Response.BodySize != 5 || ok.Response.Content.MimeType != "application/octet-stream" {
+		t.Errorf("successful attempt = %+v", ok.Response)
+	}
+	if !ok.StartedDateTime.After(failed.StartedDateTime) {
+		t.Errorf("entries are not ordered by start: %s, %s", failed.StartedDateTime, ok.StartedDateTime)
+	}
+
+	for _, e := range log.Entries {
+		if e.Request.Method != http.MethodGet || e.Request.URL != ts.URL+"/a?v=1" || e.ServerIPAddress != "127.0.0.1" {
+			t.Errorf("request = %+v to %s", e.Request, e.ServerIPAddress)
+		}
+		if !slices.Contains(e.Request.Headers, harNameValue{"X-Run", "test"}) || !slices.Contains(e.Request.QueryString, harNameValue{"v", "1"}) {
+			t.Errorf("request headers %v, query %v", e.Request.Headers, e.Request.QueryString)
+		}
+		if e.Timings.Send < 0 || e.Timings.Wait < 0 || e.Timings.Receive < 0 || e.Time < e.Timings.Wait {
+			t.Errorf("timings = %+v, time = %f", e.Timings, e.Time)
+		}
+	}
+	// 2回目の試行は接続を再利用する
+	if failed.Timings.Connect < 0 || ok.Timings.Connect != -1 {
+		t.Errorf("connect = %f, %f; want a new connection, then a reused one", failed.Timings.Connect, ok.Timings.Connect)
+	}
+}
+
+func TestHARRecorder_ConnectionError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL + "/a"
+	ts.Close()
+
+	h := NewHARRecorder()
+	policy := backoff.Policy{DelayMin: time.Millisecond, DelayMax: time.Millisecond, RetryLimit: 1}
+	d := NewDownloadWorker(url, &policy, pubsub.NewPublisher[Event](), WithHAR(h))
+	if _, _, err := d.Run(context.Background()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	log := readHAR(t, h)
+	if len(log.Entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(log.Entries))
+	}
+	e := log.Entries[0]
+	if e.Response.Status != 0 || !strings.Contains(e.Error, "connection refused") || e.Timings.Connect < 0 {
+		t.Errorf("entry = %+v", e)
+	}
+	// send、wait、receive に -1 は使えない
+	if e.Timings.Send != 0 || e.Timings.Wait != 0 || e.Timings.Receive != 0 {
+		t.Errorf("entry = %+v", e)
+	}
+}
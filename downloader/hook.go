@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/no-yan/multierr"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+const (
+	defaultHookConcurrency = 2
+	defaultHookTimeout     = 5 * time.Minute
+
+	// サマリーに表示する出力の上限
+	maxHookOutput = 1024
+)
+
+type HookKind string
+
+const (
+	HookOnComplete HookKind = "on-complete"
+	HookOnError    HookKind = "on-error"
+)
+
+// HookConfig is the configuration of the post-download hooks.
+type HookConfig struct {
+	OnComplete  string        `yaml:"on-complete,omitempty"`
+	OnError     string        `yaml:"on-error,omitempty"`
+	Concurrency int           `yaml:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+func defaultHookConfig() HookConfig {
+	return HookConfig{
+		Concurrency: defaultHookConcurrency,
+		Timeout:     defaultHookTimeout,
+	}
+}
+
+func (hc HookConfig) validate() error {
+	m := multierr.New()
+
+	if _, err := splitCommand(hc.OnComplete); err != nil {
+		m.Add(fmt.Errorf("hooks.on-complete: %w", err))
+	}
+	if _, err := splitCommand(hc.OnError); err != nil {
+		m.Add(fmt.Errorf("hooks.on-error: %w", err))
+	}
+	if hc.Concurrency < 1 {
+		m.Add(errors.New("hooks.concurrency: must be at least 1"))
+	}
+	if hc.Timeout <= 0 {
+		m.Add(fmt.Errorf("hooks.timeout: must be positive, got %s", hc.Timeout))
+	}
+
+	return m.Err()
+}
+
+// HookRunner runs a command for every finished download. The command is
+// split into words like a shell does, but is executed without a shell, so
+// that placeholders such as {url} cannot inject shell syntax.
+type HookRunner struct {
+	ctx        context.Context
+	onComplete []string
+	onError    []string
+	timeout    time.Duration
+	sem        chan int
+	wg         sync.WaitGroup
+	pub        *pubsub.Publisher[Event]
+}
+
+func NewHookRunner(ctx context.Context, hc HookConfig, pub *pubsub.Publisher[Event]) (*HookRunner, error) {
+	onComplete, err := splitCommand(hc.OnComplete)
+	if err != nil {
+		return nil, err
+	}
+	onError, err := splitCommand(hc.OnError)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HookRunner{
+		ctx:        ctx,
+		onComplete: onComplete,
+		onError:    onError,
+		timeout:    hc.Timeout,
+		sem:        make(chan int, hc.Concurrency),
+		pub:        pub,
+	}, nil
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (h *HookRunner) HandleEvent(event Event) {
+	switch e := event.(type) {
+	case EventEnd:
+		if len(h.onComplete) > 0 {
+			h.start(HookOnComplete, h.onComplete, map[string]string{"{path}": e.Path, "{url}": e.URL})
+		}
+	case EventAbort:
+		if len(h.onError) > 0 {
+			h.start(HookOnError, h.onError, map[string]string{"{url}": e.URL, "{error}": e.Err.Error()})
+		}
+	case EventDiskFull:
+		if len(h.onError) > 0 {
+			h.start(HookOnError, h.onError, map[string]string{"{url}": e.URL, "{error}": e.Err.Error()})
+		}
+	}
+}
+
+func (h *HookRunner) start(kind HookKind, command []string, vars map[string]string) {
+	// 中断された後は新しいフックを起動しない
+	if h.ctx.Err() != nil {
+		return
+	}
+
+	var pairs []string
+	for k, v := range vars {
+		pairs = append(pairs, k, v)
+	}
+	// 置換後の値に含まれるプレースホルダーは展開しない
+	r := strings.NewReplacer(pairs...)
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = r.Replace(arg)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.sem <- 1
+		defer func() { <-h.sem }()
+
+		h.pub.Publish(h.run(kind, vars["{url}"], args))
+	}()
+}
+
+func (h *HookRunner) run(kind HookKind, url string, args []string) EventHook {
+	ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// 制限時間を過ぎたら、シェルが起動した子プロセスも含めて終了させる
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	e := EventHook{URL: url, Kind: kind, ExitCode: cmd.ProcessState.ExitCode()}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		e.Err = fmt.Errorf("timed out after %s", h.timeout)
+	case err != nil:
+		e.Err = err
+	}
+	if e.Err != nil {
+		e.Output = lastBytes(out.String(), maxHookOutput)
+	}
+	return e
+}
+
+// Wait blocks until every started hook has finished.
+func (h *HookRunner) Wait() {
+	h.wg.Wait()
+}
+
+func lastBytes(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
+
+// splitCommand splits s into words, honoring single and double quotes and
+// backslash escapes.
+func splitCommand(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := map[string]struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		"plain":        {in: "tar -xf {path}", want: []string{"tar", "-xf", "{path}"}},
+		"quotes":       {in: `sh -c 'echo "$1"' "a b"`, want: []string{"sh", "-c", `echo "$1"`, "a b"}},
+		"escape":       {in: `echo a\ b`, want: []string{"echo", "a b"}},
+		"empty":        {in: "", want: nil},
+		"unterminated": {in: `echo "a`, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := splitCommand(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("splitCommand() mismatch: (-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHookRunner(t *testing.T) {
+	hc := defaultHookConfig()
+	hc.OnComplete = `sh -c 'echo "$0"; test "$0" = /out/file' {path}`
+	hc.OnError = `sh -c 'echo "$0" >&2; exit 3' {error}`
+	hc.Timeout = 5 * time.Second
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	h, err := NewHookRunner(context.Background(), hc, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.HandleEvent(EventEnd{URL: "https://example.com/a", Path: "/out/file"})
+	h.HandleEvent(NewEventAbort("https://example.com/b", errors.New("boom; rm -rf /")))
+	h.Wait()
+
+	results := make(map[HookKind]EventHook)
+	for _, e := range rec.events {
+		if e, ok := e.(EventHook); ok {
+			results[e.Kind] = e
+		}
+	}
+
+	if r := results[HookOnComplete]; r.Err != nil || r.ExitCode != 0 {
+		t.Errorf("on-complete = %+v, want success", r)
+	}
+	// エラーメッセージはシェルに解釈されずそのまま渡る
+	if r := results[HookOnError]; r.ExitCode != 3 || r.Output != "boom; rm -rf /" {
+		t.Errorf("on-error = %+v, want exit status 3 with the error as output", r)
+	}
+}
+
+func TestHookRunner_TimeoutChild(t *testing.T) {
+	// シェルが起動した子プロセスが出力を開いたままでも、制限時間で終わる
+	hc := defaultHookConfig()
+	hc.OnComplete = `sh -c 'sleep 5; echo hi'`
+	hc.Timeout = 200 * time.Millisecond
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	h, err := NewHookRunner(context.Background(), hc, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	h.HandleEvent(EventEnd{URL: "https://example.com/a", Path: "/out/file"})
+	h.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hook took %s with a timeout of %s", elapsed, hc.Timeout)
+	}
+	if len(rec.events) != 1 {
+		t.Fatalf("events = %v, want 1 hook result", rec.events)
+	}
+	if e, ok := rec.events[0].(EventHook); !ok || e.Err == nil || e.Err.Error() != "timed out after 200ms" {
+		t.Errorf("event = %+v, want a timeout", rec.events[0])
+	}
+}
@@ -1,6 +1,7 @@
 package backoff
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -93,3 +94,16 @@ func TestBackoff_NextTick(t *testing.T) {
 		})
 	}
 }
+
+func TestContinue(t *testing.T) {
+	for _, limit := range []uint{1, 3} {
+		b := Policy{time.Millisecond, time.Millisecond, limit}.NewBackoff()
+		attempts := uint(0)
+		for Continue(context.Background(), b) {
+			attempts++
+		}
+		if attempts != limit {
+			t.Errorf("RetryLimit %d: %d attempts, want %d", limit, attempts, limit)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package robots implements the subset of the Robots Exclusion Protocol
+// (RFC 9309) needed to decide whether a path may be crawled.
+package robots
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type rule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Rules are the rules of a robots.txt that apply to a single user agent.
+type Rules struct {
+	rules    []rule
+	disallow bool
+}
+
+// AllowAll is used when robots.txt does not exist.
+var AllowAll = &Rules{}
+
+// DisallowAll is used when robots.txt is unreachable.
+var DisallowAll = &Rules{disallow: true}
+
+// Parse reads robots.txt and keeps the groups that apply to agent.
+// Groups naming the product token of agent take precedence over the "*" group.
+func Parse(r io.Reader, agent string) *Rules {
+	token := productToken(agent)
+
+	var (
+		specific, wildcard []rule
+		hasSpecific        bool
+		// 現在のグループがagent/"*"に当てはまるか
+		matchAgent, matchWildcard bool
+		// user-agent行が連続している間は同じグループ
+		inAgents bool
+	)
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				matchAgent, matchWildcard = false, false
+			}
+			inAgents = true
+			if value == "*" {
+				matchWildcard = true
+			} else if value != "" && strings.EqualFold(value, token) {
+				matchAgent = true
+				hasSpecific = true
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			r := rule{allow: key == "allow", pattern: value, re: compile(value)}
+			if matchAgent {
+				specific = append(specific, r)
+			}
+			if matchWildcard {
+				wildcard = append(wildcard, r)
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	if hasSpecific {
+		return &Rules{rules: specific}
+	}
+	return &Rules{rules: wildcard}
+}
+
+// productToken は "downloader/1.0 (+https://...)" から "downloader" を取り出す
+func productToken(agent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(agent), "/")
+	token, _, _ = strings.Cut(token, " ")
+	return token
+}
+
+// compile converts a path pattern with "*" and a trailing "$" to a regexp.
+func compile(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// Allowed reports whether path (including the query) may be fetched.
+// The longest matching rule wins, and allow wins a tie.
+func (r *Rules) Allowed(path string) bool {
+	if r.disallow {
+		return false
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	allowed, longest := true, -1
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		n := len(rule.pattern)
+		if n > longest || (n == longest && rule.allow) {
+			allowed, longest = rule.allow, n
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,57 @@
+package robots
+
+import (
+	"strings"
+	"testing"
+)
+
+const robotsTxt = `
+# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: otherbot
+User-agent: Downloader
+Disallow: /only-for-downloader
+
+User-agent: bot
+User-agent: load
+Disallow: /
+`
+
+func TestRules_Allowed(t *testing.T) {
+	tests := map[string]struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		"root":                {"somebot", "/", true},
+		"disallowed prefix":   {"somebot", "/private/a", false},
+		"longer allow wins":   {"somebot", "/private/public/a", true},
+		"wildcard and anchor": {"somebot", "/docs/a.pdf", false},
+		"anchor not at end":   {"somebot", "/docs/a.pdf?x=1", true},
+		"specific group":      {"downloader/1.0", "/only-for-downloader", false},
+		"specific group only": {"downloader/1.0", "/private/a", true},
+		// 製品トークン全体が一致するグループだけを使う
+		"substring of agent": {"downloader/1.0 (+https://example.com/bot)", "/a", true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := Parse(strings.NewReader(robotsTxt), tt.agent)
+			if got := r.Allowed(tt.path); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules_AllowDisallowAll(t *testing.T) {
+	if !AllowAll.Allowed("/a") {
+		t.Error("AllowAll.Allowed() = false")
+	}
+	if DisallowAll.Allowed("/a") {
+		t.Error("DisallowAll.Allowed() = true")
+	}
+}
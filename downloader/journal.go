@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ジャーナルの行の種類。結果の行は taskState の名前を使う
+const (
+	journalRun  = "run"
+	journalTask = "task"
+)
+
+// journalEntry はジャーナルの1行
+type journalEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Args は run の行に記録する、実行のフラグ
+	Args     []string `json:"args,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Mirrors  []string `json:"mirrors,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Journal appends the tasks of a run and what became of them to a file of
+// JSON lines, so that the status command can report on the run and the
+// resume command can restart the downloads that did not complete. It must
+// be registered on the publisher of the controller to see the results.
+type Journal struct {
+	f   *os.File
+	now func() time.Time
+
+	mu sync.Mutex
+	// err は最初の書き込みのエラーで、Close で返す
+	err error
+}
+
+// OpenJournal opens the journal at path for appending, and records the
+// start of a run with the flags args. A new journal is readable only by the
+// user, as the URLs and flags may be private.
+func OpenJournal(path string, args []string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	j := &Journal{f: f, now: time.Now}
+	if err := j.write(journalEntry{Event: journalRun, Args: args}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) write(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	e.Time = j.now().UTC()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// 1行を1回で書き、中断されても途中までの行が残りにくいようにする
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		j.err = fmt.Errorf("journal: %w", err)
+	}
+	return j.err
+}
+
+// Source records every task of src as it is read.
+func (j *Journal) Source(src TaskSource) TaskSource {
+	return &journalSource{src: src, j: j}
+}
+
+type journalSource struct {
+	src TaskSource
+	j   *Journal
+}
+
+func (s *journalSource) Next(ctx context.Context) (Task, bool, error) {
+	task, ok, err := s.src.Next(ctx)
+	if ok {
+		// 記録に失敗してもダウンロードは続け、エラーは Close で返す
+		s.j.write(journalEntry{Event: journalTask, URL: task.url, Mirrors: task.mirrors, Priority: task.priority})
+	}
+	return task, ok, err
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (j *Journal) HandleEvent(event Event) {
+	switch e := event.(type) {
+	case EventEnd:
+		j.write(journalEntry{Event: stateDone.String(), URL: e.URL, Path: e.Path})
+	case EventUnchanged:
+		j.write(journalEntry{Event: stateUnchanged.String(), URL: e.URL})
+	case EventAbort:
+		state := stateFailed
+		if errors.Is(e.Err, ErrCanceled) {
+			state = stateCanceled
+		}
+		j.write(journalEntry{Event: state.String(), URL: e.URL, Error: oneLine(e.Err)})
+	case EventDiskFull:
+		j.write(journalEntry{Event: stateFailed.String(), URL: e.URL, Error: oneLine(e.Err)})
+	}
+}
+
+// Close closes the file, returning the first error writing to it.
+func (j *Journal) Close() error {
+	err := j.f.Close()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	return err
+}
+
+// JournalState is what a journal tells about the runs recorded in it.
+type JournalState struct {
+	Runs int
+	// Args は最後の実行のフラグ
+	Args    []string
+	Updated time.Time
+	// Tasks は記録されたURLごとの最後の状態で、最初に記録された順に並ぶ
+	Tasks []JournalTask
+
+	index map[string]int
+}
+
+// JournalTask is the last recorded state of a URL. A task read in a run
+// that has no result yet is in stateQueued.
+type JournalTask struct {
+	Task  Task
+	State taskState
+	Path  string
+	Err   string
+}
+
+// Completed reports whether the download needs no resuming.
+func (t JournalTask) Completed() bool {
+	return t.State == stateDone || t.State == stateUnchanged
+}
+
+// Pending returns the tasks that did not complete, in the order they were
+// first recorded.
+func (s *JournalState) Pending() []Task {
+	var tasks []Task
+	for _, t := range s.Tasks {
+		if !t.Completed() {
+			tasks = append(tasks, t.Task)
+		}
+	}
+	return tasks
+}
+
+// ReadJournalFile reads the journal at path.
+func ReadJournalFile(path string) (*JournalState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	defer f.Close()
+	state, err := ReadJournal(f)
+	if err != nil {
+		return nil, fmt.Errorf("journal %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// ReadJournal reads a journal written by Journal. A last line cut short by
+// an interrupted write is ignored.
+func ReadJournal(r io.Reader) (*JournalState, error) {
+	s := &JournalState{index: make(map[string]int)}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e journalEntry
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("line %d: %w", n, jerr)
+			}
+			s.add(e)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return s, nil
+}
+
+func (s *JournalState) add(e journalEntry) {
+	if e.Time.After(s.Updated) {
+		s.Updated = e.Time
+	}
+	if e.Event == journalRun {
+		s.Runs++
+		s.Args = e.Args
+		return
+	}
+
+	state, ok := stateQueued, e.Event == journalTask
+	if !ok {
+		state, ok = parseTaskState(e.Event)
+	}
+	// 知らない種類の行は読み飛ばす
+	if !ok || e.URL == "" {
+		return
+	}
+
+	i, ok := s.index[e.URL]
+	if !ok {
+		i = len(s.Tasks)
+		s.index[e.URL] = i
+		s.Tasks = append(s.Tasks, JournalTask{Task: *NewTask(e.URL)})
+	}
+	t := &s.Tasks[i]
+	t.State = state
+	switch state {
+	case stateQueued:
+		// resume で読み直したタスクは結果が出るまで未完了に戻す
+		t.Task.mirrors = e.Mirrors
+		t.Task.priority = e.Priority
+		t.Path, t.Err = "", ""
+	case stateDone, stateUnchanged:
+		t.Path, t.Err = e.Path, ""
+	default:
+		t.Err = e.Error
+	}
+}
+
+func parseTaskState(s string) (taskState, bool) {
+	for state := stateQueued; state <= stateCanceled; state++ {
+		if state.String() == s {
+			return state, true
+		}
+	}
+	return stateQueued, false
+}
+
+// runResume implements the resume command.
+func runResume(args []string, stdout, stderr io.Writer) int {
+	flags, _ := newFlagSet("resume")
+	if err := flags.Parse(args); err != nil {
+		return commandError("resume", &usageError{err}, stdout, stderr)
+	}
+	if flags.NArg() != 1 {
+		return commandError("resume", &usageError{errors.New("exactly one journal must be given")}, stdout, stderr)
+	}
+	path := flags.Arg(0)
+	state, err := ReadJournalFile(path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	tasks := state.Pending()
+	if len(tasks) == 0 {
+		fmt.Fprintf(stdout, "nothing to resume in %s\n", path)
+		return exitOK
+	}
+
+	// 記録したフラグの後に指定したフラグを並べ、後のものを優先する
+	runArgs := append(slices.Clone(state.Args), args[:len(args)-flags.NArg()]...)
+	config, err := NewConfigFromArgs(append([]string{"get"}, runArgs...), os.Getenv)
+	if err != nil {
+		return commandError("resume", err, stdout, stderr)
+	}
+	// 入力ファイルから読んだタスクはジャーナルに記録されている
+	config.inputFiles, config.metalinks = nil, nil
+	config.tasks = Tasks(tasks)
+	config.journal = path
+	return runDownload(config, stdout, stderr)
+}
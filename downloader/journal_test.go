@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	a, b, c := "https://example.com/a", "https://example.com/b", "https://example.com/c"
+
+	run := func(args []string, tasks []Task, events ...Event) {
+		t.Helper()
+		j, err := OpenJournal(path, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := j.Source(NewSliceSource(tasks...))
+		for {
+			_, ok, err := src.Next(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+		}
+		for _, e := range events {
+			j.HandleEvent(e)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c は結果が出る前に中断された
+	withMirror := *NewTask(b)
+	withMirror.mirrors = []string{"https://mirror.example.com/b"}
+	run([]string{"--workers=2"}, []Task{*NewTask(a), withMirror, *NewTask(c)},
+		EventEnd{URL: a, Path: "out/a"},
+		NewEventAbort(b, errors.New("500 Internal Server Error")),
+	)
+
+	state, err := ReadJournalFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// URLやフラグを他のユーザーに読ませない
+	if info, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+		t.Errorf("journal mode = %v, %v; want 0600", info.Mode(), err)
+	}
+	type got struct {
+		URL   string
+		State taskState
+		Path  string
+		Err   string
+	}
+	summarize := func(s *JournalState) []got {
+		var tasks []got
+		for _, t := range s.Tasks {
+			tasks = append(tasks, got{t.Task.url, t.State, t.Path, t.Err})
+		}
+		return tasks
+	}
+	want := []got{
+		{a, stateDone, "out/a", ""},
+		{b, stateFailed, "", "500 Internal Server Error"},
+		{c, stateQueued, "", ""},
+	}
+	if diff := cmp.Diff(want, summarize(state)); diff != "" {
+		t.Errorf("tasks (-want +got):\n%s", diff)
+	}
+	pending := state.Pending()
+	if len(pending) != 2 || pending[0].url != b || pending[1].url != c {
+		t.Fatalf("pending = %v, want b and c", pending)
+	}
+	if diff := cmp.Diff(withMirror.mirrors, pending[0].mirrors); diff != "" {
+		t.Errorf("mirrors of b (-want +got):\n%s", diff)
+	}
+
+	// 再開した実行は同じファイルに追記し、最後の行が途中で切れている
+	run([]string{"--workers=2", "--workers=1"}, pending,
+		EventEnd{URL: b, Path: "out/b"},
+		NewEventAbort(c, ErrCanceled),
+	)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-10-19T00:00:00Z","event":"done","url":"https://exa`)
+	f.Close()
+
+	state, err = ReadJournalFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Runs != 2 || !cmp.Equal(state.Args, []string{"--workers=2", "--workers=1"}) {
+		t.Errorf("runs = %d, args = %v; want 2 and the args of the second run", state.Runs, state.Args)
+	}
+	want[1] = got{b, stateDone, "out/b", ""}
+	want[2] = got{c, stateCanceled, "", ErrCanceled.Error()}
+	if diff := cmp.Diff(want, summarize(state)); diff != "" {
+		t.Errorf("tasks after resume (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadJournal_Invalid(t *testing.T) {
+	// 途中の行が壊れているのは中断では説明できない
+	_, err := ReadJournal(strings.NewReader("{\"event\":\"run\"}\nnot json\n{\"event\":\"run\"}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want an error on line 2", err)
+	}
+}
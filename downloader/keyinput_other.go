@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// 端末の読み込みを中断できないため、Run の後もキー入力を待つgoroutineが残る
+func openKeyInput(in *os.File) (io.ReadCloser, error) {
+	return io.NopCloser(in), nil
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// openKeyInput returns a reader of the terminal in whose Read returns when
+// it is closed, so that no goroutine keeps reading keys after Run returns.
+func openKeyInput(in *os.File) (io.ReadCloser, error) {
+	fd, err := syscall.Dup(int(in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	// ノンブロッキングのファイルはランタイムのポーラーで待つため、Close で Read が戻る
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &keyInput{File: os.NewFile(uintptr(fd), in.Name()), in: in}, nil
+}
+
+type keyInput struct {
+	*os.File
+	in *os.File
+}
+
+// Close は複製元と共有しているノンブロッキングの設定も元に戻す
+func (k *keyInput) Close() error {
+	err := k.File.Close()
+	syscall.SetNonblock(int(k.in.Fd()), false)
+	return err
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyInput_Close(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	input, err := openKeyInput(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := input.Read(make([]byte, 1))
+		done <- err
+	}()
+	// Read が待ち始めてから閉じる
+	time.Sleep(10 * time.Millisecond)
+	input.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Read is still blocked after Close")
+	}
+	// 閉じた後のキー入力は元のファイルから読める
+	w.Write([]byte("q"))
+	b := make([]byte, 1)
+	if _, err := r.Read(b); err != nil || string(b) != "q" {
+		t.Errorf("Read() = %q, %v", b, err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FileTooLargeError means that a file is larger than --max-filesize.
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file too large: %d bytes, limit is %d bytes", e.Size, e.Limit)
+}
+
+// TotalLimitError means that a file does not fit in what is left of --max-total.
+type TotalLimitError struct {
+	Limit int64
+}
+
+func (e *TotalLimitError) Error() string {
+	return fmt.Sprintf("total size limit of %d bytes exceeded", e.Limit)
+}
+
+// InsufficientSpaceError means that the Content-Length of a file is larger
+// than the free space in the output directory.
+type InsufficientSpaceError struct {
+	Dir  string
+	Need int64
+	Free int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough space in %s: need %d bytes, %d bytes free", e.Dir, e.Need, e.Free)
+}
+
+// DiskFullError means that the disk filled up while saving. Unlike other
+// errors it stops starting new downloads, since they would fail the same way.
+type DiskFullError struct {
+	Dir string
+	Err error
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("disk full: %s: %v", e.Dir, e.Err)
+}
+
+func (e *DiskFullError) Unwrap() error {
+	return e.Err
+}
+
+// spaceSaver is a Saver that can tell the free space where it saves.
+type spaceSaver interface {
+	Dir() string
+	FreeSpace() (int64, error)
+}
+
+// sizeLimits は --max-filesize/--max-total と空き容量の確認を全タスクで共有する
+type sizeLimits struct {
+	maxFile  int64
+	maxTotal int64
+	// space がnilなら空き容量を確認しない
+	space spaceSaver
+
+	mu sync.Mutex
+	// total は受信したバイト数と、実行中のタスクのうち受信していない既知のサイズの和
+	total int64
+	// pending は実行中のタスクがこれから書き込む既知のバイト数
+	pending int64
+}
+
+// start checks a download of size bytes, -1 if unknown, against the limits
+// and reserves its size.
+func (l *sizeLimits) start(size int64) (*sizeGuard, error) {
+	if l.maxFile > 0 && size > l.maxFile {
+		return nil, &FileTooLargeError{Size: size, Limit: l.maxFile}
+	}
+
+	g := &sizeGuard{limits: l}
+	if size <= 0 {
+		return g, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxTotal > 0 && l.total+size > l.maxTotal {
+		return nil, &TotalLimitError{Limit: l.maxTotal}
+	}
+	if l.space != nil {
+		// 空き容量が取得できない環境では確認しない
+		if free, err := l.space.FreeSpace(); err == nil && size > free-l.pending {
+			return nil, &InsufficientSpaceError{Dir: l.space.Dir(), Need: size, Free: max(free-l.pending, 0)}
+		}
+	}
+	l.total += size
+	l.pending += size
+	g.reserved, g.pending = size, size
+	return g, nil
+}
+
+// sizeGuard は1つのダウンロードの受信量を数え、上限を超えたら読み込みを失敗させる
+type sizeGuard struct {
+	limits *sizeLimits
+	n      int64
+	// reserved は total に計上済みのバイト数、pending は pending に計上済みで未受信のバイト数
+	reserved int64
+	pending  int64
+}
+
+func (g *sizeGuard) reader(r io.Reader) io.Reader {
+	return &guardedReader{r: r, g: g}
+}
+
+func (g *sizeGuard) add(n int) error {
+	l := g.limits
+	g.n += int64(n)
+	if l.maxFile > 0 && g.n > l.maxFile {
+		return &FileTooLargeError{Size: g.n, Limit: l.maxFile}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	written := min(int64(n), g.pending)
+	g.pending -= written
+	l.pending -= written
+
+	if over := g.n - g.reserved; over > 0 {
+		if l.maxTotal > 0 && l.total+over > l.maxTotal {
+			return &TotalLimitError{Limit: l.maxTotal}
+		}
+		l.total += over
+		g.reserved = g.n
+	}
+	return nil
+}
+
+// finish releases the reservation not used because the download ended early.
+func (g *sizeGuard) finish() {
+	l := g.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending -= g.pending
+	l.total -= g.reserved - g.n
+	g.pending, g.reserved = 0, g.n
+}
+
+type guardedReader struct {
+	r io.Reader
+	g *sizeGuard
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if lerr := r.g.add(n); lerr != nil {
+			return n, lerr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+// newSizeServer は /known/N でContent-Length付きの、/chunked/N でサイズ不明のNバイトを返す
+func newSizeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, size, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		n, _ := strconv.Atoi(size)
+		if kind == "known" {
+			w.Header().Set("Content-Length", size)
+		}
+		io.WriteString(w, strings.Repeat("x", n))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestDownloadController_SizeLimits(t *testing.T) {
+	ts := newSizeServer(t)
+
+	tests := map[string]struct {
+		maxFile, maxTotal int64
+		paths             []string
+		wantEnd           int
+		wantErr           error
+	}{
+		"max-filesize by Content-Length": {
+			maxFile: 10, paths: []string{"/known/5", "/known/20"},
+			wantEnd: 1, wantErr: &FileTooLargeError{Size: 20, Limit: 10},
+		},
+		"max-filesize while streaming": {
+			maxFile: 10, paths: []string{"/chunked/5", "/chunked/20"},
+			wantEnd: 1, wantErr: &FileTooLargeError{Size: 20, Limit: 10},
+		},
+		"max-total": {
+			maxTotal: 25, paths: []string{"/known/10", "/chunked/10", "/known/10", "/known/5"},
+			wantEnd: 3, wantErr: &TotalLimitError{Limit: 25},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var tasks []Task
+			for _, p := range tt.paths {
+				tasks = append(tasks, *NewTask(ts.URL + p))
+			}
+			rec := &eventRecorder{}
+			pub := pubsub.NewPublisher[Event]()
+			pub.Register(rec)
+			saver := NewFileSaver(t.TempDir(), NewOSFS())
+
+			dc := NewDownloadController(NewSliceSource(tasks...), &defaultPolicy, pub, saver, 1, WithSizeLimits(tt.maxFile, tt.maxTotal))
+			if err := dc.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rec.count(EventTypeEnd); got != tt.wantEnd {
+				t.Errorf("%d downloads completed, want %d", got, tt.wantEnd)
+			}
+			var errs []string
+			for _, e := range rec.events {
+				if abort, ok := e.(EventAbort); ok {
+					errs = append(errs, abort.Err.Error())
+				}
+			}
+			if want := []string{tt.wantErr.Error()}; fmt.Sprint(errs) != fmt.Sprint(want) {
+				t.Errorf("aborts = %q, want %q", errs, want)
+			}
+		})
+	}
+}
+
+type fixedSpaceSaver struct {
+	free int64
+}
+
+func (s fixedSpaceSaver) Dir() string               { return "out" }
+func (s fixedSpaceSaver) FreeSpace() (int64, error) { return s.free, nil }
+
+func TestSizeLimits_FreeSpace(t *testing.T) {
+	l := &sizeLimits{space: fixedSpaceSaver{free: 100}}
+
+	g, err := l.start(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 実行中のダウンロードがこれから書き込む分は空いていないものとして扱う
+	var spaceErr *InsufficientSpaceError
+	if _, err := l.start(60); !errors.As(err, &spaceErr) || spaceErr.Free != 40 {
+		t.Errorf("err = %v, want InsufficientSpaceError with 40 bytes free", err)
+	}
+	if _, err := l.start(-1); err != nil {
+		t.Errorf("unknown size: err = %v, want nil", err)
+	}
+
+	g.finish()
+	if _, err := l.start(60); err != nil {
+		t.Errorf("after finish: err = %v, want nil", err)
+	}
+}
+
+// fullSaver は常にディスクがいっぱいで失敗する
+type fullSaver struct{}
+
+func (fullSaver) Save(r io.Reader, url string) (int64, error) {
+	return 0, &DiskFullError{Dir: "out", Err: syscall.ENOSPC}
+}
+
+func TestDownloadController_DiskFull(t *testing.T) {
+	ts := newSizeServer(t)
+
+	var tasks []Task
+	for i := range 10 {
+		tasks = append(tasks, *NewTask(fmt.Sprintf("%s/known/%d", ts.URL, i+1)))
+	}
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+
+	dc := NewDownloadController(NewSliceSource(tasks...), &defaultPolicy, pub, fullSaver{}, 2)
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 実行中だった分だけが失敗し、残りは開始しない
+	if got := rec.count(EventTypeDiskFull); got < 1 || got > 2 {
+		t.Errorf("%d disk full events, want 1 or 2", got)
+	}
+	if got := rec.count(EventTypeStart); got > 2 {
+		t.Errorf("%d downloads started, want at most 2", got)
+	}
+	if got := rec.count(EventTypeAbort); got != 0 {
+		t.Errorf("%d aborts, want 0", got)
+	}
+}
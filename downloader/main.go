@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/no-yan/tmp/downloader/internal/backoff"
 	"github.com/no-yan/tmp/downloader/internal/pubsub"
+	"golang.org/x/term"
 )
 
 var defaultPolicy = backoff.Policy{
@@ -17,28 +23,479 @@ var defaultPolicy = backoff.Policy{
 }
 
 func main() {
-	config := NewConfigFromFlags()
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runDownload runs a download command with config, and returns the exit
+// status.
+func runDownload(config *Config, stdout, stderr io.Writer) int {
+	printDuplicates(stderr, config.duplicates)
+	if config.printConfig {
+		config.WriteTo(stdout)
+		return exitOK
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
-	defer cancel()
+	ctx := context.Background()
+	if config.totalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, config.totalTimeout, &TotalTimeoutError{Timeout: config.totalTimeout})
+		defer cancel()
+	}
 
-	ctx, stop := setupSignalContext(ctx)
+	ctx, drain, stop := setupSignalContext(ctx, stderr)
 	defer stop()
 
+	client, err := NewHTTPClient(config.transport)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	err = RegisterFetchers(client, map[string]Fetcher{
+		"file": FileFetcher{},
+		"data": DataFetcher{},
+		"s3":   NewS3Fetcher(config.s3, S3CredentialsFromEnv(os.Getenv), client),
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	jar, err := setupAuth(client, config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	saver, err := newSaver(config, stdout, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	// 標準出力をデータに使う場合、進捗と結果は標準エラー出力に書く
+	status := stdout
+	if config.stdout || config.pipe != "" {
+		status = stderr
+	}
+	if config.tui && !(term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))) {
+		fmt.Fprintln(stderr, "--tui needs a terminal for stdin and stdout")
+		return exitUsage
+	}
 	pub := pubsub.NewPublisher[Event]()
-	bar := NewMultiProgressBar(ctx)
-	printer := NewPrinter(os.Stdout, config.outputDir)
-	pub.Register(bar, printer)
+	// ダッシュボードを使う場合と、巡回ごとに行を出力する監視、デーモンでは進捗バーを表示しない
+	var bar *MultiProgressBar
+	if !config.tui && config.command == "get" {
+		bar = NewMultiProgressBar(ctx, status)
+		pub.Register(bar)
+	}
+	printer := NewPrinter(status, config.outputDir)
+	switch {
+	case config.stdout:
+		printer.Out = "stdout"
+	case config.pipe != "":
+		printer.Out = fmt.Sprintf("command %q", config.pipe)
+	}
+	pub.Register(printer)
+
+	hooks, err := NewHookRunner(ctx, config.hooks, pub)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	pub.Register(hooks)
 
-	saver := NewFileSaver(config.outputDir, NewOSFS())
-	dc := NewDownloadController(config.tasks, &defaultPolicy, pub, saver, config.workers)
-	dc.Run(ctx)
+	opts := []ControllerOption{
+		WithSchedule(config.schedule, config.window, NewHeadProber(client, config.header)),
+		WithHostLimits(config.hostLimits),
+		WithDrain(drain),
+		WithSizeLimits(config.maxFileSize, config.maxTotal),
+		WithWorkerOptions(
+			WithHeader(config.header),
+			WithClient(client),
+			WithSlowMirror(config.slowMirror.Speed, config.slowMirror.Window),
+			WithTimeouts(config.timeout, config.stallTimeout),
+			WithMinSpeed(config.minSpeed.Speed, config.minSpeed.Window),
+		),
+	}
+	var har *HARRecorder
+	if config.har != "" {
+		har = NewHARRecorder()
+		opts = append(opts, WithWorkerOptions(WithHAR(har)))
+	}
+	tracer, closeTrace, err := newTracer(config.trace, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if tracer != nil {
+		opts = append(opts, WithTracer(tracer))
+	}
+	if config.autoWorkers {
+		opts = append(opts, WithAdaptiveWorkers(NewAdaptiveLimiter(int(config.workers), maxAutoWorkers)))
+	}
+	if config.tui {
+		opts = append(opts, WithReadAhead(config.window))
+	}
+	if fileSaver, ok := saver.(*FileSaver); ok && config.mirror {
+		opts = append(opts, WithValidatorStore(fileSaver))
+	}
+	// 監視では条件付きリクエストで変化のないものを受信しない
+	if versioned, ok := saver.(*VersionedSaver); ok {
+		opts = append(opts, WithValidatorStore(versioned))
+	}
+	if config.failFast {
+		opts = append(opts, WithFailFast())
+	}
+	if config.recursive {
+		crawler, err := NewCrawler(config.crawl, client, config.header.Get("User-Agent"))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		opts = append(opts, WithCrawler(crawler))
+	}
+	source, dups, closeInputs, err := openTaskSource(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	defer closeInputs()
+	printDuplicates(stderr, dups)
 
-	bar.Flush()
+	if config.dryRun {
+		probes, err := NewDryRun(client, config.header, saver, config.workers, config.timeout).Run(drain, source)
+		if err != nil {
+			fmt.Fprintln(stderr, "reading input:", err)
+		}
+		WriteProbes(stdout, probes)
+		saveCookies(jar, config.cookieJar, stderr)
+		closeTrace()
+		if err != nil {
+			return exitUsage
+		}
+		failed := 0
+		for _, p := range probes {
+			if p.Failed() {
+				failed++
+			}
+		}
+		return failureStatus(failed, len(probes))
+	}
+
+	var journal *Journal
+	if config.journal != "" {
+		journal, err = OpenJournal(config.journal, config.args)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		pub.Register(journal)
+		source = journal.Source(source)
+	}
+
+	if config.command == "watch" {
+		watcher := NewWatcher(source, config.watch.Interval, status)
+		pub.Register(watcher)
+		// 中断されたら実行中の巡回を終えて止める
+		stopWatch := context.AfterFunc(drain, watcher.Stop)
+		defer stopWatch()
+		source = watcher
+	}
+
+	dc := NewDownloadController(source, &config.policy, pub, saver, config.workers, opts...)
+	stopPauseSignals := handlePauseSignals(dc)
+	defer stopPauseSignals()
+	stopServer := func() {}
+	if config.command == "serve" {
+		server := NewServer(dc)
+		pub.Register(server)
+		stopServer, err = startServer(server, dc, config.listen, drain, stderr)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	stopDashboard := func() {}
+	if config.tui {
+		stopDashboard = startDashboard(dc, pub, stderr)
+	}
+	inputErr := dc.Run(ctx)
+	stopDashboard()
+	stopServer()
+	if inputErr != nil {
+		fmt.Fprintln(stderr, "reading input:", inputErr)
+	}
+	if err := context.Cause(ctx); errors.As(err, new(*TotalTimeoutError)) {
+		fmt.Fprintln(stderr, err)
+	}
+	hooks.Wait()
+	if w, ok := saver.(*WARCSaver); ok {
+		if err := w.Close(); err != nil {
+			fmt.Fprintln(stderr, "warc:", err)
+		}
+	}
+	if journal != nil {
+		if err := journal.Close(); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+	}
+	saveCookies(jar, config.cookieJar, stderr)
+	closeTrace()
+	if har != nil {
+		if err := har.WriteFile(config.har); err != nil {
+			fmt.Fprintln(stderr, "har:", err)
+		}
+	}
+
+	if bar != nil {
+		bar.Flush()
+	}
 	printer.Print()
+	failed := printer.Abort + len(printer.DiskFull)
+	exit := failureStatus(failed, failed+printer.Success+printer.Unchanged)
+	if inputErr != nil && exit == exitOK {
+		exit = exitFailure
+	}
+	return exit
+}
+
+// startDashboard shows the dashboard until the returned function is called.
+// The downloads are held until q is pressed, so that failed ones can still
+// be retried after the others have finished.
+func startDashboard(dc *DownloadController, pub *pubsub.Publisher[Event], stderr io.Writer) (stop func()) {
+	release := dc.Hold()
+	dash := NewDashboard(dc, func() {
+		release()
+		interruptSelf()
+	})
+	pub.Register(dash)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := dash.Run(ctx, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(stderr, err)
+			release()
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// interruptSelf は Ctrl-C と同じく、1回目で新しいダウンロードを止め、2回目で中断する
+func interruptSelf() {
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(os.Interrupt)
+	}
+}
+
+// setupAuth gives client a cookie jar, loaded from --cookies, and the
+// credentials of .netrc.
+func setupAuth(client *http.Client, config *Config) (*CookieJar, error) {
+	jar := NewCookieJar()
+	if config.cookies != "" {
+		if err := jar.LoadFile(config.cookies); err != nil {
+			return nil, err
+		}
+	}
+	client.Jar = jar
+
+	if config.netrc {
+		n, err := LoadNetrc(config.netrcFile, os.Getenv)
+		if err != nil {
+			return nil, fmt.Errorf("netrc: %w", err)
+		}
+		WithNetrc(client, n)
+	}
+	return jar, nil
 }
 
-func setupSignalContext(parent context.Context) (ctx context.Context, stop context.CancelFunc) {
-	ctx, stop = signal.NotifyContext(parent, os.Interrupt)
-	return
+func saveCookies(jar *CookieJar, path string, stderr io.Writer) {
+	if path == "" {
+		return
+	}
+	if err := jar.SaveFile(path); err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+}
+
+// newTracer は設定された送信先にトレースを送るTracerを作る。無効ならnilを返す。
+// closeTrace は残りのスパンを送り、ファイルを閉じる。送れなかった場合は stderr に書く。
+func newTracer(tc TraceConfig, stderr io.Writer) (tracer *Tracer, closeTrace func(), err error) {
+	if !tc.enabled() {
+		return nil, func() {}, nil
+	}
+
+	var exporters []SpanExporter
+	if tc.OTLPEndpoint != "" {
+		// ダウンロード用のクライアントのCookieや認証情報を送らないよう、別のクライアントを使う
+		e, err := NewOTLPExporter(tc.OTLPEndpoint, &http.Client{Timeout: otlpTimeout})
+		if err != nil {
+			return nil, nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	var file *os.File
+	if tc.File != "" {
+		file, err = os.OpenFile(tc.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("trace file: %w", err)
+		}
+		exporters = append(exporters, NewFileExporter(file))
+	}
+
+	tracer = NewTracer(exporters...)
+	return tracer, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+		if file != nil {
+			file.Close()
+		}
+	}, nil
+}
+
+// newSaver は出力先の指定に応じたSaverを返す
+func newSaver(config *Config, stdout, stderr io.Writer) (Saver, error) {
+	switch {
+	case config.command == "watch":
+		return NewVersionedSaver(NewFileSaver(config.outputDir, NewOSFS()), config.watch.Keep), nil
+	case config.stdout:
+		return NewStdoutSaver(stdout), nil
+	case config.pipe != "":
+		return NewPipeSaver(config.pipe, stdout, stderr)
+	case config.warc.Enabled:
+		return NewWARCSaver(config.outputDir, config.warc), nil
+	default:
+		return NewFileSaver(config.outputDir, NewOSFS()), nil
+	}
+}
+
+func printDuplicates(w io.Writer, dups []Duplicate) {
+	for _, dup := range dups {
+		fmt.Fprintf(w, "skipping duplicate URL %s (same as %s)\n", dup.URL, dup.Of)
+	}
+}
+
+// openTaskSource は引数のURLに続けて入力ファイルを順に読むTaskSourceを作る。
+// 通常のファイルは開始前に全体を検査し、不正な行があればエラーを、重複した行は dups を返す
+func openTaskSource(config *Config) (source TaskSource, dups []Duplicate, closeAll func(), err error) {
+	sources := []TaskSource{config.tasks.Source()}
+	seen := make(map[string]string, len(config.tasks))
+	for _, task := range config.tasks {
+		seen[task.url] = task.url
+	}
+	var files []*os.File
+	closeAll = func() {
+		// 読み込みのgoroutineを止めてからファイルを閉じる
+		for _, src := range sources {
+			if c, ok := src.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for _, name := range config.inputFiles {
+		if name == "-" {
+			sources = append(sources, NewLineSource(os.Stdin))
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+		files = append(files, f)
+		skip, fileDups, err := checkInputFile(f, seen)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		dups = append(dups, fileDups...)
+		sources = append(sources, newLineSource(f, skip))
+	}
+
+	// Metalinkは小さいので先に全体を読む
+	for _, name := range config.metalinks {
+		f, err := os.Open(name)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+		src, err := NewMetalinkSource(f)
+		f.Close()
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sources = append(sources, src)
+	}
+
+	return NewMultiSource(sources...), dups, closeAll, nil
+}
+
+// checkInputFile は通常のファイルを検査して先頭に戻す。
+// パイプなど読み直せないものは標準入力と同じく、読みながら検査する
+func checkInputFile(f *os.File, seen map[string]string) (skip map[int]bool, dups []Duplicate, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, nil
+	}
+	skip, dups, err = checkTaskLines(f, seen)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return skip, dups, nil
+}
+
+// ErrInterrupted is the cause of the cancellation by a second signal.
+var ErrInterrupted = errors.New("interrupted")
+
+// setupSignalContext handles SIGINT and SIGTERM in two stages: the first
+// signal ends drain, so that no new download starts, and the second one
+// cancels ctx to abort the downloads in progress.
+func setupSignalContext(parent context.Context, stderr io.Writer) (ctx, drain context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	drain, stopDrain := context.WithCancel(ctx)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-sigs:
+		case <-done:
+			return
+		}
+		fmt.Fprintln(stderr, "\nwaiting for downloads in progress; interrupt again to abort them")
+		stopDrain()
+
+		select {
+		case <-sigs:
+		case <-done:
+			return
+		}
+		cancel(ErrInterrupted)
+	}()
+
+	return ctx, drain, func() {
+		signal.Stop(sigs)
+		close(done)
+		stopDrain()
+		cancel(nil)
+	}
 }
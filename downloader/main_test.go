@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/no-yan/tmp/downloader/internal/pubsub"
@@ -57,8 +60,8 @@ func TestDownload(t *testing.T) {
 		{
 			name:       "Not Found",
 			urlPath:    "/unknown",
-			expectErr:  false,
-			expectBody: "not found",
+			expectErr:  true,
+			expectBody: "",
 		},
 	}
 
@@ -86,6 +89,122 @@ func TestDownload(t *testing.T) {
 	}
 }
 
+func TestDownload_Conditional(t *testing.T) {
+	ts := setupServer(t)
+	pub := pubsub.NewPublisher[Event]()
+
+	d := NewDownloadWorker(ts.URL+"/etag", &defaultPolicy, pub)
+	body, _, err := d.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if d.validators.ETag != `"v1"` {
+		t.Fatalf("ETag = %q, want %q", d.validators.ETag, `"v1"`)
+	}
+
+	d = NewDownloadWorker(ts.URL+"/etag", &defaultPolicy, pub, WithConditional(d.validators))
+	_, _, err = d.Run(context.Background())
+	if !errors.Is(err, ErrNotModified) {
+		t.Fatalf("expected ErrNotModified, got: %v", err)
+	}
+}
+
+func TestDownloadController_Mirror(t *testing.T) {
+	ts := setupServer(t)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	tasks, _, err := NewTasks(ts.URL+"/etag", ts.URL+"/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() *eventRecorder {
+		rec := &eventRecorder{}
+		pub := pubsub.NewPublisher[Event]()
+		pub.Register(rec)
+		dc := NewDownloadController(tasks.Source(), &defaultPolicy, pub, saver, 2, WithValidatorStore(saver))
+		dc.Run(context.Background())
+		return rec
+	}
+
+	if got := run().count(EventTypeEnd); got != 2 {
+		t.Errorf("first run: %d EventEnd, want 2", got)
+	}
+	// バリデータを返さない/successは毎回取得し直す
+	rec := run()
+	if got := rec.count(EventTypeUnchanged); got != 1 {
+		t.Errorf("second run: %d EventUnchanged, want 1", got)
+	}
+	if got := rec.count(EventTypeEnd); got != 1 {
+		t.Errorf("second run: %d EventEnd, want 1", got)
+	}
+}
+
+func TestDownloadController_Drain(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+	defer ts.Close()
+
+	var tasks []Task
+	for i := range 10 {
+		tasks = append(tasks, *NewTask(fmt.Sprintf("%s/%d", ts.URL, i)))
+	}
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	drain, stopDrain := context.WithCancel(context.Background())
+	dc := NewDownloadController(NewSliceSource(tasks...), &defaultPolicy, pub, saver, 2, WithDrain(drain))
+
+	errc := make(chan error)
+	go func() { errc <- dc.Run(context.Background()) }()
+
+	// 2つのダウンロードが始まってから止める
+	<-started
+	<-started
+	stopDrain()
+	for rec.count(EventTypeDrain) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.count(EventTypeEnd); got != 2 {
+		t.Errorf("%d downloads completed, want the 2 in progress", got)
+	}
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) count(typ EventType) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, e := range r.events {
+		if e.Type() == typ {
+			n++
+		}
+	}
+	return n
+}
+
 func TestMain(m *testing.M) {
 	goleak.VerifyTestMain(m)
 
@@ -99,6 +218,13 @@ func newTestServer() *httptest.Server {
 			switch r.URL.Path {
 			case "/success":
 				fmt.Fprint(w, "success")
+			case "/etag":
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				fmt.Fprint(w, "etag")
 			case "/fail":
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprint(w, "error")
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const defaultSlowMirrorWindow = 10 * time.Second
+
+// resumableBody continues the body from another mirror with a Range
+// request when the connection breaks, stalls or becomes too slow. It also
+// waits while the download is paused.
+type resumableBody struct {
+	ctx    context.Context
+	d      *DownloadWorker
+	body   io.ReadCloser
+	offset int64
+
+	// mirrorSpeed はミラーの切り替え、minSpeed はリトライの判定に使う
+	mirrorSpeed speedMeter
+	minSpeed    speedMeter
+}
+
+func newResumableBody(ctx context.Context, d *DownloadWorker, body io.ReadCloser) *resumableBody {
+	b := &resumableBody{
+		ctx:         ctx,
+		d:           d,
+		body:        body,
+		mirrorSpeed: newSpeedMeter(d.slowSpeed, d.slowWindow),
+		minSpeed:    newSpeedMeter(d.minSpeed, d.minSpeedWindow),
+	}
+	if len(d.mirrors) < 2 {
+		b.mirrorSpeed.limit = 0
+	}
+	return b
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	if err := b.waitResume(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	n, err := b.body.Read(p)
+	d := time.Since(start)
+	b.offset += int64(n)
+
+	if err != nil && err != io.EOF {
+		return n, b.retry(err)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if speed, slow := b.minSpeed.add(n, d); slow {
+		return n, b.retry(&SlowTransferError{Speed: speed, MinSpeed: b.minSpeed.limit, Window: b.minSpeed.window})
+	}
+	if _, slow := b.mirrorSpeed.add(n, d); slow {
+		b.d.errs = append(b.d.errs, fmt.Errorf("%s: slower than %d bytes/s", b.d.currentMirror(), b.d.slowSpeed))
+		return n, b.reopen()
+	}
+	return n, nil
+}
+
+// retry records err as a failed attempt and continues from the next mirror.
+func (b *resumableBody) retry(err error) error {
+	err = b.d.mirrorError(b.d.currentMirror(), err)
+	b.d.errs = append(b.d.errs, err)
+	b.d.publishRetry(b.ctx, err)
+	return b.reopen()
+}
+
+func (b *resumableBody) reopen() error {
+	b.body.Close()
+
+	resp, err := b.d.open(b.ctx, b.offset)
+	if err != nil {
+		return err
+	}
+	b.body = resp.Body
+	b.mirrorSpeed.reset()
+	b.minSpeed.reset()
+	return nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// rangeStartsAt reports whether resp is a partial response starting at offset.
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	var start int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+	return err == nil && start == offset
+}
+
+// metalink is the subset of a Metalink v4 document (RFC 5854) we use.
+type metalink struct {
+	Files []struct {
+		Name   string         `xml:"name,attr"`
+		URLs   []metalinkURL  `xml:"url"`
+		Hashes []metalinkHash `xml:"hash"`
+	} `xml:"file"`
+}
+
+type metalinkURL struct {
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+type metalinkHash struct {
+	Type string `xml:"type,attr"`
+	Sum  string `xml:",chardata"`
+}
+
+// metalinkFile は Metalink の1ファイル分のタスクと、そのハッシュ
+type metalinkFile struct {
+	name   string
+	task   Task
+	hashes []metalinkHash
+}
+
+// NewMetalinkSource reads a Metalink v4 document. Each file becomes a task
+// whose mirrors are ordered by their priority attribute.
+func NewMetalinkSource(r io.Reader) (TaskSource, error) {
+	files, err := readMetalink(r)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]Task, len(files))
+	for i, f := range files {
+		tasks[i] = f.task
+	}
+	return NewSliceSource(tasks...), nil
+}
+
+func readMetalink(r io.Reader) ([]metalinkFile, error) {
+	var doc metalink
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("metalink: %w", err)
+	}
+
+	var files []metalinkFile
+	for _, file := range doc.Files {
+		urls := file.URLs
+		// priorityは1が最も優先度が高く、省略されたものは最後に回す
+		slices.SortStableFunc(urls, func(a, b metalinkURL) int {
+			return metalinkPriority(a.Priority) - metalinkPriority(b.Priority)
+		})
+
+		var mirrors []string
+		for _, u := range urls {
+			// 対応していないスキームのURLは読み飛ばす
+			if u, err := NormalizeURL(u.URL); err == nil {
+				mirrors = append(mirrors, u)
+			}
+		}
+		if len(mirrors) == 0 {
+			return nil, fmt.Errorf("metalink: file %q has no supported URL", file.Name)
+		}
+
+		task := *NewTask(mirrors[0])
+		task.mirrors = mirrors[1:]
+		files = append(files, metalinkFile{name: file.Name, task: task, hashes: file.Hashes})
+	}
+	return files, nil
+}
+
+func metalinkPriority(p int) int {
+	if p <= 0 {
+		return 1 << 20
+	}
+	return p
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+var mirrorContent = strings.Repeat("0123456789", 1000)
+
+// newMirrorServer returns a server with three mirrors of mirrorContent:
+// /dead always fails, /broken cuts the body in half and /good supports Range.
+func newMirrorServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dead":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/broken":
+			w.Header().Set("Content-Length", strconv.Itoa(len(mirrorContent)))
+			io.WriteString(w, mirrorContent[:len(mirrorContent)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case "/good":
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(mirrorContent))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestDownloadWorker_Mirrors(t *testing.T) {
+	ts := newMirrorServer(t)
+
+	tests := map[string][]string{
+		"dead primary":       {"/dead", "/good"},
+		"not found primary":  {"/missing", "/good"},
+		"resume from mirror": {"/broken", "/good"},
+	}
+	for name, paths := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub := pubsub.NewPublisher[Event]()
+			d := NewDownloadWorker(ts.URL+paths[0], &defaultPolicy, pub, WithMirrors(ts.URL+paths[1]))
+			body, _, err := d.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, body); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != mirrorContent {
+				t.Errorf("body mismatch: got %d bytes, want %d", buf.Len(), len(mirrorContent))
+			}
+		})
+	}
+}
+
+func TestNewMetalinkSource(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.iso">
+    <url>https://fallback.example/a.iso</url>
+    <url priority="2">https://second.example/a.iso</url>
+    <url priority="1">https://first.example/a.iso</url>
+    <url priority="1">ftp://first.example/a.iso</url>
+  </file>
+</metalink>`
+
+	src, err := NewMetalinkSource(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, ok, err := src.Next(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("Next() = %v, %v", ok, err)
+	}
+
+	got := append([]string{task.url}, task.mirrors...)
+	want := []string{"https://first.example/a.iso", "https://second.example/a.iso", "https://fallback.example/a.iso"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mirrors mismatch: (-want, +got)\n%s", diff)
+	}
+}
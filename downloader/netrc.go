@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Netrc holds the credentials of a .netrc file by host.
+type Netrc map[string]NetrcEntry
+
+type NetrcEntry struct {
+	Login    string
+	Password string
+}
+
+// ParseNetrc reads the machine entries of a .netrc file. The default entry
+// is ignored, since it would send the credentials to any host.
+func ParseNetrc(r io.Reader) (Netrc, error) {
+	n := make(Netrc)
+	var machine string
+	var entry NetrcEntry
+	flush := func() {
+		// 同じホストが複数あれば最初のものを使う
+		if _, ok := n[machine]; machine != "" && !ok {
+			n[machine] = entry
+		}
+		machine, entry = "", NetrcEntry{}
+	}
+
+	sc := bufio.NewScanner(r)
+	inMacro := false
+	for sc.Scan() {
+		line := sc.Text()
+		// macdef の本体は空行まで続く
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			tok := tokens[i]
+			if strings.HasPrefix(tok, "#") {
+				break
+			}
+
+			// 値をとるキーワードは次のトークンを読む
+			var value string
+			switch tok {
+			case "machine", "login", "password", "account", "macdef":
+				i++
+				if i == len(tokens) {
+					return nil, fmt.Errorf("netrc: %s: missing value", tok)
+				}
+				value = tokens[i]
+			}
+
+			switch tok {
+			case "machine":
+				flush()
+				machine = strings.ToLower(value)
+			case "default":
+				flush()
+			case "login":
+				entry.Login = value
+			case "password":
+				entry.Password = value
+			case "account":
+			case "macdef":
+				inMacro = true
+			default:
+				return nil, fmt.Errorf("netrc: unknown token %q", tok)
+			}
+			if inMacro {
+				break
+			}
+		}
+	}
+	flush()
+	return n, sc.Err()
+}
+
+// LoadNetrc reads the .netrc file at path. If path is empty, $NETRC or
+// ~/.netrc is read when it exists.
+func LoadNetrc(path string, getenv func(string) string) (Netrc, error) {
+	explicit := path != ""
+	if !explicit {
+		path = getenv("NETRC")
+	}
+	if path == "" {
+		home := getenv("HOME")
+		if home == "" {
+			return Netrc{}, nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return Netrc{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n, err := ParseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
+
+// netrcTransport adds Basic authentication from .netrc to requests that do
+// not have their own credentials. Credentials are looked up for every
+// request, so they are not sent to another host after a redirect.
+type netrcTransport struct {
+	base  http.RoundTripper
+	netrc Netrc
+}
+
+// WithNetrc makes client authenticate with the credentials in n.
+func WithNetrc(client *http.Client, n Netrc) {
+	if len(n) == 0 {
+		return
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &netrcTransport{base: base, netrc: n}
+}
+
+func (t *netrcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	entry, ok := t.netrc[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTripperはリクエストを変更してはいけないので複製する
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(entry.Login, entry.Password)
+	return t.base.RoundTrip(req)
+}
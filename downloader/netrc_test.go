@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseNetrc(t *testing.T) {
+	const netrc = `# comment
+machine example.com login alice password s3cret
+machine Files.Example.com
+	login bob
+	password "pw"
+	account ignored
+
+macdef init
+cd /pub
+machine evil.com login x password y
+
+machine example.com login dup password dup
+default login anonymous password guest
+`
+	got, err := ParseNetrc(strings.NewReader(netrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Netrc{
+		"example.com":       {Login: "alice", Password: "s3cret"},
+		"files.example.com": {Login: "bob", Password: `"pw"`},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseNetrc mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := ParseNetrc(strings.NewReader("machine example.com login")); err == nil {
+		t.Error("missing value: expected error, got nil")
+	}
+}
+
+func TestNetrcTransport(t *testing.T) {
+	var other *httptest.Server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL, http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+	// 127.0.0.1 と localhost を別のホストとして扱う
+	other = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	other.URL = strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	client := &http.Client{}
+	WithNetrc(client, Netrc{"127.0.0.1": {Login: "alice", Password: "s3cret"}})
+
+	tests := map[string]struct {
+		url, auth, want string
+	}{
+		"matching host":        {ts.URL + "/", "", "Basic YWxpY2U6czNjcmV0"},
+		"explicit credentials": {ts.URL + "/", "Bearer token", "Bearer token"},
+		"redirect to another":  {ts.URL + "/redirect", "", ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
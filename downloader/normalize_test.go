@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := map[string]string{
+		"http://Example.COM/a":              "http://example.com/a",
+		"HTTP://example.com:80/a":           "http://example.com/a",
+		"https://example.com:443/a":         "https://example.com/a",
+		"https://example.com:8443/a":        "https://example.com:8443/a",
+		"http://example.com/a#frag":         "http://example.com/a",
+		"http://example.com":                "http://example.com/",
+		"http://example.com/%7euser/%2f%3a": "http://example.com/~user/%2F%3A",
+		"http://example.com/a/./b/../c":     "http://example.com/a/c",
+		"http://example.com/../a":           "http://example.com/a",
+		"http://example.com/a?q=%7e&r=%2f":  "http://example.com/a?q=~&r=%2F",
+		"http://[::1]:80/a":                 "http://[::1]/a",
+		"http://[::1]:8080/a":               "http://[::1]:8080/a",
+		"http://user@Example.com/a":         "http://user@example.com/a",
+		"file://localhost/tmp/./a%7e":       "file:///tmp/a~",
+		"s3://bucket/dir/../key#x":          "s3://bucket/key",
+		"data:text/plain,hello#x":           "data:text/plain,hello",
+	}
+	for in, want := range tests {
+		got, err := NormalizeURL(in)
+		if err != nil {
+			t.Errorf("NormalizeURL(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("NormalizeURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizeURL_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"example.com/a":        "missing scheme",
+		"ftp://example.com/a":  "unsupported scheme",
+		"s3:///key":            "missing host",
+		"http:///a":            "missing host",
+		"http://example.com:x": "invalid port",
+		"http://a b.com/":      "invalid character",
+	}
+	for in, want := range tests {
+		_, err := NormalizeURL(in)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("NormalizeURL(%q) error = %v, want %q", in, err, want)
+		}
+	}
+}
+
+func TestNewTasks(t *testing.T) {
+	tasks, dups, err := NewTasks("http://Host/a", "http://host:80/a", "http://host/a#frag", "http://host/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Errorf("tasks = %v, want 2 tasks", tasks)
+	}
+	if len(dups) != 2 || dups[0].URL != "http://host:80/a" || dups[0].Of != "http://Host/a" {
+		t.Errorf("duplicates = %+v", dups)
+	}
+
+	_, _, err = NewTasks("http://host/a", "host/b", "gopher://host/c")
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	for _, want := range []string{`"host/b": missing scheme`, `"gopher://host/c": unsupported scheme`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
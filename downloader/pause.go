@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pauseDropDelay is how long a paused download keeps its connection. After
+// that the connection is closed, so that the server does not time it out,
+// and the body is requested again from the same offset on resume.
+// テストで短くするため変数にしている
+var pauseDropDelay = 10 * time.Second
+
+// pauseGate blocks the reads of the downloads it is attached to while paused.
+type pauseGate struct {
+	mu sync.Mutex
+	// resumed は一時停止中だけ存在し、再開で閉じられる
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{}
+}
+
+// pause reports whether the gate was not already paused.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume reports whether the gate was paused.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return true
+}
+
+// paused は一時停止中なら再開で閉じられるチャネルを、そうでなければnilを返す
+func (g *pauseGate) paused() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed
+}
+
+// withPauses makes the reads of the body wait while any of gates is paused.
+func withPauses(gates ...*pauseGate) WorkerOption {
+	return func(d *DownloadWorker) {
+		d.pauses = append(d.pauses, gates...)
+	}
+}
+
+func (d *DownloadWorker) pausedUntil() <-chan struct{} {
+	for _, g := range d.pauses {
+		if c := g.paused(); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// acceptsRanges reports whether the body of resp can be continued with a
+// Range request.
+func acceptsRanges(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// waitResume blocks while the download is paused. A pause longer than
+// pauseDropDelay closes the connection if the server accepts ranges.
+func (b *resumableBody) waitResume() error {
+	resumed := b.d.pausedUntil()
+	if resumed == nil {
+		return nil
+	}
+
+	var drop <-chan time.Time
+	if b.d.acceptsRanges {
+		t := time.NewTimer(pauseDropDelay)
+		defer t.Stop()
+		drop = t.C
+	}
+	dropped := false
+	// 全体と個別の一時停止がどちらも解除されるまで待つ
+	for ; resumed != nil; resumed = b.d.pausedUntil() {
+		select {
+		case <-resumed:
+		case <-drop:
+			b.body.Close()
+			dropped, drop = true, nil
+		case <-b.ctx.Done():
+			return causeOf(b.ctx, b.ctx.Err())
+		}
+	}
+	if !dropped {
+		return nil
+	}
+	return b.resume()
+}
+
+// resume は一時停止で切断したボディの続きを同じミラーに要求する。
+// 一時停止は失敗ではないので、要求に失敗したときだけリトライとして数える。
+func (b *resumableBody) resume() error {
+	resp, err := b.d.request(b.ctx, b.d.currentMirror(), b.offset, 0)
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return causeOf(b.ctx, err)
+		}
+		return b.retry(err)
+	}
+	b.body = resp.Body
+	b.mirrorSpeed.reset()
+	b.minSpeed.reset()
+	return nil
+}
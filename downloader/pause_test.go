@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestResumableBody_Pause(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100_000)
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	defer func(d time.Duration) { pauseDropDelay = d }(pauseDropDelay)
+	pauseDropDelay = 10 * time.Millisecond
+
+	gate := newPauseGate()
+	d := NewDownloadWorker(ts.URL, &defaultPolicy, pubsub.NewPublisher[Event](), withPauses(gate))
+	body, _, err := d.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	head := make([]byte, 1000)
+	if _, err := io.ReadFull(body, head); err != nil {
+		t.Fatal(err)
+	}
+	gate.pause()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		b, err := io.ReadAll(body)
+		done <- result{b, err}
+	}()
+
+	select {
+	case res := <-done:
+		t.Fatalf("read while paused: %d bytes, %v", len(res.b), res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	gate.resume()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !bytes.Equal(append(head, res.b...), content) {
+		t.Error("body mismatch after resume")
+	}
+	// 一時停止中に切断し、続きから要求し直す
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{"", "bytes=1000-"}, ranges); diff != "" {
+		t.Errorf("Range headers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDownloadController_PauseAll(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	source := NewSliceSource(*NewTask(ts.URL + "/a"), *NewTask(ts.URL + "/b"))
+	dc := NewDownloadController(source, &defaultPolicy, pub, NewFileSaver(t.TempDir(), NewOSFS()), 2)
+
+	if !dc.PauseAll() {
+		t.Fatal("PauseAll() = false, want true")
+	}
+	if dc.PauseAll() {
+		t.Error("PauseAll() = true while paused")
+	}
+	if dc.Pause(ts.URL + "/a") {
+		t.Error("Pause(/a) = true for a download that is not running")
+	}
+
+	errc := make(chan error)
+	go func() { errc <- dc.Run(context.Background()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(requests) != 0 {
+		t.Errorf("started %v while paused", requests)
+	}
+	mu.Unlock()
+
+	if !dc.ResumeAll() {
+		t.Error("ResumeAll() = false, want true")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.count(EventTypeEnd); got != 2 {
+		t.Errorf("%d downloads ended, want 2", got)
+	}
+	if rec.count(EventTypePause) != 1 || rec.count(EventTypeResume) != 1 {
+		t.Errorf("events = %v, want one pause and one resume", rec.events)
+	}
+}
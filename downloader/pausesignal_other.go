@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// SIGUSR1 と SIGUSR2 がないため、シグナルでは一時停止できない
+func handlePauseSignals(dc *DownloadController) (stop func()) {
+	return func() {}
+}
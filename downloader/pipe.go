@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandWaitDelay は起動したコマンドが終了した後、その出力を開いたままの
+// 子プロセスを待つ時間。プロセスグループから抜けたものがいても Wait を返す
+const commandWaitDelay = time.Second
+
+// StdoutSaver writes the body to w, which is stdout for "-O -".
+type StdoutSaver struct {
+	w io.Writer
+}
+
+func NewStdoutSaver(w io.Writer) *StdoutSaver {
+	return &StdoutSaver{w: w}
+}
+
+func (s *StdoutSaver) Save(r io.Reader, url string) (int64, error) {
+	return io.Copy(s.w, r)
+}
+
+// PipeExitError means that the command given to --pipe failed.
+type PipeExitError struct {
+	Command  string
+	ExitCode int
+}
+
+func (e *PipeExitError) Error() string {
+	return fmt.Sprintf("pipe command %q exited with status %d", e.Command, e.ExitCode)
+}
+
+// PipeSaver starts a command for every download and streams the body into
+// its stdin. The command runs without a shell; {url} in its arguments is
+// replaced. Its output goes to stdout and stderr.
+//
+// Writing blocks while the command does not read, which in turn stops
+// reading the body, so a slow command slows down the download.
+type PipeSaver struct {
+	command string
+	args    []string
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func NewPipeSaver(command string, stdout, stderr io.Writer) (*PipeSaver, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("pipe: empty command")
+	}
+	return &PipeSaver{command: command, args: args, stdout: stdout, stderr: stderr}, nil
+}
+
+func (s *PipeSaver) Save(r io.Reader, url string) (int64, error) {
+	args := make([]string, len(s.args))
+	for i, arg := range s.args {
+		args[i] = strings.ReplaceAll(arg, "{url}", url)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("pipe: %w", err)
+	}
+
+	body := &readErrRecorder{r: r}
+	n, copyErr := io.Copy(stdin, body)
+	if body.err != nil {
+		// 途中までのデータを完全なものとして処理させないよう、EOFを送る前に
+		// シェルが起動した子プロセスごと終了させる
+		killProcessGroup(cmd)
+		stdin.Close()
+		cmd.Wait()
+		return n, body.err
+	}
+	stdin.Close()
+	waitErr := cmd.Wait()
+
+	// 子プロセスが先に終了した場合の書き込みエラーより、終了ステータスを優先して報告する
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		return n, &PipeExitError{Command: s.command, ExitCode: exitErr.ExitCode()}
+	}
+	if copyErr != nil {
+		return n, copyErr
+	}
+	return n, waitErr
+}
+
+// readErrRecorder は io.Copy のエラーが読み込み側のものかを区別するために使う
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func newTestPipeSaver(t *testing.T, command string) (*PipeSaver, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	s, err := NewPipeSaver(command, &out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &out
+}
+
+func TestPipeSaver(t *testing.T) {
+	s, out := newTestPipeSaver(t, "sh -c 'echo {url}; cat'")
+
+	n, err := s.Save(strings.NewReader(mirrorContent), "https://example.com/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(mirrorContent)) {
+		t.Errorf("n = %d, want %d", n, len(mirrorContent))
+	}
+	if want := "https://example.com/file\n" + mirrorContent; out.String() != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestPipeSaver_ExitStatus(t *testing.T) {
+	// 入力を読まずに終了しても、書き込みエラーではなく終了ステータスを報告する
+	s, _ := newTestPipeSaver(t, "sh -c 'exit 3'")
+
+	_, err := s.Save(strings.NewReader(strings.Repeat(mirrorContent, 10000)), "https://example.com/file")
+	var exitErr *PipeExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 3 {
+		t.Errorf("err = %v, want exit status 3", err)
+	}
+}
+
+func TestPipeSaver_ReadError(t *testing.T) {
+	// 途中で失敗したボディは、EOFを送らずにコマンドを終了させる
+	// シェルが起動した子プロセスにも EOF を送らない
+	for name, command := range map[string]string{
+		"command": "sh -c 'cat >/dev/null && echo done'",
+		"child":   `sh -c 'sh -c "cat >/dev/null && echo done"; echo parent'`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, out := newTestPipeSaver(t, command)
+
+			// 子プロセスが起動してから失敗させる
+			broken := io.MultiReader(strings.NewReader("partial"), slowReader{iotest.ErrReader(errors.New("connection reset")), 100 * time.Millisecond})
+			start := time.Now()
+			if _, err := s.Save(broken, "https://example.com/file"); err == nil || err.Error() != "connection reset" {
+				t.Errorf("err = %v, want connection reset", err)
+			}
+			if elapsed := time.Since(start); elapsed > commandWaitDelay {
+				t.Errorf("Save took %s to stop the command", elapsed)
+			}
+			if out.Len() != 0 {
+				t.Errorf("command finished normally: %q", out)
+			}
+		})
+	}
+}
+
+// slowReader は読み込みの前に待つ
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestStdoutSaver(t *testing.T) {
+	var out bytes.Buffer
+	n, err := NewStdoutSaver(&out).Save(strings.NewReader(mirrorContent), "https://example.com/file")
+	if err != nil || n != int64(len(mirrorContent)) || out.String() != mirrorContent {
+		t.Errorf("Save = %d, %v, %q; want %d, nil, %q", n, err, out, len(mirrorContent), mirrorContent)
+	}
+}
@@ -3,44 +3,102 @@ package main
 import (
 	"fmt"
 	"io"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"text/template"
 )
 
 type res map[string]error
 
 type Printer struct {
-	w       io.Writer
-	Out     string
-	Success int
-	Abort   int
-	URLS    res
-	tmpl    *template.Template
+	// mu は複数のワーカーから届くイベントの集計を守る
+	mu        sync.Mutex
+	w         io.Writer
+	Out       string
+	Success   int
+	Unchanged int
+	// Changed は監視中に内容が変わったファイルの数
+	Changed   int
+	Abort     int
+	URLS      res
+	HookOK    int
+	HookFails []EventHook
+	Drained   bool
+	// Pauses は一時停止した回数、paused はまだ一時停止しているURL(全体なら空文字)
+	Pauses int
+	paused map[string]bool
+	// DiskFull はディスクがいっぱいで保存できなかったURL
+	DiskFull    []string
+	DiskFullErr error
+	tmpl        *template.Template
 }
 
 // HandleEvent implements pubsub.Subscriber.
 func (p *Printer) HandleEvent(event Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	switch e := event.(type) {
 	case EventStart:
+	case EventQueued:
 	case EventProgress:
 	case EventEnd:
 		p.Success++
+		// Retry で成功したものは中断として数えない
+		if _, ok := p.URLS[e.URL]; ok {
+			delete(p.URLS, e.URL)
+			p.Abort--
+		}
 	case EventRetry:
 	case EventAbort:
+		if _, ok := p.URLS[e.URL]; !ok {
+			p.Abort++
+		}
 		p.URLS[e.URL] = e.Err
-		p.Abort++
+	case EventUnchanged:
+		p.Unchanged++
+	case EventChanged:
+		p.Changed++
+	case EventHook:
+		if e.Err != nil {
+			p.HookFails = append(p.HookFails, e)
+		} else {
+			p.HookOK++
+		}
+	case EventDrain:
+		p.Drained = true
+	case EventPause:
+		p.Pauses++
+		p.paused[e.URL] = true
+	case EventResume:
+		delete(p.paused, e.URL)
+	case EventDiskFull:
+		p.DiskFull = append(p.DiskFull, e.URL)
+		if p.DiskFullErr == nil {
+			p.DiskFullErr = e.Err
+		}
 	default:
 		panic(fmt.Sprintf("unexpected main.Event: %#v", event))
 	}
 }
 
 const format = `Stored {{.Success}} files to {{.Out}}.
-{{ if .Abort }}Aborted {{ .Abort }} urls:
-Error: {{ range $key, $err := .URLS }} 
-	- {{$key}}: {{ PrettyError $err }}
-{{ end }}{{- end}}`
+{{ if .Changed }}Detected changes in {{ .Changed }} files.
+{{ end }}{{ if .Unchanged }}Skipped {{ .Unchanged }} unchanged files.
+{{ end }}{{ if .Pauses }}Paused {{ .Pauses }} time{{ if gt .Pauses 1 }}s{{ end }}{{ if .StillPaused }}; interrupted while paused{{ end }}.
+{{ end }}{{ if .Drained }}Stopped early: downloads not yet started were skipped.
+{{ end }}{{ if .DiskFull }}Stopped: {{ .DiskFullErr }}
+No new downloads were started; {{ len .DiskFull }} in progress could not be saved:
+{{ range .DiskFull }}	- {{ . }}
+{{ end }}{{ end }}{{ if .Abort }}Aborted {{ .Abort }} urls:
+Error:
+{{ range $key, $err := .URLS }}	- {{$key}}: {{ PrettyError $err }}
+{{ end }}{{- end}}
+{{- if or .HookOK .HookFails }}Hooks: {{ .HookOK }} succeeded, {{ len .HookFails }} failed.
+{{ range .HookFails }}	- {{ .Kind }} {{ .URL }}: {{ .Err }}
+{{ if .Output }}{{ .Output }}
+{{ end }}{{ end }}{{- end}}`
 
 func NewPrinter(w io.Writer, outDir string) *Printer {
 	outDir, _ = filepath.Abs(outDir)
@@ -55,6 +113,7 @@ func NewPrinter(w io.Writer, outDir string) *Printer {
 		w:       w,
 		Out:     outDir,
 		URLS:    make(res),
+		paused:  make(map[string]bool),
 		Success: 0,
 		Abort:   0,
 		tmpl:    tmpl,
@@ -68,20 +127,38 @@ func NewPrinter(w io.Writer, outDir string) *Printer {
 //   - url1: $error1
 //   - url2: $error2
 func (r *Printer) Print() {
-	r.tmpl.Execute(os.Stdout, r)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tmpl.Execute(r.w, r)
 }
 
-func prettyError(e error) string {
-	str := e.Error()
-	deduped := make(map[string]bool)
+// StillPaused reports whether the run ended while something was paused.
+func (r *Printer) StillPaused() bool {
+	return len(r.paused) > 0
+}
 
-	for _, line := range strings.Split(str, "\n") {
-		deduped[line] = true
+// prettyError は複数行のエラーを順序を保って字下げする。
+// 試行ごとのエラーのように同じ行が続く場合は、回数を添えて1行にまとめる。
+func prettyError(e error) string {
+	var lines []string
+	var last string
+	n := 0
+	flush := func() {
+		if n > 1 {
+			last += fmt.Sprintf(" (%d times)", n)
+		}
+		if n > 0 {
+			lines = append(lines, last)
+		}
 	}
-
-	ret := ""
-	for key := range deduped {
-		ret += key
+	for _, line := range strings.Split(e.Error(), "\n") {
+		if n > 0 && line == last {
+			n++
+			continue
+		}
+		flush()
+		last, n = line, 1
 	}
-	return ret
+	flush()
+	return strings.Join(lines, "\n\t\t")
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
@@ -11,22 +13,37 @@ import (
 
 type bars map[string]*mpb.Bar
 
+// labels はバーの状態表示を上書きする。描画は別goroutineで行われるためatomicに保持する
+type labels map[string]*atomic.Pointer[string]
+
 type MultiProgressBar struct {
-	p    *mpb.Progress
-	bars bars
+	p *mpb.Progress
+	w io.Writer
+	// mu は bars、labels、pausedBars を守る。イベントは複数のワーカーから同時に届く
+	mu     sync.Mutex
+	bars   bars
+	labels labels
+	// pausedBars は個別に一時停止したバー、paused は全体の一時停止
+	pausedBars map[string]*atomic.Bool
+	paused     atomic.Bool
+	// draining は実行中のバーの状態表示を "draining" にする
+	draining atomic.Bool
 }
 
-func NewMultiProgressBar(ctx context.Context) *MultiProgressBar {
-	p := mpb.NewWithContext(ctx, mpb.WithWidth(64))
+func NewMultiProgressBar(ctx context.Context, w io.Writer) *MultiProgressBar {
+	p := mpb.NewWithContext(ctx, mpb.WithWidth(64), mpb.WithOutput(w))
 	bars := make(bars)
 
 	return &MultiProgressBar{
-		p:    p,
-		bars: bars,
+		p:          p,
+		w:          w,
+		bars:       bars,
+		labels:     make(labels),
+		pausedBars: make(map[string]*atomic.Bool),
 	}
 }
 
-func (p *MultiProgressBar) CreateBar(title string) *mpb.Bar {
+func (p *MultiProgressBar) CreateBar(title string, label *atomic.Pointer[string], paused *atomic.Bool) *mpb.Bar {
 	// TODO: if content-size is unknown, let bar will be spinner.
 	return p.p.New(
 		int64(0),
@@ -34,13 +51,7 @@ func (p *MultiProgressBar) CreateBar(title string) *mpb.Bar {
 		clearBarFillerOnFinish(),
 		mpb.PrependDecorators(
 			decor.Name(title, decor.WC{C: decor.DSyncWidthR | decor.DextraSpace}),
-			decor.OnAbort(
-				decor.OnComplete(
-					decor.Name("downloading", decor.WC{C: decor.DindentRight | decor.DextraSpace}),
-					"completed",
-				),
-				"aborted",
-			),
+			statusDecorator(label, paused, &p.paused, &p.draining, decor.WC{C: decor.DindentRight | decor.DextraSpace}),
 			decor.OnAbort(
 				decor.OnComplete(
 					decor.Percentage(), "",
@@ -51,6 +62,26 @@ func (p *MultiProgressBar) CreateBar(title string) *mpb.Bar {
 	)
 }
 
+func statusDecorator(label *atomic.Pointer[string], paused, allPaused, draining *atomic.Bool, wc decor.WC) decor.Decorator {
+	return decor.Any(func(st decor.Statistics) string {
+		if l := label.Load(); l != nil {
+			return *l
+		}
+		switch {
+		case st.Aborted:
+			return "aborted"
+		case st.Completed:
+			return "completed"
+		case paused.Load() || allPaused.Load():
+			return "paused"
+		case draining.Load():
+			return "draining"
+		default:
+			return "downloading"
+		}
+	}, wc)
+}
+
 func clearBarFillerOnFinish() mpb.BarOption {
 	return barFilterOnFinish("")
 }
@@ -69,10 +100,16 @@ func barFilterOnFinish(message string) mpb.BarOption {
 }
 
 func (p *MultiProgressBar) HandleEvent(event Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	switch e := event.(type) {
 	case EventStart:
-		bar := p.CreateBar(e.URL)
+		label := new(atomic.Pointer[string])
+		paused := p.pausedBar(e.URL)
+		bar := p.CreateBar(e.URL, label, paused)
 		p.bars[e.URL] = bar
+		p.labels[e.URL] = label
 	case EventProgress:
 		b := p.findBar(e.URL)
 		if e.Total > 0 {
@@ -86,13 +123,41 @@ func (p *MultiProgressBar) HandleEvent(event Event) {
 		b := p.findBar(e.URL)
 		b.EnableTriggerComplete()
 	case EventAbort:
+		// キューから取り消されたタスクにはバーがない
+		if b, ok := p.bars[e.URL]; ok {
+			b.Abort(false)
+		}
+	case EventDiskFull:
+		p.setLabel(e.URL, "disk full")
 		b := p.findBar(e.URL)
 		b.Abort(false)
+	case EventHook:
+	case EventQueued:
+	case EventChanged:
+	case EventDrain:
+		p.draining.Store(true)
+	case EventPause:
+		if e.URL == "" {
+			p.paused.Store(true)
+		} else {
+			p.pausedBar(e.URL).Store(true)
+		}
+	case EventResume:
+		if e.URL == "" {
+			p.paused.Store(false)
+		} else {
+			p.pausedBar(e.URL).Store(false)
+		}
+	case EventUnchanged:
+		p.setLabel(e.URL, "unchanged")
+		b := p.findBar(e.URL)
+		b.SetTotal(-1, true)
 	default:
 		panic(fmt.Sprintf("unexpected main.Event: %#v", e))
 	}
 }
 
+// findBar、pausedBar、setLabel は mu を保持して呼ぶ
 func (p *MultiProgressBar) findBar(url string) *mpb.Bar {
 	bar, ok := p.bars[url]
 	if !ok {
@@ -101,15 +166,35 @@ func (p *MultiProgressBar) findBar(url string) *mpb.Bar {
 	return bar
 }
 
+// pausedBar はURLの一時停止の状態を返す。EventStart より先に一時停止されることがあるため、バーがなくても作る
+func (p *MultiProgressBar) pausedBar(url string) *atomic.Bool {
+	b, ok := p.pausedBars[url]
+	if !ok {
+		b = new(atomic.Bool)
+		p.pausedBars[url] = b
+	}
+	return b
+}
+
+func (p *MultiProgressBar) setLabel(url, label string) {
+	l, ok := p.labels[url]
+	if !ok {
+		panic("bar not found")
+	}
+	l.Store(&label)
+}
+
 func (p *MultiProgressBar) Flush() {
 	p.p.Wait()
 	p.clear()
 }
 
 func (p *MultiProgressBar) clear() {
+	p.mu.Lock()
 	linesToDelete := len(p.bars)
+	p.mu.Unlock()
 
 	for range linesToDelete {
-		fmt.Printf("\033[F\033[K")
+		fmt.Fprint(p.w, "\033[F\033[K")
 	}
 }
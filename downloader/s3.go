@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/no-yan/multierr"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+
+	// GETのボディは空なので、そのSHA-256
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat    = "20060102T150405Z"
+)
+
+// S3Config is the configuration of s3://bucket/key URLs. Credentials are
+// read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// rather than the config file.
+type S3Config struct {
+	// Endpoint は互換サーバーのURL。空ならAWSのエンドポイントを使う
+	Endpoint  string `yaml:"endpoint,omitempty"`
+	Region    string `yaml:"region"`
+	PathStyle bool   `yaml:"path-style"`
+}
+
+func defaultS3Config() S3Config {
+	return S3Config{Region: defaultS3Region}
+}
+
+func (sc S3Config) validate() error {
+	m := multierr.New()
+
+	if sc.Endpoint != "" {
+		u, err := url.Parse(sc.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			m.Add(fmt.Errorf("s3.endpoint: want an http(s) URL, got %q", sc.Endpoint))
+		}
+	}
+	if sc.Region == "" {
+		m.Add(errors.New("s3.region: must not be empty"))
+	}
+
+	return m.Err()
+}
+
+// S3Credentials are the keys used to sign requests. Requests are sent
+// unsigned when AccessKeyID is empty.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func S3CredentialsFromEnv(getenv func(string) string) S3Credentials {
+	return S3Credentials{
+		AccessKeyID:     getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// S3Fetcher gets objects from S3 or an S3-compatible server, signing
+// requests with AWS Signature Version 4.
+type S3Fetcher struct {
+	config S3Config
+	creds  S3Credentials
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3Fetcher(sc S3Config, creds S3Credentials, client *http.Client) *S3Fetcher {
+	return &S3Fetcher{config: sc, creds: creds, client: client, now: time.Now}
+}
+
+func (f *S3Fetcher) Fetch(ctx context.Context, u *url.URL, offset int64) (*Object, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, &invalidURLError{u.String(), errors.New("want s3://bucket/key")}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.objectURL(bucket, key), nil)
+	if err != nil {
+		return nil, &invalidURLError{u.String(), err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	f.sign(req, f.now())
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		code := s3ErrorCode(resp)
+		return nil, fmt.Errorf("%s: %s: %w", u, code, fs.ErrNotExist)
+	case http.StatusForbidden:
+		code := s3ErrorCode(resp)
+		return nil, fmt.Errorf("%s: %s: %w", u, code, fs.ErrPermission)
+	default:
+		code := s3ErrorCode(resp)
+		return nil, fmt.Errorf("%s: s3 error (%d): %s", u, resp.StatusCode, code)
+	}
+
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		size = contentRangeSize(resp.Header.Get("Content-Range"))
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return &Object{
+		Body:        resp.Body,
+		Size:        size,
+		ContentType: resp.Header.Get("Content-Type"),
+		ModTime:     modTime,
+		ETag:        resp.Header.Get("ETag"),
+	}, nil
+}
+
+// objectURL はパス形式 (endpoint/bucket/key) か仮想ホスト形式 (bucket.endpoint/key) のURLを返す
+func (f *S3Fetcher) objectURL(bucket, key string) string {
+	endpoint := f.config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", f.config.Region)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	if f.config.PathStyle {
+		return endpoint + "/" + bucket + "/" + awsEscapePath(key)
+	}
+	scheme, host, _ := strings.Cut(endpoint, "://")
+	return scheme + "://" + bucket + "." + host + "/" + awsEscapePath(key)
+}
+
+// sign adds the SigV4 Authorization header. The host, the x-amz-* headers
+// and Range are signed.
+func (f *S3Fetcher) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if f.creds.AccessKeyID == "" {
+		return
+	}
+
+	amzDate := t.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if f.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", f.creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + f.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+f.creds.SecretAccessKey), date)
+	for _, part := range []string{f.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		f.creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscapePath は非予約文字と"/"以外をすべて%エンコードする
+func awsEscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; isUnreserved(c) || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ErrorCode はエラーレスポンスのXMLからCodeを取り出す
+func s3ErrorCode(resp *http.Response) string {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	_, rest, ok := strings.Cut(string(body), "<Code>")
+	code, _, ok2 := strings.Cut(rest, "</Code>")
+	if !ok || !ok2 {
+		return http.StatusText(resp.StatusCode)
+	}
+	return code
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 )
 
 type FileSaver struct {
@@ -52,18 +55,104 @@ func (fs FileSaver) Save(r io.Reader, url string) (int64, error) {
 		return 0, err
 	}
 
-	fName := fs.createFileName(url)
-	path := filepath.Join(fs.dir, fName)
+	path := fs.Path(url)
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	// 途中で失敗した場合は .part を残し、完了したものだけを保存先に置く。
+	// 前回のファイルを壊すと、バリデータが残ったまま 304 で壊れたファイルが使われ続ける
+	f, err := os.OpenFile(path+partSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
 
-	return io.Copy(f, r)
+	body := &readErrRecorder{r: r}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+partSuffix, path)
+	}
+	if err != nil && body.err == nil {
+		// 中断されたダウンロードと違い、書き込めなかった .part は残さない。
+		// ディスクがいっぱいのときに容量を使い続けないようにする
+		os.Remove(path + partSuffix)
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return n, &DiskFullError{Dir: fs.dir, Err: err}
+	}
+	return n, err
+}
+
+// Path returns the file url is saved to.
+func (fs FileSaver) Path(url string) string {
+	return filepath.Join(fs.dir, fs.createFileName(url))
+}
+
+// Dir implements spaceSaver.
+func (fs FileSaver) Dir() string {
+	return fs.dir
+}
+
+// FreeSpace implements spaceSaver.
+func (fs FileSaver) FreeSpace() (int64, error) {
+	if err := fs.ensureDir(); err != nil {
+		return 0, err
+	}
+	return diskFree(fs.dir)
+}
+
+// validatorsFile は保存先の隣に置くバリデータのファイル
+type validatorsFile struct {
+	URL string `json:"url"`
+	Validators
+}
+
+// LoadValidators implements ValidatorStore.
+func (fs FileSaver) LoadValidators(url string) (Validators, bool) {
+	path := fs.Path(url)
+	// 保存済みのファイルが消えていれば再取得する
+	if _, err := os.Stat(path); err != nil {
+		return Validators{}, false
+	}
+
+	b, err := os.ReadFile(path + validatorsSuffix)
+	if err != nil {
+		return Validators{}, false
+	}
+	var vf validatorsFile
+	if err := json.Unmarshal(b, &vf); err != nil || vf.URL != url {
+		return Validators{}, false
+	}
+	return vf.Validators, !vf.IsZero()
+}
+
+// StoreValidators implements ValidatorStore.
+func (fs FileSaver) StoreValidators(url string, v Validators) error {
+	if err := fs.ensureDir(); err != nil {
+		return err
+	}
+	path := fs.Path(url) + validatorsSuffix
+
+	if v.IsZero() {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(validatorsFile{URL: url, Validators: v})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
 }
 
+const (
+	validatorsSuffix = ".validators.json"
+	partSuffix       = ".part"
+)
+
 func (fs FileSaver) createFileName(url string) string {
 	b := sha256.Sum256([]byte(url))
 	hex := hex.EncodeToString(b[:])
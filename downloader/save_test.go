@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFileSaver_Partial(t *testing.T) {
+	dir := t.TempDir()
+	saver := NewFileSaver(dir, NewOSFS())
+	url := "https://example.com/file"
+	path := filepath.Join(dir, saver.createFileName(url))
+
+	if _, err := saver.Save(strings.NewReader("previous"), url); err != nil {
+		t.Fatal(err)
+	}
+	broken := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := saver.Save(broken, url); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	// 前回のファイルは壊さない
+	if b, err := os.ReadFile(path); err != nil || string(b) != "previous" {
+		t.Errorf("saved file = %q, %v; want %q", b, err, "previous")
+	}
+	if b, err := os.ReadFile(path + partSuffix); err != nil || string(b) != "partial" {
+		t.Errorf("partial file = %q, %v; want %q", b, err, "partial")
+	}
+
+	if _, err := saver.Save(strings.NewReader("complete"), url); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "complete" {
+		t.Errorf("saved file = %q, %v; want %q", b, err, "complete")
+	}
+	if _, err := os.Stat(path + partSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file is left after a complete download")
+	}
+}
+
+func TestFileSaver_WriteError(t *testing.T) {
+	dir := t.TempDir()
+	saver := NewFileSaver(dir, NewOSFS())
+	url := "https://example.com/file"
+	path := saver.Path(url)
+
+	// 保存先が空でないディレクトリなので、最後の置き換えに失敗する
+	if err := os.MkdirAll(filepath.Join(path, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saver.Save(strings.NewReader("content"), url); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	// 書き込みの失敗で残った .part は容量を使い続けるので消す
+	if _, err := os.Stat(path + partSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file is left after a write error: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type SchedulePolicy string
+
+const (
+	ScheduleFIFO          SchedulePolicy = "fifo"
+	SchedulePriority      SchedulePolicy = "priority"
+	ScheduleSmallestFirst SchedulePolicy = "smallest-first"
+	ScheduleLargestFirst  SchedulePolicy = "largest-first"
+
+	defaultScheduleWindow = 1000
+	probeTimeout          = 10 * time.Second
+	probeConcurrency      = 8
+)
+
+func ParseSchedulePolicy(s string) (SchedulePolicy, error) {
+	switch p := SchedulePolicy(s); p {
+	case ScheduleFIFO, SchedulePriority, ScheduleSmallestFirst, ScheduleLargestFirst:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown schedule %q: want fifo, priority, smallest-first or largest-first", s)
+	}
+}
+
+// needsSize reports whether the policy needs the Content-Length of each task.
+func (p SchedulePolicy) needsSize() bool {
+	return p == ScheduleSmallestFirst || p == ScheduleLargestFirst
+}
+
+// less reports whether a should be started before b. Pinned tasks come
+// first whatever the policy. Tasks whose size is unknown are started after
+// the ones with a known size.
+func (p SchedulePolicy) less(a, b Task) bool {
+	if a.pinned != b.pinned {
+		return a.pinned > b.pinned
+	}
+	switch p {
+	case SchedulePriority:
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+	case ScheduleSmallestFirst, ScheduleLargestFirst:
+		if (a.size < 0) != (b.size < 0) {
+			return b.size < 0
+		}
+		if a.size != b.size {
+			if p == ScheduleSmallestFirst {
+				return a.size < b.size
+			}
+			return a.size > b.size
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+	}
+	return a.seq < b.seq
+}
+
+// SizeProber returns the Content-Length of url, or -1 if it is unknown.
+type SizeProber func(ctx context.Context, url string) int64
+
+// NewHeadProber returns a SizeProber that sends a HEAD request.
+func NewHeadProber(client *http.Client, header http.Header) SizeProber {
+	return func(ctx context.Context, url string) int64 {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return -1
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return -1
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return -1
+		}
+		return resp.ContentLength
+	}
+}
+
+// taskHeap は container/heap 用の優先度付きキュー
+type taskHeap struct {
+	tasks  []Task
+	policy SchedulePolicy
+}
+
+func (h *taskHeap) Len() int           { return len(h.tasks) }
+func (h *taskHeap) Less(i, j int) bool { return h.policy.less(h.tasks[i], h.tasks[j]) }
+func (h *taskHeap) Swap(i, j int)      { h.tasks[i], h.tasks[j] = h.tasks[j], h.tasks[i] }
+func (h *taskHeap) Push(x any)         { h.tasks = append(h.tasks, x.(Task)) }
+
+func (h *taskHeap) index(url string) int {
+	for i, t := range h.tasks {
+		if t.url == url {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *taskHeap) Pop() any {
+	n := len(h.tasks)
+	t := h.tasks[n-1]
+	h.tasks = h.tasks[:n-1]
+	return t
+}
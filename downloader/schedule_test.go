@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestDownloadController_Schedule(t *testing.T) {
+	// /size/N は N バイトを返す
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/size/"))
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, strings.Repeat("x", n))
+		}
+	}))
+	defer ts.Close()
+
+	input := fmt.Sprintf("%[1]s/size/30\n%[1]s/size/10 priority=1\n%[1]s/size/20 priority=5\n%[1]s/size/40\n", ts.URL)
+
+	tests := []struct {
+		policy SchedulePolicy
+		want   []string
+	}{
+		{ScheduleFIFO, []string{"/size/30", "/size/10", "/size/20", "/size/40"}},
+		{SchedulePriority, []string{"/size/20", "/size/10", "/size/30", "/size/40"}},
+		{ScheduleSmallestFirst, []string{"/size/10", "/size/20", "/size/30", "/size/40"}},
+		{ScheduleLargestFirst, []string{"/size/40", "/size/30", "/size/20", "/size/10"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rec := &eventRecorder{}
+			pub := pubsub.NewPublisher[Event]()
+			pub.Register(rec)
+			saver := NewFileSaver(t.TempDir(), NewOSFS())
+
+			// ワーカー1つで開始順を確定させる
+			dc := NewDownloadController(NewLineSource(strings.NewReader(input)), &defaultPolicy, pub, saver, 1,
+				WithSchedule(tt.policy, defaultScheduleWindow, NewHeadProber(http.DefaultClient, nil)),
+			)
+			if err := dc.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, e := range rec.events {
+				if e, ok := e.(EventStart); ok {
+					got = append(got, strings.TrimPrefix(e.URL, ts.URL))
+				}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("start order mismatch: (-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDownloadController_ScheduleArgs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	var urls, want []string
+	for i := range 8 {
+		urls = append(urls, fmt.Sprintf("%s/%d", ts.URL, i))
+		want = append(want, fmt.Sprintf("/%d", i))
+	}
+	tasks, _, err := NewTasks(urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	// 引数のURLは指定した順に開始する
+	dc := NewDownloadController(tasks.Source(), &defaultPolicy, pub, NewFileSaver(t.TempDir(), NewOSFS()), 1,
+		WithSchedule(ScheduleFIFO, defaultScheduleWindow, nil),
+	)
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range rec.events {
+		if e, ok := e.(EventStart); ok {
+			got = append(got, strings.TrimPrefix(e.URL, ts.URL))
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("start order mismatch: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestParseTaskLine(t *testing.T) {
+	task, err := parseTaskLine("https://example.com/a priority=-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.url != "https://example.com/a" || task.priority != -3 {
+		t.Errorf("parseTaskLine() = %+v", task)
+	}
+
+	if _, err := parseTaskLine("https://example.com/a prio=1"); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
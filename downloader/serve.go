@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultListenAddr = "localhost:8421"
+	// serverShutdownTimeout は終了時に処理中のAPIリクエストを待つ時間
+	serverShutdownTimeout = 5 * time.Second
+	// maxAddBodySize は POST /downloads の本文の上限
+	maxAddBodySize = 1 << 20
+)
+
+// ServerControls are the operations of the HTTP API of serve.
+// DownloadController implements it.
+type ServerControls interface {
+	Add(task Task) bool
+	Cancel(url string) bool
+}
+
+// DownloadStatus is the state of a download reported by GET /status.
+type DownloadStatus struct {
+	URL      string `json:"url"`
+	State    string `json:"state"`
+	Current  int64  `json:"current"`
+	Total    int64  `json:"total,omitempty"`
+	Attempts int    `json:"attempts"`
+	Path     string `json:"path,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ServerStatus is the response of GET /status.
+type ServerStatus struct {
+	Draining  bool             `json:"draining"`
+	Downloads []DownloadStatus `json:"downloads"`
+}
+
+// Server is the HTTP API of the serve command:
+//
+//	GET    /status          the state of every download, as ServerStatus
+//	POST   /downloads       queue the URLs of the body, in the format of --input-file
+//	DELETE /downloads?url=  cancel a download
+//
+// Requests that change the downloads are refused when they carry an Origin
+// header, so that web pages open in a browser cannot send them.
+//
+// It must be registered on the publisher of the controller to follow the
+// downloads.
+type Server struct {
+	ctl ServerControls
+
+	mu        sync.Mutex
+	downloads map[string]*DownloadStatus
+	// order は最初にキューに入った順のURL
+	order    []string
+	draining bool
+}
+
+func NewServer(ctl ServerControls) *Server {
+	return &Server{ctl: ctl, downloads: make(map[string]*DownloadStatus)}
+}
+
+// Handler returns the handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("POST /downloads", s.handleAdd)
+	mux.HandleFunc("DELETE /downloads", s.handleCancel)
+	return mux
+}
+
+// Status returns the state of every download, in the order they were first
+// queued.
+func (s *Server) Status() ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ServerStatus{Draining: s.draining, Downloads: make([]DownloadStatus, 0, len(s.order))}
+	for _, url := range s.order {
+		status.Downloads = append(status.Downloads, *s.downloads[url])
+	}
+	return status
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Status())
+}
+
+// fromBrowser はブラウザから送られたリクエストを拒否する。ブラウザはGET以外の
+// リクエストに必ず Origin を付けるので、他のサイトのページや DNS rebinding から
+// ダウンロードを操作されない
+func fromBrowser(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		return false
+	}
+	http.Error(w, "requests from browsers are not accepted", http.StatusForbidden)
+	return true
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	if fromBrowser(w, r) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAddBodySize)
+
+	// 一部だけ受け付けることがないよう、全ての行を読んでからキューに入れる
+	var tasks []Task
+	sc := bufio.NewScanner(r.Body)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		task, err := parseTaskLine(line)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("line %d: %v", n, err), http.StatusBadRequest)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+	if err := sc.Err(); err != nil {
+		code := http.StatusBadRequest
+		if errors.As(err, new(*http.MaxBytesError)) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	if draining {
+		http.Error(w, "shutting down; no new downloads are accepted", http.StatusServiceUnavailable)
+		return
+	}
+
+	queued := []string{}
+	for _, task := range tasks {
+		if s.ctl.Add(task) {
+			queued = append(queued, task.url)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string][]string{"queued": queued})
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if fromBrowser(w, r) {
+		return
+	}
+	url, err := NormalizeURL(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.ctl.Cancel(url) {
+		http.Error(w, "no such download in progress or queued", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (s *Server) HandleEvent(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e := event.(type) {
+	case EventQueued:
+		// 同じURLを再びキューに入れた場合は前の結果を消す
+		d := s.download(e.URL)
+		*d = DownloadStatus{URL: e.URL, State: stateQueued.String()}
+	case EventStart:
+		d := s.download(e.URL)
+		d.State = stateDownloading.String()
+		d.Attempts++
+		d.Current, d.Total = 0, 0
+	case EventProgress:
+		d := s.download(e.URL)
+		d.Current = e.Current
+		if e.Total > 0 {
+			d.Total = e.Total
+		}
+	case EventRetry:
+		d := s.download(e.URL)
+		d.Attempts++
+		d.Error = oneLine(e.Err)
+	case EventEnd:
+		d := s.download(e.URL)
+		d.State = stateDone.String()
+		d.Current = e.CurrentSize
+		d.Path = e.Path
+		d.Error = ""
+	case EventUnchanged:
+		s.download(e.URL).State = stateUnchanged.String()
+	case EventAbort:
+		d := s.download(e.URL)
+		d.State = stateFailed.String()
+		if errors.Is(e.Err, ErrCanceled) {
+			d.State = stateCanceled.String()
+		}
+		d.Error = oneLine(e.Err)
+	case EventDiskFull:
+		d := s.download(e.URL)
+		d.State = stateFailed.String()
+		d.Error = oneLine(e.Err)
+	case EventDrain:
+		s.draining = true
+	}
+}
+
+// download は s.mu を持った状態で呼ぶ
+func (s *Server) download(url string) *DownloadStatus {
+	d, ok := s.downloads[url]
+	if !ok {
+		d = &DownloadStatus{URL: url}
+		s.downloads[url] = d
+		s.order = append(s.order, url)
+	}
+	return d
+}
+
+// startServer serves the API of s on addr until stop is called. The
+// controller is held open to accept new downloads until drain ends.
+func startServer(s *Server, dc *DownloadController, addr string, drain context.Context, w io.Writer) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("serve: %w", err)
+	}
+	release := dc.Hold()
+	stopRelease := context.AfterFunc(drain, release)
+
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintln(w, "serve:", err)
+			release()
+		}
+	}()
+	fmt.Fprintf(w, "listening on http://%s\n", ln.Addr())
+
+	return func() {
+		stopRelease()
+		release()
+		ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-done
+	}, nil
+}
+
+// FetchServerStatus asks the serve command listening on addr for the state
+// of its downloads.
+func FetchServerStatus(ctx context.Context, client *http.Client, addr string) (*ServerStatus, error) {
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	var status ServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("%s: %w", req.URL, err)
+	}
+	return &status, nil
+}
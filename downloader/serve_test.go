@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeServerControls は Server から受けた操作を記録する
+type fakeServerControls struct {
+	mu       sync.Mutex
+	added    []Task
+	canceled []string
+}
+
+func (c *fakeServerControls) Add(task Task) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.added = append(c.added, task)
+	return true
+}
+
+func (c *fakeServerControls) Cancel(url string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canceled = append(c.canceled, url)
+	return url == "https://example.com/a"
+}
+
+func TestServer(t *testing.T) {
+	ctl := &fakeServerControls{}
+	s := NewServer(ctl)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// ブラウザからのリクエストは受け付けない
+	for _, method := range []string{"POST", "DELETE"} {
+		req, err := http.NewRequest(method, ts.URL+"/downloads?url=https://example.com/a", strings.NewReader("https://example.com/a\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "https://evil.example")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with Origin = %d, want 403", method, resp.StatusCode)
+		}
+	}
+	if code, _ := do("POST", "/downloads", strings.Repeat("https://example.com/a\n", maxAddBodySize/20)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body = %d, want 413", code)
+	}
+	if len(ctl.added) != 0 || len(ctl.canceled) != 0 {
+		t.Errorf("rejected requests reached the controller: added %v, canceled %v", ctl.added, ctl.canceled)
+	}
+
+	// 1行でも不正なら何もキューに入れない
+	if code, _ := do("POST", "/downloads", "https://example.com/a\nnot a url\n"); code != http.StatusBadRequest {
+		t.Errorf("invalid body = %d, want 400", code)
+	}
+	if len(ctl.added) != 0 {
+		t.Errorf("invalid body queued %v", ctl.added)
+	}
+
+	code, body := do("POST", "/downloads", "# comment\nhttps://example.com/a https://mirror.example.com/a\n\nhttps://example.com/b\n")
+	if code != http.StatusAccepted || !strings.Contains(body, `"queued":["https://example.com/a","https://example.com/b"]`) {
+		t.Errorf("POST = %d %s", code, body)
+	}
+	if len(ctl.added) != 2 || !cmp.Equal(ctl.added[0].mirrors, []string{"https://mirror.example.com/a"}) {
+		t.Errorf("added = %v", ctl.added)
+	}
+
+	if code, _ := do("DELETE", "/downloads?url=https://example.com/a", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE a = %d, want 204", code)
+	}
+	if code, _ := do("DELETE", "/downloads?url=https://example.com/c", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE c = %d, want 404", code)
+	}
+
+	a, b := "https://example.com/a", "https://example.com/b"
+	for _, e := range []Event{
+		EventQueued{URL: b},
+		EventQueued{URL: a},
+		EventStart{URL: b},
+		EventRetry{URL: b, Err: errors.New("503 Service Unavailable")},
+		EventProgress{URL: b, Current: 10, Total: 20},
+		EventEnd{URL: b, CurrentSize: 20, Path: "out/b"},
+		EventStart{URL: a},
+		NewEventAbort(a, ErrCanceled),
+	} {
+		s.HandleEvent(e)
+	}
+	status, err := FetchServerStatus(context.Background(), http.DefaultClient, strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ServerStatus{Downloads: []DownloadStatus{
+		{URL: b, State: "done", Current: 20, Total: 20, Attempts: 2, Path: "out/b"},
+		{URL: a, State: "canceled", Attempts: 1, Error: ErrCanceled.Error()},
+	}}
+	if diff := cmp.Diff(want, status); diff != "" {
+		t.Errorf("status (-want +got):\n%s", diff)
+	}
+
+	var out bytes.Buffer
+	if code := printServerStatus(&out, "localhost", status); code != exitOK {
+		t.Errorf("printServerStatus = %d, want %d without failures:\n%s", code, exitOK, out.String())
+	}
+
+	s.HandleEvent(EventDrain{})
+	if code, _ := do("POST", "/downloads", "https://example.com/c\n"); code != http.StatusServiceUnavailable {
+		t.Errorf("POST while draining = %d, want 503", code)
+	}
+	if !s.Status().Draining {
+		t.Error("status is not draining")
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/no-yan/multierr"
+)
+
+// TaskSource yields tasks one by one, so that a long URL list never has to
+// be held in memory.
+type TaskSource interface {
+	// Next returns the next task. ok is false when the source is exhausted.
+	Next(ctx context.Context) (task Task, ok bool, err error)
+}
+
+type sliceSource struct {
+	tasks []Task
+}
+
+func NewSliceSource(tasks ...Task) TaskSource {
+	return &sliceSource{tasks: tasks}
+}
+
+func (s *sliceSource) Next(ctx context.Context) (Task, bool, error) {
+	if len(s.tasks) == 0 {
+		return Task{}, false, nil
+	}
+	t := s.tasks[0]
+	s.tasks = s.tasks[1:]
+	return t, true, nil
+}
+
+// lineSource reads one task per line in the form "URL [MIRROR...] [priority=N]".
+// Blank lines and lines starting with "#" are skipped.
+// Close stops reading when the tasks are no longer needed.
+type lineSource struct {
+	tasks <-chan Task
+	errc  <-chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewLineSource(r io.Reader) TaskSource {
+	return newLineSource(r, nil)
+}
+
+// newLineSource skips the lines in skip, which are found by checkTaskLines.
+func newLineSource(r io.Reader, skip map[int]bool) TaskSource {
+	tasks := make(chan Task)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+
+	// stdinの読み込みはキャンセルできないため、別goroutineで読んでNextでctxと待ち合わせる
+	go func() {
+		defer close(tasks)
+		sc := bufio.NewScanner(r)
+		for n := 1; sc.Scan(); n++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") || skip[n] {
+				continue
+			}
+			task, err := parseTaskLine(line)
+			if err != nil {
+				errc <- fmt.Errorf("line %d: %w", n, err)
+				return
+			}
+			// 読み手が止まった後も送ろうとして残らないようにする
+			select {
+			case tasks <- task:
+			case <-done:
+				errc <- nil
+				return
+			}
+		}
+		errc <- sc.Err()
+	}()
+
+	return &lineSource{tasks: tasks, errc: errc, done: done}
+}
+
+// checkTaskLines reads every line before the download starts, so that a
+// malformed line is reported before any URL is downloaded. seen maps the
+// URLs read so far to the URL as written, and the lines of URLs already in
+// seen are returned as duplicates to skip.
+func checkTaskLines(r io.Reader, seen map[string]string) (skip map[int]bool, dups []Duplicate, err error) {
+	skip = make(map[int]bool)
+	errs := multierr.New()
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		task, err := parseTaskLine(line)
+		if err != nil {
+			errs.Add(fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		raw := strings.Fields(line)[0]
+		if first, ok := seen[task.url]; ok {
+			dups = append(dups, Duplicate{URL: raw, Of: first})
+			skip[n] = true
+			continue
+		}
+		seen[task.url] = raw
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := errs.Err(); err != nil {
+		return nil, nil, fmt.Errorf("invalid lines:\n%w", err)
+	}
+	return skip, dups, nil
+}
+
+func parseTaskLine(line string) (Task, error) {
+	fields := strings.Fields(line)
+	url, err := NormalizeURL(fields[0])
+	if err != nil {
+		return Task{}, fmt.Errorf("invalid URL %q: %w", fields[0], err)
+	}
+	task := *NewTask(url)
+
+	for _, field := range fields[1:] {
+		if strings.Contains(field, "://") {
+			mirror, err := NormalizeURL(field)
+			if err != nil {
+				return Task{}, fmt.Errorf("invalid mirror %q: %w", field, err)
+			}
+			task.mirrors = append(task.mirrors, mirror)
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Task{}, fmt.Errorf("invalid field %q: want a mirror URL or key=value", field)
+		}
+		switch key {
+		case "priority":
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				return Task{}, fmt.Errorf("invalid priority %q", value)
+			}
+			task.priority = p
+		default:
+			return Task{}, fmt.Errorf("unknown field %q", key)
+		}
+	}
+
+	return task, nil
+}
+
+func (s *lineSource) Next(ctx context.Context) (Task, bool, error) {
+	select {
+	case <-ctx.Done():
+		return Task{}, false, ctx.Err()
+	case task, ok := <-s.tasks:
+		if !ok {
+			return Task{}, false, <-s.errc
+		}
+		return task, true, nil
+	}
+}
+
+// Close stops the reading goroutine. It does not close the underlying reader.
+func (s *lineSource) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+type multiSource struct {
+	sources []TaskSource
+}
+
+// NewMultiSource reads sources one after another.
+func NewMultiSource(sources ...TaskSource) TaskSource {
+	return &multiSource{sources: sources}
+}
+
+func (s *multiSource) Next(ctx context.Context) (Task, bool, error) {
+	for len(s.sources) > 0 {
+		t, ok, err := s.sources[0].Next(ctx)
+		if err != nil || ok {
+			return t, ok, err
+		}
+		s.sources = s.sources[1:]
+	}
+	return Task{}, false, nil
+}
+
+// taskQueue hands tasks to the worker pool. Tasks pulled from the source
+// and tasks pushed by the crawler share one queue, and the queue is drained
+// only when the source is exhausted and no task in flight can push more.
+//
+// Unless the policy is FIFO, up to window tasks are read ahead from the
+// source and the best of them by the policy is started first.
+type taskQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	src  TaskSource
+
+	pending   taskHeap
+	window    int
+	probe     SizeProber
+	probeSem  chan int
+	probes    sync.WaitGroup
+	seq       uint64
+	probing   int
+	active    int
+	holds     int
+	pinned    uint64
+	reading   bool
+	exhausted bool
+	draining  bool
+	paused    bool
+	err       error
+
+	// onAdd is called with q.mu held when a task becomes pending.
+	onAdd func(Task)
+}
+
+func newTaskQueue(src TaskSource) *taskQueue {
+	q := &taskQueue{
+		src:     src,
+		pending: taskHeap{policy: ScheduleFIFO},
+		window:  1,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// schedule sets the scheduling policy. probe is required for size-aware policies.
+func (q *taskQueue) schedule(policy SchedulePolicy, window int, probe SizeProber) {
+	q.pending.policy = policy
+	q.window = 1
+	if policy != ScheduleFIFO {
+		q.window = max(window, 1)
+	}
+	if policy.needsSize() {
+		q.probe = probe
+		q.probeSem = make(chan int, probeConcurrency)
+	}
+}
+
+// next blocks until a task is available. ok is false when the queue is drained
+// or ctx is done. Every task returned must be reported back with done.
+func (q *taskQueue) next(ctx context.Context) (task Task, ok bool) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if ctx.Err() != nil || q.draining {
+			return Task{}, false
+		}
+
+		windowFull := q.pending.Len()+q.probing >= q.window
+		if !q.exhausted && !q.reading && !windowFull {
+			q.read(ctx)
+			continue
+		}
+		// 先読みが済んでから優先度の高いものを選ぶ
+		if q.pending.Len() > 0 && !q.paused && (windowFull || (q.exhausted && q.probing == 0)) {
+			task = heap.Pop(&q.pending).(Task)
+			q.active++
+			q.cond.Broadcast()
+			return task, true
+		}
+		if q.exhausted && q.active == 0 && q.probing == 0 && q.pending.Len() == 0 && q.holds == 0 {
+			return Task{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// read pulls one task from the source without holding the lock,
+// so that pushed tasks can be taken while the source blocks.
+func (q *taskQueue) read(ctx context.Context) {
+	q.reading = true
+	q.mu.Unlock()
+	task, ok, err := q.src.Next(ctx)
+	q.mu.Lock()
+	q.reading = false
+
+	switch {
+	case err != nil:
+		q.exhausted = true
+		if ctx.Err() == nil {
+			q.err = err
+		}
+	case !ok:
+		q.exhausted = true
+	default:
+		q.add(ctx, task)
+	}
+	q.cond.Broadcast()
+}
+
+// add must be called with q.mu held. With a size-aware policy the task
+// joins the queue after its size is probed.
+func (q *taskQueue) add(ctx context.Context, task Task) {
+	q.seq++
+	task.seq = q.seq
+	task.size = -1
+
+	if q.probe == nil {
+		q.pushPending(task)
+		return
+	}
+
+	q.probing++
+	q.probes.Add(1)
+	go func() {
+		defer q.probes.Done()
+
+		q.probeSem <- 1
+		task.size = q.probe(ctx, task.url)
+		<-q.probeSem
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.probing--
+		q.pushPending(task)
+		q.cond.Broadcast()
+	}()
+}
+
+func (q *taskQueue) pushPending(task Task) {
+	heap.Push(&q.pending, task)
+	if q.onAdd != nil {
+		q.onAdd(task)
+	}
+}
+
+func (q *taskQueue) push(ctx context.Context, task Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(ctx, task)
+	q.cond.Broadcast()
+}
+
+// drain stops handing out tasks. Tasks already handed out are not affected.
+func (q *taskQueue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.draining = true
+	q.cond.Broadcast()
+}
+
+// setPaused stops or restarts handing out tasks. Tasks are still read
+// ahead from the source while paused.
+func (q *taskQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = paused
+	q.cond.Broadcast()
+}
+
+// readAhead makes the queue keep at least n tasks pending, so that they
+// can be seen and reordered before they start.
+func (q *taskQueue) readAhead(n int) {
+	q.window = max(q.window, n)
+}
+
+// hold keeps next from reporting the end of the queue until release is
+// called, so that tasks can still be pushed after the source is exhausted.
+func (q *taskQueue) hold() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.holds++
+}
+
+func (q *taskQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.holds--
+	q.cond.Broadcast()
+}
+
+// remove takes the pending task of url out of the queue.
+func (q *taskQueue) remove(url string) (Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.pending.index(url)
+	if i < 0 {
+		return Task{}, false
+	}
+	task := heap.Remove(&q.pending, i).(Task)
+	q.cond.Broadcast()
+	return task, true
+}
+
+// prioritize moves the pending task of url to the front of the queue.
+func (q *taskQueue) prioritize(url string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.pending.index(url)
+	if i < 0 {
+		return false
+	}
+	q.pinned++
+	q.pending.tasks[i].pinned = q.pinned
+	heap.Fix(&q.pending, i)
+	return true
+}
+
+// wait blocks until every probe has finished.
+func (q *taskQueue) wait() {
+	q.probes.Wait()
+}
+
+func (q *taskQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	q.cond.Broadcast()
+}
+
+// Err returns the error that stopped the source early, if any.
+func (q *taskQueue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestLineSource(t *testing.T) {
+	input := "https://example.com/a\n\n  # comment\n  https://example.com/b  \n"
+	src := NewMultiSource(NewSliceSource(*NewTask("https://example.com/first")), NewLineSource(strings.NewReader(input)))
+
+	var got []string
+	for {
+		task, ok, err := src.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, task.url)
+	}
+
+	want := []string{"https://example.com/first", "https://example.com/a", "https://example.com/b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next() mismatch: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestLineSource_InvalidURL(t *testing.T) {
+	src := NewLineSource(strings.NewReader("https://example.com/a\nexample.com/b\n"))
+
+	var err error
+	for ok := true; ok && err == nil; {
+		_, ok, err = src.Next(context.Background())
+	}
+	if err == nil || !strings.Contains(err.Error(), `line 2: invalid URL "example.com/b": missing scheme`) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCheckTaskLines(t *testing.T) {
+	seen := map[string]string{"https://example.com/a": "https://example.com/a"}
+	input := "https://Example.com/b\n# comment\nhttps://example.com/b#frag\nhttps://example.com:443/a\n"
+	skip, dups, err := checkTaskLines(strings.NewReader(input), seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[int]bool{3: true, 4: true}, skip); diff != "" {
+		t.Errorf("skip mismatch: (-want, +got)\n%s", diff)
+	}
+	want := []Duplicate{
+		{URL: "https://example.com/b#frag", Of: "https://Example.com/b"},
+		{URL: "https://example.com:443/a", Of: "https://example.com/a"},
+	}
+	if diff := cmp.Diff(want, dups); diff != "" {
+		t.Errorf("duplicates mismatch: (-want, +got)\n%s", diff)
+	}
+
+	// 不正な行はすべてまとめて報告する
+	_, _, err = checkTaskLines(strings.NewReader("https://example.com/a\nexample.com/b\nhttps://example.com/c prio=1\n"), map[string]string{})
+	for _, want := range []string{`line 2: invalid URL "example.com/b"`, `line 3: unknown field "prio"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+}
+
+// endlessLines は同じURLの行を返し続ける
+type endlessLines struct{}
+
+func (endlessLines) Read(p []byte) (int, error) {
+	const line = "https://example.com/a\n"
+	n := 0
+	for n+len(line) <= len(p) {
+		n += copy(p[n:], line)
+	}
+	return n, nil
+}
+
+func TestLineSource_Close(t *testing.T) {
+	src := NewLineSource(endlessLines{})
+	if _, ok, err := src.Next(context.Background()); !ok || err != nil {
+		t.Fatalf("Next() = %t, %v", ok, err)
+	}
+	src.(io.Closer).Close()
+
+	// 読み込みのgoroutineは送信を待ち続けずに終わる
+	for range 1000 {
+		_, ok, err := src.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return
+		}
+	}
+	t.Error("tasks are still read after Close")
+}
+
+// pullCounter は読み出されたが完了していないタスクの最大数を記録する
+type pullCounter struct {
+	TaskSource
+	mu              sync.Mutex
+	pulled, maxOpen int
+	ended           int
+}
+
+func (c *pullCounter) Next(ctx context.Context) (Task, bool, error) {
+	t, ok, err := c.TaskSource.Next(ctx)
+	if ok {
+		c.mu.Lock()
+		c.pulled++
+		c.maxOpen = max(c.maxOpen, c.pulled-c.ended)
+		c.mu.Unlock()
+	}
+	return t, ok, err
+}
+
+func (c *pullCounter) HandleEvent(event Event) {
+	if event.Type() == EventTypeEnd {
+		c.mu.Lock()
+		c.ended++
+		c.mu.Unlock()
+	}
+}
+
+func TestDownloadController_BoundedByWorkers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	var lines strings.Builder
+	for i := range 50 {
+		fmt.Fprintf(&lines, "%s/%d\n", ts.URL, i)
+	}
+	const workers = 3
+	src := &pullCounter{TaskSource: NewLineSource(strings.NewReader(lines.String()))}
+
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(src)
+	saver := NewFileSaver(t.TempDir(), NewOSFS())
+	dc := NewDownloadController(src, &defaultPolicy, pub, saver, workers)
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if src.ended != 50 {
+		t.Errorf("%d EventEnd, want 50", src.ended)
+	}
+	// 各ワーカーが1件ずつ処理中で、さらに1件を先読みしている状態が最大
+	if src.maxOpen > workers+1 {
+		t.Errorf("%d tasks pulled ahead, want at most %d", src.maxOpen, workers+1)
+	}
+}
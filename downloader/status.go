@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statusTimeout は serve に問い合わせるときの制限時間
+const statusTimeout = 5 * time.Second
+
+func newStatusFlagSet() (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("downloader status", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+	addr := flags.String("addr", "", "ask the serve command listening on this address instead of reading a journal")
+	return flags, addr
+}
+
+// runStatus implements the status command.
+func runStatus(args []string, stdout, stderr io.Writer) int {
+	flags, addr := newStatusFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return commandError("status", &usageError{err}, stdout, stderr)
+	}
+	switch {
+	case *addr != "" && flags.NArg() == 0:
+		ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+		defer cancel()
+		status, err := FetchServerStatus(ctx, http.DefaultClient, *addr)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		return printServerStatus(stdout, *addr, status)
+	case *addr == "" && flags.NArg() == 1:
+		state, err := ReadJournalFile(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		return printJournalState(stdout, flags.Arg(0), state)
+	default:
+		return commandError("status", &usageError{errors.New("give either a journal or --addr")}, stdout, stderr)
+	}
+}
+
+// printJournalState は完了していないダウンロードがあれば exitFailure を返す
+func printJournalState(w io.Writer, path string, s *JournalState) int {
+	counts := make(map[taskState]int)
+	for _, t := range s.Tasks {
+		counts[t.State]++
+	}
+	fmt.Fprintf(w, "journal: %s\n", path)
+	if s.Runs > 0 {
+		fmt.Fprintf(w, "runs: %d, last updated %s\n", s.Runs, s.Updated.Local().Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "%d done, %d unchanged, %d failed, %d canceled, %d unfinished\n",
+		counts[stateDone], counts[stateUnchanged], counts[stateFailed], counts[stateCanceled], counts[stateQueued])
+
+	for _, t := range s.Tasks {
+		switch t.State {
+		case stateFailed, stateCanceled:
+			fmt.Fprintf(w, "%-10s %s: %s\n", t.State, t.Task.url, t.Err)
+		case stateQueued:
+			fmt.Fprintf(w, "%-10s %s\n", "unfinished", t.Task.url)
+		}
+	}
+	if len(s.Pending()) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// printServerStatus は失敗したダウンロードがあれば exitFailure を返す
+func printServerStatus(w io.Writer, addr string, s *ServerStatus) int {
+	counts := make(map[string]int)
+	for _, d := range s.Downloads {
+		counts[d.State]++
+	}
+	line := "server: " + addr
+	if s.Draining {
+		line += " (draining)"
+	}
+	fmt.Fprintln(w, line)
+	var summary []string
+	for state := stateQueued; state <= stateCanceled; state++ {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[state.String()], state))
+	}
+	fmt.Fprintln(w, strings.Join(summary, ", "))
+
+	for _, d := range s.Downloads {
+		progress := formatSize(d.Current)
+		if d.Total > 0 {
+			progress += "/" + formatSize(d.Total)
+		}
+		fmt.Fprintf(w, "%-11s %-17s %s", d.State, progress, d.URL)
+		if d.Error != "" && d.State != stateDone.String() {
+			fmt.Fprintf(w, ": %s", d.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	if counts[stateFailed.String()] > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
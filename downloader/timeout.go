@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultStallTimeout   = 60 * time.Second
+	defaultMinSpeedWindow = 30 * time.Second
+)
+
+// RequestTimeoutError means that no response header arrived within the
+// per-attempt request timeout.
+type RequestTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("request timed out: no response within %s", e.Timeout)
+}
+
+// ConnectTimeoutError means that the TCP connection was not established in time.
+type ConnectTimeoutError struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+func (e *ConnectTimeoutError) Error() string {
+	return fmt.Sprintf("connect to %s timed out after %s", e.Addr, e.Timeout)
+}
+
+// StallError means that no byte of the body arrived for the stall timeout.
+type StallError struct {
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("transfer stalled: no data for %s", e.Timeout)
+}
+
+// SlowTransferError means that the throughput stayed below the minimum speed.
+type SlowTransferError struct {
+	Speed    int64
+	MinSpeed int64
+	Window   time.Duration
+}
+
+func (e *SlowTransferError) Error() string {
+	return fmt.Sprintf("transfer too slow: %d bytes/s over %s, want at least %d bytes/s", e.Speed, e.Window, e.MinSpeed)
+}
+
+// TotalTimeoutError means that the whole run exceeded --total-timeout.
+type TotalTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TotalTimeoutError) Error() string {
+	return fmt.Sprintf("total timeout of %s exceeded", e.Timeout)
+}
+
+// causeOf はctxが終了していればその原因を、そうでなければerrを返す。
+// キャンセルによるエラーを各タイムアウトのエラー型に置き換えるために使う。
+func causeOf(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return cause
+		}
+	}
+	return err
+}
+
+// dialWithTimeout wraps a dial timeout of dialer in ConnectTimeoutError.
+func dialWithTimeout(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	var netErr net.Error
+	if err != nil && ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, &ConnectTimeoutError{Addr: addr, Timeout: dialer.Timeout}
+	}
+	return conn, err
+}
+
+// attemptBody is the body of one attempt. It cancels the attempt when a
+// Read waits for data longer than stallTimeout, and releases the attempt on
+// Close. Time the caller spends between reads does not count, so that a
+// slow consumer is not taken for a stalled server.
+type attemptBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	stallTimeout time.Duration
+	stall        *time.Timer
+
+	// span と har は Close で受信したバイト数を記録して終わる
+	span  *Span
+	har   *harAttempt
+	resp  *http.Response
+	bytes int64
+}
+
+func newAttemptBody(ctx context.Context, cancel context.CancelCauseFunc, resp *http.Response, stallTimeout time.Duration, span *Span, har *harAttempt) *attemptBody {
+	b := &attemptBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, stallTimeout: stallTimeout, span: span, har: har, resp: resp}
+	if stallTimeout > 0 {
+		b.stall = time.AfterFunc(stallTimeout, func() {
+			cancel(&StallError{Timeout: stallTimeout})
+		})
+		b.stall.Stop()
+	}
+	return b
+}
+
+func (b *attemptBody) Read(p []byte) (int, error) {
+	if b.stall != nil {
+		b.stall.Reset(b.stallTimeout)
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.stall != nil {
+		b.stall.Stop()
+	}
+	b.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		err = networkError(b.ctx, err)
+		b.span.SetError(err)
+		b.har.setError(err)
+	}
+	return n, err
+}
+
+func (b *attemptBody) Close() error {
+	if b.stall != nil {
+		b.stall.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	b.span.SetAttributes(attr("downloader.bytes", b.bytes))
+	b.span.End()
+	b.har.finish(b.resp, b.bytes)
+	return err
+}
+
+// speedMeter は Read で待った時間が window に達するごとに平均速度を測る。
+// 読み出し側が遅いだけの時間は含めない。
+type speedMeter struct {
+	limit   int64
+	window  time.Duration
+	elapsed time.Duration
+	bytes   int64
+}
+
+func newSpeedMeter(limit int64, window time.Duration) speedMeter {
+	return speedMeter{limit: limit, window: window}
+}
+
+func (m *speedMeter) reset() {
+	m.elapsed, m.bytes = 0, 0
+}
+
+// add counts n bytes read in d and, once a window has passed, reports
+// whether the average speed over it was below the limit.
+func (m *speedMeter) add(n int, d time.Duration) (speed int64, slow bool) {
+	if m.limit <= 0 {
+		return 0, false
+	}
+	m.bytes += int64(n)
+	m.elapsed += d
+	if m.elapsed < m.window {
+		return 0, false
+	}
+	speed = int64(float64(m.bytes) / m.elapsed.Seconds())
+	m.reset()
+	return speed, speed < m.limit
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/no-yan/tmp/downloader/internal/backoff"
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+// newTimeoutServer returns a server of mirrorContent that answers a Range
+// request at once, while /hang, /stall and /slow misbehave on the first request.
+func newTimeoutServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(mirrorContent))
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(mirrorContent)))
+		switch r.URL.Path {
+		case "/hang":
+			<-r.Context().Done()
+		case "/stall":
+			io.WriteString(w, mirrorContent[:len(mirrorContent)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "/slow":
+			for i := range len(mirrorContent) {
+				io.WriteString(w, mirrorContent[i:i+1])
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestDownloadWorker_RequestTimeout(t *testing.T) {
+	ts := newTimeoutServer(t)
+	policy := backoff.Policy{DelayMin: time.Millisecond, DelayMax: time.Millisecond, RetryLimit: 3}
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+
+	d := NewDownloadWorker(ts.URL+"/hang", &policy, pub, WithTimeouts(50*time.Millisecond, 0))
+	_, _, err := d.Run(context.Background())
+
+	var timeoutErr *RequestTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v, want RequestTimeoutError", err)
+	}
+	if got := rec.count(EventTypeRetry); got != 3 {
+		t.Errorf("retries = %d, want 3", got)
+	}
+}
+
+func TestDownloadWorker_ResumeAfterTimeout(t *testing.T) {
+	ts := newTimeoutServer(t)
+
+	tests := map[string]struct {
+		path string
+		opt  WorkerOption
+		want any
+	}{
+		"stall":     {"/stall", WithTimeouts(0, 50*time.Millisecond), new(*StallError)},
+		"min speed": {"/slow", WithMinSpeed(1000, 50*time.Millisecond), new(*SlowTransferError)},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := &eventRecorder{}
+			pub := pubsub.NewPublisher[Event]()
+			pub.Register(rec)
+
+			d := NewDownloadWorker(ts.URL+tt.path, &defaultPolicy, pub, tt.opt)
+			body, _, err := d.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != mirrorContent {
+				t.Errorf("got %d bytes, want %d", len(got), len(mirrorContent))
+			}
+			if !errors.As(errors.Join(d.errs...), tt.want) {
+				t.Errorf("errors = %v, want %T", d.errs, tt.want)
+			}
+			if got := rec.count(EventTypeRetry); got != 1 {
+				t.Errorf("retries = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestDialWithTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := &net.Dialer{Timeout: time.Nanosecond}
+	_, err = dialWithTimeout(context.Background(), dialer, "tcp", ln.Addr().String())
+
+	var timeoutErr *ConnectTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v, want ConnectTimeoutError", err)
+	}
+}
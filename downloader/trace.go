@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/no-yan/multierr"
+)
+
+const (
+	// 終了したスパンは traceBatchSize 件たまるか traceFlushInterval ごとに送る
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+	// traceQueueSize を超えて送信が追いつかないスパンは捨てる
+	traceQueueSize = 4096
+)
+
+// TraceConfig is the configuration of the tracing of downloads. Tracing is
+// disabled unless an exporter is set.
+type TraceConfig struct {
+	// OTLPEndpoint は OTLP/HTTP の送信先。パスがなければ /v1/traces を送る
+	OTLPEndpoint string `yaml:"otlp-endpoint,omitempty"`
+	// File にはスパンを OTLP の JSON で1行ずつ追記する
+	File string `yaml:"file,omitempty"`
+}
+
+func (tc TraceConfig) enabled() bool {
+	return tc.OTLPEndpoint != "" || tc.File != ""
+}
+
+func (tc TraceConfig) validate() error {
+	if tc.OTLPEndpoint == "" {
+		return nil
+	}
+	if _, err := NewOTLPExporter(tc.OTLPEndpoint, nil); err != nil {
+		return fmt.Errorf("trace.otlp-endpoint: %w", err)
+	}
+	return nil
+}
+
+type SpanKind int
+
+// OTLP の SpanKind の値
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindClient   SpanKind = 3
+)
+
+// Attribute is a key-value pair of a span. Value is a string, int, int64,
+// bool or float64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// Span is a timed operation of a trace. A nil *Span is valid and records
+// nothing, so that code can be traced whether or not tracing is enabled.
+type Span struct {
+	tracer *Tracer
+
+	name    string
+	kind    SpanKind
+	traceID TraceID
+	spanID  SpanID
+	// parent はルートのスパンならゼロ
+	parent SpanID
+	start  time.Time
+	end    time.Time
+
+	mu         sync.Mutex
+	attributes []Attribute
+	err        error
+	ended      bool
+}
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches in the background.
+type Tracer struct {
+	exporters []SpanExporter
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+	errs    multierr.Collector
+	queue   chan *Span
+	done    chan struct{}
+}
+
+func NewTracer(exporters ...SpanExporter) *Tracer {
+	t := &Tracer{
+		exporters: exporters,
+		errs:      multierr.New(),
+		queue:     make(chan *Span, traceQueueSize),
+		done:      make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+type spanKey struct{}
+
+// Start starts a span, as a child of the span in ctx if any. It returns a
+// nil span if t is nil.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: attrs}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan は ctx のスパンの子を開始する。ctx にスパンがなければ何もしない
+func startSpan(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind, attrs...)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SetAttributes adds attrs to the span. They are ignored after End.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.attributes = append(s.attributes, attrs...)
+	}
+}
+
+// SetError marks the span as failed with err. A nil err, or one set after
+// End, is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.err = err
+	}
+}
+
+// End ends the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if s.err != nil {
+		s.attributes = append(s.attributes, attr("error.type", errorType(s.err)))
+	}
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// errorType はラップを外した最も内側のエラーの型の名前
+func errorType(err error) string {
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			return fmt.Sprintf("%T", err)
+		}
+		err = inner
+	}
+}
+
+// traceparent は W3C Trace Context の traceparent ヘッダーの値
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// inject は req に traceparent を付けて、送信先のサーバーのスパンを s の子にする
+func (s *Span) inject(req *http.Request) {
+	if s == nil {
+		return
+	}
+	req.Header.Set("Traceparent", s.traceparent())
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		t.dropped++
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped++
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	for _, e := range t.exporters {
+		if err := e.ExportSpans(ctx, batch); err != nil {
+			t.mu.Lock()
+			t.errs.Add(err)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Shutdown exports the spans not sent yet and stops the tracer. The error
+// lists the exports that failed while tracing.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return fmt.Errorf("trace: %w", ctx.Err())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dropped > 0 {
+		t.errs.Add(fmt.Errorf("dropped %d spans", t.dropped))
+	}
+	if err := t.errs.Err(); err != nil {
+		return fmt.Errorf("trace:\n%w", err)
+	}
+	return nil
+}
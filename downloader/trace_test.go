@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+// readSpans はファイルエクスポーターが書いた行からスパンを読む
+func readSpans(t *testing.T, r io.Reader) []otlpSpan {
+	t.Helper()
+	var spans []otlpSpan
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var req otlpRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			t.Fatalf("invalid line %q: %v", sc.Text(), err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func spanAttr(s otlpSpan, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key != key {
+			continue
+		}
+		switch {
+		case kv.Value.StringValue != nil:
+			return *kv.Value.StringValue
+		case kv.Value.IntValue != nil:
+			return *kv.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestDownloadController_Trace(t *testing.T) {
+	var requests atomic.Int32
+	traceparents := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("Traceparent")
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	tracer := NewTracer(NewFileExporter(&buf))
+	source := NewSliceSource(*NewTask(ts.URL + "/a"))
+	dc := NewDownloadController(source, &defaultPolicy, pubsub.NewPublisher[Event](), NewFileSaver(t.TempDir(), NewOSFS()), 1, WithTracer(tracer))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := readSpans(t, &buf)
+	if len(spans) != 3 {
+		t.Fatalf("%d spans, want a task and 2 attempts: %+v", len(spans), spans)
+	}
+	var task otlpSpan
+	var attempts []otlpSpan
+	for _, s := range spans {
+		if s.Name == "download" {
+			task = s
+		} else {
+			attempts = append(attempts, s)
+		}
+	}
+	if task.ParentSpanID != "" || spanAttr(task, "downloader.bytes") != "5" || spanAttr(task, "downloader.attempts") != "2" {
+		t.Errorf("task span = %+v", task)
+	}
+
+	failed, ok := attempts[0], attempts[1]
+	if spanAttr(failed, "downloader.attempt") != "1" {
+		failed, ok = ok, failed
+	}
+	for _, s := range attempts {
+		if s.TraceID != task.TraceID || s.ParentSpanID != task.SpanID || s.Kind != SpanKindClient {
+			t.Errorf("attempt span %+v is not a client span under the task", s)
+		}
+	}
+	if failed.Status.Code != otlpStatusError || spanAttr(failed, "http.response.status_code") != "503" || spanAttr(failed, "error.type") != "*main.HTTPStatusError" {
+		t.Errorf("failed attempt = %+v", failed)
+	}
+	if ok.Status.Code != 0 || spanAttr(ok, "downloader.bytes") != "5" || spanAttr(ok, "downloader.retry.delay_ms") == "" {
+		t.Errorf("successful attempt = %+v", ok)
+	}
+
+	// サーバーが受け取ったtraceparentの親は各試行のスパン
+	close(traceparents)
+	var got []string
+	for tp := range traceparents {
+		got = append(got, tp)
+	}
+	for i, s := range []otlpSpan{failed, ok} {
+		if want := "00-" + s.TraceID + "-" + s.SpanID + "-01"; got[i] != want {
+			t.Errorf("traceparent of attempt %d = %q, want %q", i+1, got[i], want)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var path, contentType string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	e, err := NewOTLPExporter(ts.URL, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(e)
+	_, span := tracer.Start(context.Background(), "download", SpanKindInternal, attr("url.full", "https://example.com/a"))
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != otlpTracesPath || contentType != "application/json" {
+		t.Errorf("posted to %s as %s, want %s as application/json", path, contentType, otlpTracesPath)
+	}
+	spans := readSpans(t, bytes.NewReader(body))
+	if len(spans) != 1 || spans[0].Name != "download" || spanAttr(spans[0], "url.full") != "https://example.com/a" {
+		t.Errorf("spans = %+v", spans)
+	}
+	if !strings.Contains(string(body), `"service.name"`) {
+		t.Errorf("resource has no service.name: %s", body)
+	}
+}
+
+func TestOTLPExporter_Error(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such tenant", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	e, err := NewOTLPExporter(ts.URL+"/custom", ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(e)
+	_, span := tracer.Start(context.Background(), "download", SpanKindInternal)
+	span.End()
+
+	err = tracer.Shutdown(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: no such tenant") {
+		t.Errorf("Shutdown() = %v, want the export error", err)
+	}
+	if _, err := NewOTLPExporter("localhost:4318", nil); err == nil {
+		t.Error("NewOTLPExporter accepted an endpoint without scheme")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/no-yan/multierr"
+)
+
+// TransportConfig is the http.Transport part of the configuration.
+type TransportConfig struct {
+	Proxy               string        `yaml:"proxy,omitempty"`
+	CACert              string        `yaml:"ca-cert,omitempty"`
+	ClientCert          string        `yaml:"client-cert,omitempty"`
+	ClientKey           string        `yaml:"client-key,omitempty"`
+	InsecureSkipVerify  bool          `yaml:"insecure-skip-verify"`
+	MaxIdleConns        int           `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost int           `yaml:"max-idle-conns-per-host"`
+	MaxConnsPerHost     int           `yaml:"max-conns-per-host"`
+	HTTP2               bool          `yaml:"http2"`
+	Resolve             []string      `yaml:"resolve,omitempty"`
+	ConnectTimeout      time.Duration `yaml:"connect-timeout"`
+}
+
+func defaultTransportConfig() TransportConfig {
+	t := http.DefaultTransport.(*http.Transport)
+	return TransportConfig{
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		MaxConnsPerHost:     0,
+		HTTP2:               true,
+		ConnectTimeout:      defaultConnectTimeout,
+	}
+}
+
+func (tc TransportConfig) validate() error {
+	m := multierr.New()
+
+	if tc.Proxy != "" {
+		if _, err := parseProxyURL(tc.Proxy); err != nil {
+			m.Add(fmt.Errorf("transport.proxy: %w", err))
+		}
+	}
+	if (tc.ClientCert == "") != (tc.ClientKey == "") {
+		m.Add(errors.New("transport.client-cert, transport.client-key: both must be given"))
+	}
+	if tc.MaxIdleConns < 0 {
+		m.Add(errors.New("transport.max-idle-conns: must not be negative"))
+	}
+	if tc.MaxIdleConnsPerHost < 0 {
+		m.Add(errors.New("transport.max-idle-conns-per-host: must not be negative"))
+	}
+	if tc.MaxConnsPerHost < 0 {
+		m.Add(errors.New("transport.max-conns-per-host: must not be negative"))
+	}
+	if _, err := parseResolve(tc.Resolve); err != nil {
+		m.Add(fmt.Errorf("transport.resolve: %w", err))
+	}
+	if tc.ConnectTimeout <= 0 {
+		m.Add(fmt.Errorf("transport.connect-timeout: must be positive, got %s", tc.ConnectTimeout))
+	}
+
+	return m.Err()
+}
+
+// NewHTTPClient builds an http.Client whose transport follows tc.
+func NewHTTPClient(tc TransportConfig) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if tc.Proxy != "" {
+		proxy, err := parseProxyURL(tc.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig, err := tc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+
+	t.MaxIdleConns = tc.MaxIdleConns
+	t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = tc.MaxConnsPerHost
+
+	if tc.HTTP2 {
+		t.ForceAttemptHTTP2 = true
+	} else {
+		// TLSNextProtoを空でないmapにするとHTTP/2が無効になる
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	overrides, err := parseResolve(tc.Resolve)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: tc.ConnectTimeout, KeepAlive: dialKeepAlive}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if override, ok := overrides[addr]; ok {
+			addr = override
+		}
+		return dialWithTimeout(ctx, dialer, network, addr)
+	}
+
+	return &http.Client{Transport: t}, nil
+}
+
+// net/httpのDefaultTransportと同じ値
+const dialKeepAlive = 30 * time.Second
+
+func (tc TransportConfig) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify}
+
+	if tc.CACert != "" {
+		pem, err := os.ReadFile(tc.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("ca-cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca-cert: no certificates found in %s", tc.CACert)
+		}
+		c.RootCAs = pool
+	}
+
+	if tc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(tc.ClientCert, tc.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client-cert: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q: want http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// parseResolve parses curl-style "host:port:addr" entries into a map from
+// "host:port" to the address to dial instead.
+func parseResolve(entries []string) (map[string]string, error) {
+	m := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		host, rest, ok1 := strings.Cut(entry, ":")
+		port, addr, ok2 := strings.Cut(rest, ":")
+		if !ok1 || !ok2 || host == "" || port == "" || addr == "" {
+			return nil, fmt.Errorf("invalid entry %q: want host:port:addr", entry)
+		}
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid entry %q: %q is not an IP address", entry, addr)
+		}
+		m[net.JoinHostPort(host, port)] = net.JoinHostPort(addr, port)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewHTTPClient_CACertAndResolve(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	tc := defaultTransportConfig()
+	tc.CACert = caFile
+	// httptestの証明書はexample.comに対して発行されている
+	tc.Resolve = []string{fmt.Sprintf("example.com:%s:127.0.0.1", port)}
+
+	client, err := NewHTTPClient(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(fmt.Sprintf("https://example.com:%s/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// プロキシには絶対URLでリクエストが届く
+		fmt.Fprintf(w, "proxied %s", r.URL)
+	}))
+	defer proxy.Close()
+
+	tc := defaultTransportConfig()
+	tc.Proxy = proxy.URL
+	client, err := NewHTTPClient(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://upstream.invalid/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := "proxied http://upstream.invalid/file"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestParseResolve(t *testing.T) {
+	tests := map[string]struct {
+		entry   string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		"ipv4":        {entry: "example.com:443:10.0.0.1", key: "example.com:443", want: "10.0.0.1:443"},
+		"ipv6":        {entry: "example.com:80:[::1]", key: "example.com:80", want: "[::1]:80"},
+		"missing":     {entry: "example.com:443", wantErr: true},
+		"not an addr": {entry: "example.com:443:other.host", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := parseResolve([]string{tt.entry})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && m[tt.key] != tt.want {
+				t.Errorf("m[%q] = %q, want %q", tt.key, m[tt.key], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/term"
+)
+
+const (
+	dashboardRefresh = 250 * time.Millisecond
+	dashboardLogSize = 100
+	// speedSampleInterval より短い間隔の進捗では速度を更新しない
+	speedSampleInterval = 500 * time.Millisecond
+
+	altScreenOn  = "\x1b[?1049h\x1b[?25l"
+	altScreenOff = "\x1b[?25h\x1b[?1049l"
+	clearLine    = "\x1b[K"
+	reverseVideo = "\x1b[7m"
+	resetStyle   = "\x1b[0m"
+)
+
+// TaskControls are the per-download operations of the dashboard.
+// DownloadController implements it.
+type TaskControls interface {
+	Cancel(url string) bool
+	Retry(url string) bool
+	Prioritize(url string) bool
+	Pause(url string) bool
+	Resume(url string) bool
+}
+
+type taskState int
+
+const (
+	stateQueued taskState = iota
+	stateDownloading
+	stateDone
+	stateUnchanged
+	stateFailed
+	stateCanceled
+)
+
+func (s taskState) String() string {
+	switch s {
+	case stateQueued:
+		return "queued"
+	case stateDownloading:
+		return "downloading"
+	case stateDone:
+		return "done"
+	case stateUnchanged:
+		return "unchanged"
+	case stateFailed:
+		return "failed"
+	case stateCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+type taskRow struct {
+	url   string
+	seq   int
+	state taskState
+
+	current  int64
+	total    int64
+	speed    float64
+	attempts int
+	err      error
+	paused   bool
+
+	// 直近の速度を測るための前回のサンプル
+	sampleAt    time.Time
+	sampleBytes int64
+}
+
+// status は一時停止中のダウンロードを "paused" と表示する
+func (r *taskRow) status() string {
+	if r.paused && r.state == stateDownloading {
+		return "paused"
+	}
+	return r.state.String()
+}
+
+func (r *taskRow) progress() float64 {
+	if r.total <= 0 {
+		return 0
+	}
+	return float64(r.current) / float64(r.total)
+}
+
+type sortKey int
+
+const (
+	sortQueue sortKey = iota
+	sortState
+	sortProgress
+	sortSpeed
+	sortSize
+	sortURL
+	numSortKeys
+)
+
+func (k sortKey) String() string {
+	return [...]string{"queue", "state", "progress", "speed", "size", "url"}[k]
+}
+
+// Dashboard is the full-screen view of --tui. It shows every download in a
+// table built from the Event stream, with a log of retries and failures,
+// and sends the keys pressed to TaskControls.
+type Dashboard struct {
+	ctl TaskControls
+	// interrupt は q や Ctrl-C で呼ばれる。端末がrawモードの間はSIGINTが届かないため
+	interrupt func()
+	now       func() time.Time
+
+	mu       sync.Mutex
+	rows     map[string]*taskRow
+	logs     []string
+	sortBy   sortKey
+	reverse  bool
+	selected string
+	offset   int
+	draining bool
+	paused   bool
+	message  string
+}
+
+func NewDashboard(ctl TaskControls, interrupt func()) *Dashboard {
+	return &Dashboard{
+		ctl:       ctl,
+		interrupt: interrupt,
+		now:       time.Now,
+		rows:      make(map[string]*taskRow),
+	}
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (d *Dashboard) HandleEvent(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch e := event.(type) {
+	case EventQueued:
+		r := d.row(e.URL)
+		r.state = stateQueued
+	case EventStart:
+		r := d.row(e.URL)
+		r.state = stateDownloading
+		r.attempts++
+		r.current, r.total, r.speed = 0, 0, 0
+		r.sampleAt, r.sampleBytes = d.now(), 0
+	case EventProgress:
+		r := d.row(e.URL)
+		if e.Total > 0 {
+			r.total = e.Total
+		}
+		r.current = e.Current
+		d.sampleSpeed(r)
+	case EventRetry:
+		r := d.row(e.URL)
+		r.attempts++
+		r.err = e.Err
+		d.log("retry %s: %s", e.URL, oneLine(e.Err))
+	case EventEnd:
+		r := d.row(e.URL)
+		r.state = stateDone
+		r.current = e.CurrentSize
+		r.err = nil
+	case EventUnchanged:
+		r := d.row(e.URL)
+		r.state = stateUnchanged
+	case EventChanged:
+		d.log("changed %s", e.URL)
+	case EventAbort:
+		r := d.row(e.URL)
+		r.state = stateFailed
+		if errors.Is(e.Err, ErrCanceled) {
+			r.state = stateCanceled
+		}
+		r.err = e.Err
+		d.log("abort %s: %s", e.URL, oneLine(e.Err))
+	case EventDiskFull:
+		r := d.row(e.URL)
+		r.state = stateFailed
+		r.err = e.Err
+		d.log("disk full %s: %s", e.URL, oneLine(e.Err))
+	case EventHook:
+		if e.Err != nil {
+			d.log("%s hook %s: %s", e.Kind, e.URL, oneLine(e.Err))
+		}
+	case EventDrain:
+		d.draining = true
+		d.log("no new downloads will start; waiting for the ones in progress")
+	case EventPause:
+		if e.URL == "" {
+			d.paused = true
+			d.log("paused all downloads")
+		} else {
+			d.row(e.URL).paused = true
+			d.log("paused %s", e.URL)
+		}
+	case EventResume:
+		if e.URL == "" {
+			d.paused = false
+			d.log("resumed all downloads")
+		} else {
+			d.row(e.URL).paused = false
+			d.log("resumed %s", e.URL)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected main.Event: %#v", event))
+	}
+}
+
+// row はURLの行を返す。初めてのURLなら追加する
+func (d *Dashboard) row(url string) *taskRow {
+	r, ok := d.rows[url]
+	if !ok {
+		r = &taskRow{url: url, seq: len(d.rows)}
+		d.rows[url] = r
+	}
+	return r
+}
+
+func (d *Dashboard) sampleSpeed(r *taskRow) {
+	now := d.now()
+	elapsed := now.Sub(r.sampleAt)
+	if elapsed < speedSampleInterval {
+		return
+	}
+	// リトライで最初から受信し直した場合
+	if r.current < r.sampleBytes {
+		r.sampleBytes = 0
+	}
+	speed := float64(r.current-r.sampleBytes) / elapsed.Seconds()
+	if r.speed == 0 {
+		r.speed = speed
+	} else {
+		r.speed = 0.7*r.speed + 0.3*speed
+	}
+	r.sampleAt, r.sampleBytes = now, r.current
+}
+
+func (d *Dashboard) log(format string, args ...any) {
+	line := d.now().Format("15:04:05 ") + fmt.Sprintf(format, args...)
+	d.logs = append(d.logs, line)
+	if len(d.logs) > dashboardLogSize {
+		d.logs = d.logs[len(d.logs)-dashboardLogSize:]
+	}
+}
+
+// Run draws the dashboard on out and reads keys from in until ctx is done.
+// Both must be terminals.
+func (d *Dashboard) Run(ctx context.Context, in, out *os.File) error {
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return fmt.Errorf("tui: %w", err)
+	}
+	defer term.Restore(int(in.Fd()), state)
+	fmt.Fprint(out, altScreenOn)
+	defer fmt.Fprint(out, altScreenOff)
+
+	input, err := openKeyInput(in)
+	if err != nil {
+		return fmt.Errorf("tui: %w", err)
+	}
+	defer input.Close()
+	keys := make(chan string)
+	go readKeys(input, keys, ctx.Done())
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+
+	for {
+		width, height, err := term.GetSize(int(out.Fd()))
+		if err != nil {
+			width, height = 120, 40
+		}
+		d.Render(out, width, height)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case k := <-keys:
+			d.HandleKey(k, height)
+		case <-ticker.C:
+		}
+	}
+}
+
+// readKeys は入力をキーの名前に変換して送る。矢印キーなどは "up" のような名前になる
+func readKeys(in io.Reader, keys chan<- string, done <-chan struct{}) {
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			select {
+			case keys <- k:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+var escapeKeys = map[string]string{
+	"\x1b[A":  "up",
+	"\x1b[B":  "down",
+	"\x1b[5~": "pgup",
+	"\x1b[6~": "pgdn",
+	"\x1b[H":  "home",
+	"\x1b[F":  "end",
+}
+
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		matched := false
+		for seq, name := range escapeKeys {
+			if bytes.HasPrefix(b, []byte(seq)) {
+				keys = append(keys, name)
+				b = b[len(seq):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		switch b[0] {
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		case 0x1b:
+			// 知らないエスケープシーケンスは残りごと捨てる
+			return keys
+		default:
+			keys = append(keys, string(b[0]))
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// HandleKey applies a key read by Run. height is that of the terminal.
+func (d *Dashboard) HandleKey(key string, height int) {
+	d.mu.Lock()
+	rows := d.sortedRows()
+	i := d.selectedIndex(rows)
+	page := max(d.tableHeight(height), 1)
+
+	switch key {
+	case "up", "k":
+		i--
+	case "down", "j":
+		i++
+	case "pgup":
+		i -= page
+	case "pgdn":
+		i += page
+	case "home", "g":
+		i = 0
+	case "end", "G":
+		i = len(rows) - 1
+	case "s":
+		d.sortBy = (d.sortBy + 1) % numSortKeys
+	case "S":
+		d.reverse = !d.reverse
+	}
+	if len(rows) > 0 {
+		i = min(max(i, 0), len(rows)-1)
+		d.selected = rows[i].url
+	}
+	url := d.selected
+	paused := false
+	if r, ok := d.rows[url]; ok {
+		paused = r.paused
+	}
+	d.mu.Unlock()
+
+	// TaskControlsはイベントを発行するので、ロックを外してから呼ぶ
+	var op string
+	var ok bool
+	switch key {
+	case "c":
+		op, ok = "cancel", d.ctl.Cancel(url)
+	case "r":
+		op, ok = "retry", d.ctl.Retry(url)
+	case "p":
+		op, ok = "prioritize", d.ctl.Prioritize(url)
+	case " ":
+		if paused {
+			op, ok = "resume", d.ctl.Resume(url)
+		} else {
+			op, ok = "pause", d.ctl.Pause(url)
+		}
+	case "q", "ctrl-c":
+		d.interrupt()
+		return
+	default:
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ok {
+		d.message = fmt.Sprintf("%s: %s", op, url)
+	} else {
+		d.message = fmt.Sprintf("cannot %s %s in its current state", op, url)
+	}
+}
+
+func (d *Dashboard) sortedRows() []*taskRow {
+	rows := make([]*taskRow, 0, len(d.rows))
+	for _, r := range d.rows {
+		rows = append(rows, r)
+	}
+
+	less := func(a, b *taskRow) bool {
+		switch d.sortBy {
+		case sortState:
+			if a.state != b.state {
+				return a.state < b.state
+			}
+		case sortProgress:
+			if a.progress() != b.progress() {
+				return a.progress() > b.progress()
+			}
+		case sortSpeed:
+			if a.speed != b.speed {
+				return a.speed > b.speed
+			}
+		case sortSize:
+			if a.total != b.total {
+				return a.total > b.total
+			}
+		case sortURL:
+			if a.url != b.url {
+				return a.url < b.url
+			}
+		}
+		return a.seq < b.seq
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if d.reverse {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+	return rows
+}
+
+func (d *Dashboard) selectedIndex(rows []*taskRow) int {
+	for i, r := range rows {
+		if r.url == d.selected {
+			return i
+		}
+	}
+	return 0
+}
+
+// 見出し2行、表の見出し、区切り線、メッセージの5行とログを除いた高さ
+func (d *Dashboard) tableHeight(height int) int {
+	return height - 5 - d.logHeight(height)
+}
+
+func (d *Dashboard) logHeight(height int) int {
+	return min(8, max(height/4, 1))
+}
+
+// Render draws one frame of width x height.
+func (d *Dashboard) Render(w io.Writer, width, height int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows := d.sortedRows()
+	counts := make(map[taskState]int)
+	for _, r := range rows {
+		counts[r.state]++
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	line := func(s string) {
+		buf.WriteString(truncate(s, width))
+		buf.WriteString(clearLine + "\r\n")
+	}
+
+	status := fmt.Sprintf("downloader  done %d/%d  downloading %d  queued %d  failed %d",
+		counts[stateDone]+counts[stateUnchanged], len(rows), counts[stateDownloading], counts[stateQueued], counts[stateFailed]+counts[stateCanceled])
+	switch {
+	case d.draining:
+		status += "  [draining]"
+	case d.paused:
+		status += "  [paused]"
+	case len(rows) > 0 && counts[stateDownloading] == 0 && counts[stateQueued] == 0:
+		status += "  [finished: press q to quit]"
+	}
+	line(status)
+	order := "asc"
+	if d.reverse {
+		order = "desc"
+	}
+	line(fmt.Sprintf("↑/↓ select  s sort: %s  S %s  c cancel  r retry  p prioritize  space pause  q quit", d.sortBy, order))
+
+	// URLとエラーで残りの幅を分ける
+	const fixed = 11 + 1 + 5 + 1 + 10 + 1 + 10 + 1 + 5 + 1
+	urlWidth := max((width-fixed)/2, 10)
+	rowFormat := fmt.Sprintf("%%-11s %%5s %%10s %%10s %%5s %%-%d.%ds %%s", urlWidth, urlWidth)
+	line(fmt.Sprintf(rowFormat, "STATE", "DONE", "SIZE", "SPEED", "TRIES", "URL", "ERROR"))
+
+	tableHeight := max(d.tableHeight(height), 1)
+	selected := d.selectedIndex(rows)
+	if selected < d.offset {
+		d.offset = selected
+	}
+	if selected >= d.offset+tableHeight {
+		d.offset = selected - tableHeight + 1
+	}
+	d.offset = min(d.offset, max(len(rows)-tableHeight, 0))
+
+	for i := d.offset; i < d.offset+tableHeight; i++ {
+		if i >= len(rows) {
+			line("")
+			continue
+		}
+		r := rows[i]
+		s := fmt.Sprintf(rowFormat, r.status(), formatPercent(r), formatSize(r.total), formatSpeed(r), fmt.Sprint(r.attempts), r.url, oneLine(r.err))
+		if i == selected {
+			buf.WriteString(reverseVideo + truncate(s, width) + resetStyle + clearLine + "\r\n")
+			continue
+		}
+		line(s)
+	}
+
+	line(strings.Repeat("─", max(width, 0)))
+	logs := d.logs[max(len(d.logs)-d.logHeight(height), 0):]
+	for i := range d.logHeight(height) {
+		if i < len(logs) {
+			line(logs[i])
+		} else {
+			line("")
+		}
+	}
+	buf.WriteString(truncate(d.message, width) + clearLine)
+
+	w.Write(buf.Bytes())
+}
+
+func formatPercent(r *taskRow) string {
+	switch {
+	case r.state == stateDone || r.state == stateUnchanged:
+		return "100%"
+	case r.total <= 0:
+		return "-"
+	default:
+		return fmt.Sprintf("%d%%", int(r.progress()*100))
+	}
+}
+
+func formatSize(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("% .1f", decor.SizeB1024(n))
+}
+
+func formatSpeed(r *taskRow) string {
+	if r.state != stateDownloading || r.paused || r.speed <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("% .1f/s", decor.SizeB1024(int64(r.speed)))
+}
+
+// oneLine は複数行のエラーを1行にまとめる
+func oneLine(err error) string {
+	if err == nil {
+		return ""
+	}
+	return strings.ReplaceAll(err.Error(), "\n", "; ")
+}
+
+// truncate はエスケープシーケンスを含まない s を width 文字に切り詰める
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width])
+}
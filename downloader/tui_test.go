@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeControls struct {
+	calls []string
+}
+
+func (f *fakeControls) Cancel(url string) bool {
+	f.calls = append(f.calls, "cancel "+url)
+	return true
+}
+
+func (f *fakeControls) Retry(url string) bool {
+	f.calls = append(f.calls, "retry "+url)
+	return false
+}
+
+func (f *fakeControls) Prioritize(url string) bool {
+	f.calls = append(f.calls, "prioritize "+url)
+	return true
+}
+
+func (f *fakeControls) Pause(url string) bool {
+	f.calls = append(f.calls, "pause "+url)
+	return true
+}
+
+func (f *fakeControls) Resume(url string) bool {
+	f.calls = append(f.calls, "resume "+url)
+	return true
+}
+
+var escapeSeq = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// render は1フレームを描画し、エスケープシーケンスを除いた行を返す
+func render(d *Dashboard, width, height int) []string {
+	var buf bytes.Buffer
+	d.Render(&buf, width, height)
+	return strings.Split(escapeSeq.ReplaceAllString(buf.String(), ""), "\r\n")
+}
+
+func newTestDashboard() (*Dashboard, *fakeControls, *int) {
+	ctl := &fakeControls{}
+	interrupts := new(int)
+	d := NewDashboard(ctl, func() { *interrupts++ })
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	for _, e := range []Event{
+		EventQueued{URL: "https://example.com/a"},
+		EventQueued{URL: "https://example.com/b"},
+		EventQueued{URL: "https://example.com/c"},
+		EventStart{URL: "https://example.com/a"},
+		EventProgress{URL: "https://example.com/a", Current: 512, Total: 1024},
+		EventStart{URL: "https://example.com/b"},
+		EventRetry{URL: "https://example.com/b", Err: errors.New("connection reset")},
+		EventAbort{URL: "https://example.com/b", Err: errors.New("gave up\nafter 2 attempts")},
+	} {
+		d.HandleEvent(e)
+	}
+	return d, ctl, interrupts
+}
+
+func TestDashboard_Render(t *testing.T) {
+	d, _, _ := newTestDashboard()
+	lines := render(d, 120, 16)
+
+	if len(lines) != 16 {
+		t.Fatalf("%d lines, want 16", len(lines))
+	}
+	if want := "downloader  done 0/3  downloading 1  queued 1  failed 1"; lines[0] != want {
+		t.Errorf("status = %q, want %q", lines[0], want)
+	}
+	fields := func(s string) []string { return strings.Fields(s) }
+	want := [][]string{
+		{"downloading", "50%", "1.0", "KiB", "-", "1", "https://example.com/a"},
+		{"failed", "-", "-", "-", "2", "https://example.com/b", "gave", "up;", "after", "2", "attempts"},
+		{"queued", "-", "-", "-", "0", "https://example.com/c"},
+	}
+	for i, w := range want {
+		if diff := cmp.Diff(w, fields(lines[3+i])); diff != "" {
+			t.Errorf("row %d mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "12:00:00 retry https://example.com/b: connection reset") {
+		t.Errorf("log does not contain the retry:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestDashboard_HandleKey(t *testing.T) {
+	d, ctl, interrupts := newTestDashboard()
+
+	// 並べ替えても選択中の行は変わらない。状態順では c, a, b の順になる
+	for _, k := range []string{"s", "c", "down", "r", "home", "p", "q"} {
+		d.HandleKey(k, 16)
+	}
+	want := []string{
+		"cancel https://example.com/a",
+		"retry https://example.com/b",
+		"prioritize https://example.com/c",
+	}
+	if diff := cmp.Diff(want, ctl.calls); diff != "" {
+		t.Errorf("calls mismatch (-want +got):\n%s", diff)
+	}
+	if *interrupts != 1 {
+		t.Errorf("%d interrupts, want 1", *interrupts)
+	}
+	if lines := render(d, 120, 16); lines[15] != "prioritize: https://example.com/c" {
+		t.Errorf("message = %q", lines[15])
+	}
+}
+
+func TestDashboard_Pause(t *testing.T) {
+	d, ctl, _ := newTestDashboard()
+	d.HandleEvent(EventPause{})
+	d.HandleEvent(EventPause{URL: "https://example.com/a"})
+
+	lines := render(d, 120, 16)
+	if want := "downloader  done 0/3  downloading 1  queued 1  failed 1  [paused]"; lines[0] != want {
+		t.Errorf("status = %q, want %q", lines[0], want)
+	}
+	if got := strings.Fields(lines[3]); got[0] != "paused" || got[4] != "-" {
+		t.Errorf("row of a = %q, want paused without speed", lines[3])
+	}
+
+	// space は一時停止中なら再開し、そうでなければ一時停止する
+	d.HandleKey(" ", 16)
+	d.HandleEvent(EventResume{URL: "https://example.com/a"})
+	d.HandleKey(" ", 16)
+	want := []string{
+		"resume https://example.com/a",
+		"pause https://example.com/a",
+	}
+	if diff := cmp.Diff(want, ctl.calls); diff != "" {
+		t.Errorf("calls mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("j\x1b[A\x1b[6~\x03q\x1b[Zx"))
+	want := []string{"j", "up", "pgdn", "ctrl-c", "q"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseKeys mismatch (-want +got):\n%s", diff)
+	}
+}
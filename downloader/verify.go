@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// hashes はチェックサムに使えるアルゴリズム。強いものから順に並ぶ
+var hashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+func newHash(algorithm string) (hash.Hash, bool) {
+	for _, h := range hashes {
+		if h.name == algorithm {
+			return h.new(), true
+		}
+	}
+	return nil, false
+}
+
+// Checksum is the expected digest of a file.
+type Checksum struct {
+	// Name は一覧に書かれた名前で、Path はそれを検証するファイル
+	Name      string
+	Path      string
+	Algorithm string
+	Sum       []byte
+}
+
+// bsdChecksum は "SHA256 (name) = hex" の形式の行
+var bsdChecksum = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.*)\) = ([0-9A-Fa-f]+)$`)
+
+// ParseChecksums reads a checksum list in the format of sha256sum and its
+// relatives ("HEX  NAME"), or in the BSD format ("SHA256 (NAME) = HEX").
+// The algorithm of the first format is told by the length of the digest.
+// path gives the file to verify for each name.
+func ParseChecksums(r io.Reader, path func(name string) string) ([]Checksum, error) {
+	var sums []Checksum
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseChecksum(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		c.Path = path(c.Name)
+		sums = append(sums, c)
+	}
+	return sums, sc.Err()
+}
+
+func parseChecksum(line string) (Checksum, error) {
+	var c Checksum
+	var sum string
+	if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+		c.Algorithm = strings.ToLower(strings.ReplaceAll(m[1], "-", ""))
+		c.Name, sum = m[2], m[3]
+	} else {
+		var rest string
+		var ok bool
+		sum, rest, ok = strings.Cut(line, " ")
+		if !ok {
+			return Checksum{}, fmt.Errorf("invalid checksum %q: want \"HEX  NAME\"", line)
+		}
+		// "*" はバイナリモードの印
+		c.Name = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "*")
+		switch len(sum) {
+		case 32:
+			c.Algorithm = "md5"
+		case 40:
+			c.Algorithm = "sha1"
+		case 64:
+			c.Algorithm = "sha256"
+		case 96:
+			c.Algorithm = "sha384"
+		case 128:
+			c.Algorithm = "sha512"
+		default:
+			return Checksum{}, fmt.Errorf("invalid checksum %q: unknown digest length %d", sum, len(sum))
+		}
+	}
+
+	h, ok := newHash(c.Algorithm)
+	if !ok {
+		return Checksum{}, fmt.Errorf("unsupported algorithm %q", c.Algorithm)
+	}
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s digest %q", c.Algorithm, sum)
+	}
+	c.Sum = b
+	return c, nil
+}
+
+// MetalinkChecksums returns the strongest hash given for each file of a
+// Metalink document. The files are looked for where FileSaver saves their
+// first URL, under dir. A file without a supported hash has no Algorithm,
+// and fails to verify.
+func MetalinkChecksums(r io.Reader, dir string) ([]Checksum, error) {
+	files, err := readMetalink(r)
+	if err != nil {
+		return nil, err
+	}
+	saver := NewFileSaver(dir, NewOSFS())
+
+	var sums []Checksum
+	for _, f := range files {
+		c := strongestHash(f.hashes)
+		c.Name = f.name
+		c.Path = saver.Path(f.task.url)
+		sums = append(sums, c)
+	}
+	return sums, nil
+}
+
+// strongestHash は対応するハッシュがなければ Algorithm が空の Checksum を返す
+func strongestHash(hs []metalinkHash) Checksum {
+	for _, h := range hashes {
+		for _, mh := range hs {
+			// Metalink の種類は "sha-256" のように書く
+			if strings.ReplaceAll(strings.ToLower(mh.Type), "-", "") != h.name {
+				continue
+			}
+			sum, err := hex.DecodeString(strings.TrimSpace(mh.Sum))
+			if err != nil || len(sum) != h.new().Size() {
+				continue
+			}
+			return Checksum{Algorithm: h.name, Sum: sum}
+		}
+	}
+	return Checksum{}
+}
+
+// ChecksumError means that the digest of a file differs from the expected one.
+type ChecksumError struct {
+	Path      string
+	Algorithm string
+	Want      []byte
+	Got       []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: %s mismatch: got %x, want %x", e.Path, e.Algorithm, e.Got, e.Want)
+}
+
+// Verify hashes the file of c and compares it with the expected digest.
+// A file with another digest results in ChecksumError.
+func (c Checksum) Verify() error {
+	if c.Algorithm == "" {
+		return errors.New("no supported hash")
+	}
+	h, ok := newHash(c.Algorithm)
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", c.Algorithm)
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, c.Sum) {
+		return &ChecksumError{Path: c.Path, Algorithm: c.Algorithm, Want: c.Sum, Got: sum}
+	}
+	return nil
+}
+
+// checksumPath は一覧の名前を検証するファイルに変換する。
+// URLはダウンロードした時と同じく dir の下のファイルになる。
+func checksumPath(dir string) func(name string) string {
+	saver := NewFileSaver(dir, NewOSFS())
+	return func(name string) string {
+		if !strings.Contains(name, "://") {
+			return name
+		}
+		if url, err := NormalizeURL(name); err == nil {
+			return saver.Path(url)
+		}
+		return name
+	}
+}
+
+type verifyFlags struct {
+	outputDir string
+	metalinks listFlag
+	quiet     bool
+}
+
+func newVerifyFlagSet() (*flag.FlagSet, *verifyFlags) {
+	flags := flag.NewFlagSet("downloader verify", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+
+	vf := &verifyFlags{}
+	flags.StringVar(&vf.outputDir, "output-dir", defaultOutputDir, "directory of the files listed by URL")
+	flags.Var(&vf.metalinks, "metalink", "verify the files of this Metalink v4 file against its hashes (repeatable)")
+	flags.BoolVar(&vf.quiet, "quiet", false, "only print the files that failed")
+	return flags, vf
+}
+
+// runVerify implements the verify command.
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	flags, vf := newVerifyFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return commandError("verify", &usageError{err}, stdout, stderr)
+	}
+	if flags.NArg() == 0 && len(vf.metalinks) == 0 {
+		return commandError("verify", &usageError{errors.New("no checksum list or metalink given")}, stdout, stderr)
+	}
+
+	var sums []Checksum
+	for _, name := range flags.Args() {
+		s, err := readChecksumFile(name, checksumPath(vf.outputDir))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		sums = append(sums, s...)
+	}
+	for _, name := range vf.metalinks {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		s, err := MetalinkChecksums(f, vf.outputDir)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			return exitUsage
+		}
+		sums = append(sums, s...)
+	}
+
+	failed := 0
+	for _, c := range sums {
+		name := c.Name
+		if c.Path != c.Name {
+			name = fmt.Sprintf("%s (%s)", c.Name, c.Path)
+		}
+		err := c.Verify()
+		switch {
+		case errors.As(err, new(*ChecksumError)):
+			failed++
+			fmt.Fprintf(stdout, "%s: FAILED\n", name)
+		case err != nil:
+			failed++
+			fmt.Fprintf(stdout, "%s: FAILED (%v)\n", name, err)
+		case !vf.quiet:
+			fmt.Fprintf(stdout, "%s: OK\n", name)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(stderr, "%d of %d files failed verification\n", failed, len(sums))
+	}
+	return failureStatus(failed, len(sums))
+}
+
+// readChecksumFile は name のチェックサムの一覧を読む。"-" は標準入力
+func readChecksumFile(name string, path func(string) string) ([]Checksum, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	sums, err := ParseChecksums(r, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return sums, nil
+}
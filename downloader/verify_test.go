@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksums(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "b.txt": "bravo", "c.txt": "charlie"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha := sha256.Sum256([]byte("alpha"))
+	sum := md5.Sum([]byte("bravo"))
+	wrong := sha512.Sum512([]byte("not charlie"))
+	list := strings.Join([]string{
+		"# comment",
+		hex.EncodeToString(sha[:]) + "  a.txt",
+		"MD5 (b.txt) = " + hex.EncodeToString(sum[:]),
+		hex.EncodeToString(wrong[:]) + " *c.txt",
+		hex.EncodeToString(sha[:]) + "  missing.txt",
+	}, "\n")
+
+	sums, err := ParseChecksums(strings.NewReader(list), func(name string) string { return filepath.Join(dir, name) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name, algorithm string
+		ok, mismatch    bool
+	}{
+		{"a.txt", "sha256", true, false},
+		{"b.txt", "md5", true, false},
+		{"c.txt", "sha512", false, true},
+		{"missing.txt", "sha256", false, false},
+	}
+	if len(sums) != len(want) {
+		t.Fatalf("got %d checksums, want %d", len(sums), len(want))
+	}
+	for i, w := range want {
+		c := sums[i]
+		err := c.Verify()
+		var mismatch *ChecksumError
+		if c.Name != w.name || c.Algorithm != w.algorithm || (err == nil) != w.ok || errors.As(err, &mismatch) != w.mismatch {
+			t.Errorf("%d: %s %s = %v; want %s %s, ok %v, mismatch %v", i, c.Name, c.Algorithm, err, w.name, w.algorithm, w.ok, w.mismatch)
+		}
+	}
+	var mismatch *ChecksumError
+	if errors.As(sums[2].Verify(), &mismatch) && !bytes.Equal(mismatch.Want, wrong[:]) {
+		t.Errorf("want = %x, want the listed digest", mismatch.Want)
+	}
+}
+
+func TestParseChecksums_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no name":        "d41d8cd98f00b204e9800998ecf8427e",
+		"length":         "abcd  a.txt",
+		"not hex":        strings.Repeat("z", 32) + "  a.txt",
+		"unknown bsd":    "CRC32 (a.txt) = 12345678",
+		"short bsd hash": "SHA256 (a.txt) = d41d8cd98f00b204e9800998ecf8427e",
+	}
+	for name, line := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseChecksums(strings.NewReader("\n"+line+"\n"), func(name string) string { return name })
+			if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+				t.Errorf("err = %v, want an error on line 2", err)
+			}
+		})
+	}
+}
+
+func TestMetalinkChecksums(t *testing.T) {
+	sha := sha256.Sum256([]byte("alpha"))
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.iso">
+    <hash type="md5">00000000000000000000000000000000</hash>
+    <hash type="sha-256">` + hex.EncodeToString(sha[:]) + `</hash>
+    <url>https://example.com/a.iso</url>
+  </file>
+  <file name="b.iso">
+    <hash type="crc32">12345678</hash>
+    <url>https://example.com/b.iso</url>
+  </file>
+</metalink>`
+
+	dir := t.TempDir()
+	sums, err := MetalinkChecksums(strings.NewReader(doc), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 {
+		t.Fatalf("got %d checksums, want 2", len(sums))
+	}
+
+	// md5 より強い sha-256 で検証する
+	a := sums[0]
+	if a.Name != "a.iso" || a.Algorithm != "sha256" || !bytes.Equal(a.Sum, sha[:]) {
+		t.Errorf("a.iso = %+v, want its sha-256", a)
+	}
+	if want := NewFileSaver(dir, NewOSFS()).Path("https://example.com/a.iso"); a.Path != want {
+		t.Errorf("path = %s, want %s", a.Path, want)
+	}
+	if err := os.WriteFile(a.Path, []byte("alpha"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+
+	if err := sums[1].Verify(); err == nil || !strings.Contains(err.Error(), "no supported hash") {
+		t.Errorf("b.iso: err = %v, want no supported hash", err)
+	}
+}
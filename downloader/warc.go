@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/no-yan/multierr"
+)
+
+const (
+	defaultWARCPrefix  = "downloader"
+	defaultWARCMaxSize = 1 << 30
+
+	warcVersion = "WARC/1.1"
+	// 書き込み中のWARCファイルの接尾辞。閉じたときに外す
+	warcOpenSuffix = ".open"
+)
+
+// WARCConfig is the configuration of the WARC output.
+type WARCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Prefix は出力するファイル名の先頭
+	Prefix string `yaml:"prefix"`
+	// Gzip はレコードごとに gzip で圧縮する
+	Gzip bool `yaml:"gzip"`
+	// MaxSize バイトを超えたら次のファイルに切り替える。0なら切り替えない
+	MaxSize int64 `yaml:"max-size"`
+}
+
+func defaultWARCConfig() WARCConfig {
+	return WARCConfig{Prefix: defaultWARCPrefix, Gzip: true, MaxSize: defaultWARCMaxSize}
+}
+
+func (wc WARCConfig) validate() error {
+	if !wc.Enabled {
+		return nil
+	}
+	m := multierr.New()
+
+	if wc.Prefix == "" || strings.ContainsRune(wc.Prefix, filepath.Separator) {
+		m.Add(fmt.Errorf("warc.prefix: must be a file name, got %q", wc.Prefix))
+	}
+	if wc.MaxSize < 0 {
+		m.Add(fmt.Errorf("warc.max-size: must not be negative, got %d", wc.MaxSize))
+	}
+	return m.Err()
+}
+
+// responseSaver is a Saver that also records the HTTP exchange of the
+// download. resp is the response whose body r continues, and its Request
+// is the request that was sent.
+type responseSaver interface {
+	SaveResponse(r io.Reader, resp *http.Response) (int64, error)
+}
+
+// WARCSaver writes every download as a request and a response record of a
+// WARC 1.1 file. Each file starts with a warcinfo record, and a new file is
+// started once it grows beyond the maximum size.
+//
+// The body is spooled to a temporary file first, since the length and digest
+// of a record are written before its content.
+type WARCSaver struct {
+	dir    string
+	config WARCConfig
+	// now はテストで時刻を固定するため
+	now func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	size   int64
+	serial int
+	// warcinfo は現在のファイルの warcinfo レコードのID
+	warcinfo string
+}
+
+func NewWARCSaver(dir string, config WARCConfig) *WARCSaver {
+	return &WARCSaver{dir: dir, config: config, now: time.Now}
+}
+
+// Save implements Saver for downloads without a response, which are
+// recorded as a resource record.
+func (s *WARCSaver) Save(r io.Reader, url string) (int64, error) {
+	return s.save(r, url, nil)
+}
+
+// SaveResponse implements responseSaver.
+func (s *WARCSaver) SaveResponse(r io.Reader, resp *http.Response) (int64, error) {
+	return s.save(r, resp.Request.URL.String(), resp)
+}
+
+func (s *WARCSaver) save(r io.Reader, url string, resp *http.Response) (int64, error) {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return 0, err
+	}
+	date := s.now().UTC()
+
+	var head []byte
+	if resp != nil {
+		head = responseHead(resp)
+	}
+	spool, err := spoolBody(s.dir, head)
+	if err != nil {
+		return 0, s.diskFull(err)
+	}
+	defer spool.remove()
+	if err := spool.copy(r); err != nil {
+		return spool.n, s.diskFull(err)
+	}
+
+	var records []*warcRecord
+	if resp == nil {
+		records = append(records, &warcRecord{
+			fields: warcFields{
+				{"WARC-Type", "resource"},
+				{"WARC-Target-URI", url},
+				{"Content-Type", "application/octet-stream"},
+				{"WARC-Payload-Digest", spool.payloadDigest()},
+			},
+			block: spool.reader(), length: spool.blockLength(), blockDigest: spool.blockDigest(),
+		})
+	} else {
+		request := requestHead(resp.Request)
+		responseID := newRecordID()
+		records = append(records,
+			&warcRecord{
+				id: responseID,
+				fields: warcFields{
+					{"WARC-Type", "response"},
+					{"WARC-Target-URI", url},
+					{"Content-Type", "application/http;msgtype=response"},
+					{"WARC-Payload-Digest", spool.payloadDigest()},
+				},
+				block: spool.reader(), length: spool.blockLength(), blockDigest: spool.blockDigest(),
+			},
+			&warcRecord{
+				fields: warcFields{
+					{"WARC-Type", "request"},
+					{"WARC-Target-URI", url},
+					{"WARC-Concurrent-To", responseID},
+					{"Content-Type", "application/http;msgtype=request"},
+				},
+				block: bytes.NewReader(request), length: int64(len(request)), blockDigest: digest(request),
+			},
+		)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeRecords(date, records); err != nil {
+		return spool.n, s.diskFull(err)
+	}
+	return spool.n, nil
+}
+
+func (s *WARCSaver) diskFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return &DiskFullError{Dir: s.dir, Err: err}
+	}
+	return err
+}
+
+// writeRecords は1つのダウンロードのレコードを同じファイルに続けて書く
+func (s *WARCSaver) writeRecords(date time.Time, records []*warcRecord) error {
+	if s.file != nil && s.config.MaxSize > 0 && s.size >= s.config.MaxSize {
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.openFile(date); err != nil {
+			return err
+		}
+	}
+	start := s.size
+	for _, rec := range records {
+		rec.fields = append(rec.fields, warcField{"WARC-Warcinfo-ID", s.warcinfo})
+		if err := s.writeRecord(date, rec); err != nil {
+			// 書きかけのレコードを残さないよう、このダウンロードの分を切り詰める
+			if s.file.Truncate(start) == nil {
+				s.file.Seek(start, io.SeekStart)
+				s.size = start
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WARCSaver) openFile(date time.Time) error {
+	ext := ".warc"
+	if s.config.Gzip {
+		ext += ".gz"
+	}
+	// 同じ秒に開始した別の実行と衝突したら次の番号を使う
+	for {
+		name := fmt.Sprintf("%s-%s-%05d%s", s.config.Prefix, date.Format("20060102150405"), s.serial, ext)
+		s.serial++
+		path := filepath.Join(s.dir, name)
+		f, err := os.OpenFile(path+warcOpenSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err == nil {
+			f.Close()
+			os.Remove(path + warcOpenSuffix)
+			continue
+		}
+		s.file, s.path, s.size = f, path, 0
+		break
+	}
+
+	info := []byte("software: downloader\r\nformat: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+	rec := &warcRecord{
+		id: newRecordID(),
+		fields: warcFields{
+			{"WARC-Type", "warcinfo"},
+			{"WARC-Filename", filepath.Base(s.path)},
+			{"Content-Type", "application/warc-fields"},
+		},
+		block: bytes.NewReader(info), length: int64(len(info)), blockDigest: digest(info),
+	}
+	s.warcinfo = rec.id
+	return s.writeRecord(date, rec)
+}
+
+func (s *WARCSaver) writeRecord(date time.Time, rec *warcRecord) error {
+	cw := &countingWriter{w: s.file}
+	bw := bufio.NewWriter(cw)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if s.config.Gzip {
+		// レコードごとに別の gzip メンバーにし、途中のレコードから読めるようにする
+		zw = gzip.NewWriter(bw)
+		w = zw
+	}
+
+	err := rec.write(w, date)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	s.size += cw.n
+	return err
+}
+
+// Close finishes the current WARC file.
+func (s *WARCSaver) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
+
+func (s *WARCSaver) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	f, path := s.file, s.path
+	s.file = nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+warcOpenSuffix, path)
+}
+
+// Dir implements spaceSaver.
+func (s *WARCSaver) Dir() string {
+	return s.dir
+}
+
+// FreeSpace implements spaceSaver.
+func (s *WARCSaver) FreeSpace() (int64, error) {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return 0, err
+	}
+	return diskFree(s.dir)
+}
+
+type warcField struct {
+	name, value string
+}
+
+type warcFields []warcField
+
+type warcRecord struct {
+	// id が空なら書き込み時に生成する
+	id          string
+	fields      warcFields
+	block       io.Reader
+	length      int64
+	blockDigest string
+}
+
+func (rec *warcRecord) write(w io.Writer, date time.Time) error {
+	if rec.id == "" {
+		rec.id = newRecordID()
+	}
+	var head bytes.Buffer
+	head.WriteString(warcVersion + "\r\n")
+	fields := append(warcFields{
+		{"WARC-Record-ID", rec.id},
+		{"WARC-Date", date.Format(time.RFC3339)},
+	}, rec.fields...)
+	fields = append(fields,
+		warcField{"WARC-Block-Digest", rec.blockDigest},
+		warcField{"Content-Length", fmt.Sprint(rec.length)},
+	)
+	for _, f := range fields {
+		fmt.Fprintf(&head, "%s: %s\r\n", f.name, f.value)
+	}
+	head.WriteString("\r\n")
+
+	if _, err := head.WriteTo(w); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, rec.block); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// newRecordID は WARC-Record-ID に使う UUID v4 の URN
+func newRecordID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func hashDigest(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// requestHead は送ったリクエストを HTTP/1.1 の形式で表す。
+// Transport が付けるヘッダーのうち Host と User-Agent だけを補う。
+func requestHead(req *http.Request) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	header := req.Header.Clone()
+	if _, ok := header["User-Agent"]; !ok {
+		header.Set("User-Agent", "Go-http-client/1.1")
+	}
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// responseHead は受け取ったレスポンスのステータス行とヘッダー。
+// ボディは転送符号化と圧縮を解いたものを書くので、それを表すヘッダーは含まない。
+func responseHead(resp *http.Response) []byte {
+	var b bytes.Buffer
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(&b, "%s %s\r\n", proto, resp.Status)
+	resp.Header.WriteSubset(&b, map[string]bool{"Transfer-Encoding": true})
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// bodySpool はボディを一時ファイルに書き、長さとダイジェストを求める
+type bodySpool struct {
+	file    *os.File
+	head    []byte
+	n       int64
+	payload hash.Hash
+	block   hash.Hash
+}
+
+func spoolBody(dir string, head []byte) (*bodySpool, error) {
+	f, err := os.CreateTemp(dir, ".warc-body-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &bodySpool{file: f, head: head, payload: sha1.New(), block: sha1.New()}
+	s.block.Write(head)
+	return s, nil
+}
+
+func (s *bodySpool) copy(r io.Reader) error {
+	var err error
+	s.n, err = io.Copy(io.MultiWriter(s.file, s.payload, s.block), r)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *bodySpool) blockLength() int64 {
+	return int64(len(s.head)) + s.n
+}
+
+func (s *bodySpool) reader() io.Reader {
+	return io.MultiReader(bytes.NewReader(s.head), s.file)
+}
+
+func (s *bodySpool) payloadDigest() string {
+	return hashDigest(s.payload)
+}
+
+func (s *bodySpool) blockDigest() string {
+	return hashDigest(s.block)
+}
+
+func (s *bodySpool) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+type parsedRecord struct {
+	header textproto.MIMEHeader
+	block  string
+}
+
+// readWARC はWARCファイルのレコードを順に読む
+func readWARC(t *testing.T, path string) []parsedRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		// gzip.Reader は連結されたメンバーを続けて読む
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	var records []parsedRecord
+	tr := textproto.NewReader(bufio.NewReader(r))
+	for {
+		line, err := tr.ReadLine()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil || line != warcVersion {
+			t.Fatalf("record starts with %q, %v", line, err)
+		}
+		header, err := tr.ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(header.Get("Content-Length"))
+		block := make([]byte, n+4)
+		if _, err := io.ReadFull(tr.R, block); err != nil {
+			t.Fatal(err)
+		}
+		if string(block[n:]) != "\r\n\r\n" {
+			t.Fatalf("record of %d bytes is not followed by CRLFCRLF", n)
+		}
+		records = append(records, parsedRecord{header: header, block: string(block[:n])})
+	}
+}
+
+func TestWARCSaver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "test")
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	saver := NewWARCSaver(dir, defaultWARCConfig())
+	source := NewSliceSource(*NewTask(ts.URL + "/a"))
+	dc := NewDownloadController(source, &defaultPolicy, pubsub.NewPublisher[Event](), saver, 1,
+		WithWorkerOptions(WithHeader(http.Header{"User-Agent": {"archiver"}})))
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".warc.gz") || !strings.HasPrefix(filepath.Base(files[0]), "downloader-") {
+		t.Fatalf("files = %v, want one finished .warc.gz", files)
+	}
+	records := readWARC(t, files[0])
+	if len(records) != 3 {
+		t.Fatalf("%d records, want warcinfo, response and request", len(records))
+	}
+	info, resp, req := records[0], records[1], records[2]
+
+	if info.header.Get("WARC-Type") != "warcinfo" || info.header.Get("WARC-Filename") != filepath.Base(files[0]) {
+		t.Errorf("warcinfo = %v", info.header)
+	}
+	for _, rec := range records[1:] {
+		if rec.header.Get("WARC-Warcinfo-ID") != info.header.Get("WARC-Record-ID") || rec.header.Get("WARC-Target-URI") != ts.URL+"/a" {
+			t.Errorf("record = %v", rec.header)
+		}
+		sum := sha1.Sum([]byte(rec.block))
+		if want := "sha1:" + base32.StdEncoding.EncodeToString(sum[:]); rec.header.Get("WARC-Block-Digest") != want {
+			t.Errorf("%s block digest = %s, want %s", rec.header.Get("WARC-Type"), rec.header.Get("WARC-Block-Digest"), want)
+		}
+	}
+
+	if resp.header.Get("WARC-Type") != "response" || resp.header.Get("Content-Type") != "application/http;msgtype=response" {
+		t.Errorf("response = %v", resp.header)
+	}
+	if !strings.HasPrefix(resp.block, "HTTP/1.1 200 OK\r\n") || !strings.Contains(resp.block, "X-Served-By: test\r\n") || !strings.HasSuffix(resp.block, "\r\n\r\nhello /a") {
+		t.Errorf("response block = %q", resp.block)
+	}
+	sum := sha1.Sum([]byte("hello /a"))
+	if want := "sha1:" + base32.StdEncoding.EncodeToString(sum[:]); resp.header.Get("WARC-Payload-Digest") != want {
+		t.Errorf("payload digest = %s, want %s", resp.header.Get("WARC-Payload-Digest"), want)
+	}
+
+	if req.header.Get("WARC-Type") != "request" || req.header.Get("WARC-Concurrent-To") != resp.header.Get("WARC-Record-ID") {
+		t.Errorf("request = %v", req.header)
+	}
+	if !strings.HasPrefix(req.block, "GET /a HTTP/1.1\r\nHost: "+ts.Listener.Addr().String()+"\r\n") || !strings.Contains(req.block, "User-Agent: archiver\r\n") {
+		t.Errorf("request block = %q", req.block)
+	}
+}
+
+func TestWARCSaver_Rotate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	// どのダウンロードも上限を超えるので、1件ごとにファイルが変わる
+	saver := NewWARCSaver(dir, WARCConfig{Prefix: "crawl", MaxSize: 1})
+	source := NewSliceSource(*NewTask(ts.URL + "/a"), *NewTask(ts.URL + "/b"))
+	dc := NewDownloadController(source, &defaultPolicy, pubsub.NewPublisher[Event](), saver, 1)
+	if err := dc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if open, _ := filepath.Glob(filepath.Join(dir, "*"+warcOpenSuffix)); len(open) != 1 {
+		t.Errorf("files being written = %v, want the current one", open)
+	}
+	if err := saver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("files = %v, want 2", files)
+	}
+	var bodies []string
+	for _, f := range files {
+		if !strings.HasPrefix(filepath.Base(f), "crawl-") || !strings.HasSuffix(f, ".warc") {
+			t.Errorf("file %s is not an uncompressed WARC with the prefix", f)
+		}
+		records := readWARC(t, f)
+		if len(records) != 3 || records[0].header.Get("WARC-Type") != "warcinfo" {
+			t.Fatalf("%s has %d records, want warcinfo, response and request", f, len(records))
+		}
+		_, body, _ := strings.Cut(records[1].block, "\r\n\r\n")
+		bodies = append(bodies, body)
+	}
+	if strings.Join(bodies, ",") != "/a,/b" {
+		t.Errorf("bodies = %v, want /a then /b", bodies)
+	}
+}
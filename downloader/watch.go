@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/no-yan/multierr"
+)
+
+const (
+	defaultWatchInterval = 5 * time.Minute
+	// 前の版のファイル名に付ける時刻の形式
+	versionTimeLayout = "20060102T150405Z"
+)
+
+// WatchConfig is the configuration of the watch command.
+type WatchConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	// Keep は内容が変わったときに残す前の版の数
+	Keep int `yaml:"keep"`
+}
+
+func defaultWatchConfig() WatchConfig {
+	return WatchConfig{Interval: defaultWatchInterval}
+}
+
+func (wc WatchConfig) validate() error {
+	m := multierr.New()
+
+	if wc.Interval <= 0 {
+		m.Add(fmt.Errorf("watch.interval: must be positive, got %s", wc.Interval))
+	}
+	if wc.Keep < 0 {
+		m.Add(fmt.Errorf("watch.keep: must not be negative, got %d", wc.Keep))
+	}
+	return m.Err()
+}
+
+// Change tells how a saved download relates to the previous version of
+// the same URL.
+type Change int
+
+const (
+	// ChangeNew は前の版がないことを表す
+	ChangeNew Change = iota
+	ChangeModified
+	ChangeNone
+)
+
+// versionSaver is a Saver that compares the download with the previous
+// version of the URL. An unchanged download is discarded.
+type versionSaver interface {
+	SaveVersion(r io.Reader, url string) (n int64, change Change, previous string, err error)
+}
+
+// VersionedSaver is a FileSaver that only replaces a file when its content
+// has changed, keeping up to keep previous versions next to it, named after
+// the time they were saved.
+type VersionedSaver struct {
+	*FileSaver
+	keep int
+}
+
+func NewVersionedSaver(fs *FileSaver, keep int) *VersionedSaver {
+	return &VersionedSaver{FileSaver: fs, keep: keep}
+}
+
+// SaveVersion implements versionSaver. previous is the file the replaced
+// version was kept as, if any.
+func (s *VersionedSaver) SaveVersion(r io.Reader, url string) (int64, Change, string, error) {
+	if err := s.ensureDir(); err != nil {
+		return 0, ChangeNew, "", err
+	}
+	path := s.Path(url)
+
+	f, err := os.OpenFile(path+partSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, ChangeNew, "", err
+	}
+	h := sha256.New()
+	body := &readErrRecorder{r: r}
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// 書き込めなかった .part は容量を使い続けないよう消す
+		if body.err == nil {
+			os.Remove(path + partSuffix)
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			err = &DiskFullError{Dir: s.dir, Err: err}
+		}
+		return n, ChangeNew, "", err
+	}
+
+	change := ChangeNew
+	info, err := os.Stat(path)
+	if err == nil {
+		old, err := fileHash(path)
+		if err != nil {
+			return n, ChangeNew, "", err
+		}
+		if bytes.Equal(old, h.Sum(nil)) {
+			return n, ChangeNone, "", os.Remove(path + partSuffix)
+		}
+		change = ChangeModified
+	}
+
+	var previous string
+	if change == ChangeModified && s.keep > 0 {
+		previous = path + "." + info.ModTime().UTC().Format(versionTimeLayout)
+		if err := os.Rename(path, previous); err != nil {
+			return n, change, "", err
+		}
+		if err := s.prune(path); err != nil {
+			return n, change, previous, err
+		}
+	}
+	return n, change, previous, os.Rename(path+partSuffix, path)
+}
+
+// prune は path の前の版のうち新しい keep 個を残して削除する
+func (s *VersionedSaver) prune(path string) error {
+	versions, err := s.Versions(path)
+	if err != nil {
+		return err
+	}
+	m := multierr.New()
+	for _, v := range versions[min(s.keep, len(versions)):] {
+		if err := os.Remove(v); err != nil {
+			m.Add(err)
+		}
+	}
+	return m.Err()
+}
+
+// Versions returns the previous versions kept for the file at path,
+// newest first.
+func (s *VersionedSaver) Versions(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var versions []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		// .part や .validators.json は前の版ではない
+		if _, err := time.Parse(versionTimeLayout, stamp); err != nil {
+			continue
+		}
+		versions = append(versions, filepath.Join(filepath.Dir(path), e.Name()))
+	}
+	// 時刻の形式は文字列の順序と時刻の順序が一致する
+	slices.Sort(versions)
+	slices.Reverse(versions)
+	return versions, nil
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Watcher is a TaskSource that hands out the tasks of src again and again,
+// starting a round every interval once the previous one has finished. It
+// must be registered on the publisher of the controller to see the rounds
+// finish, and logs a line for every change and round to w.
+type Watcher struct {
+	src      TaskSource
+	interval time.Duration
+	w        io.Writer
+	// now と after はテストで時刻を進めるため
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	mu sync.Mutex
+	// tasks は最初の巡回で src から読んだタスクで、以降の巡回で繰り返す
+	tasks []Task
+	// srcDone は src を読み終えたこと
+	srcDone bool
+	round   int
+	next    int
+	started time.Time
+	// pending は今回の巡回で終わっていないURL
+	pending map[string]bool
+	// idle は今回の巡回が終わると閉じる
+	idle    chan struct{}
+	counts  roundCounts
+	stopped chan struct{}
+	stop    sync.Once
+}
+
+type roundCounts struct {
+	changed, unchanged, saved, failed int
+}
+
+func NewWatcher(src TaskSource, interval time.Duration, w io.Writer) *Watcher {
+	return &Watcher{
+		src:      src,
+		interval: interval,
+		w:        w,
+		now:      time.Now,
+		after:    time.After,
+		pending:  make(map[string]bool),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Stop makes Next report the end of the tasks, so that the controller
+// stops once the current round has finished.
+func (w *Watcher) Stop() {
+	w.stop.Do(func() { close(w.stopped) })
+}
+
+// Next implements TaskSource.
+func (w *Watcher) Next(ctx context.Context) (Task, bool, error) {
+	w.mu.Lock()
+	if w.round == 0 {
+		w.startRound()
+	}
+	if !w.srcDone {
+		w.mu.Unlock()
+		task, ok, err := w.src.Next(ctx)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil || !ok {
+			w.srcDone = true
+			w.next = len(w.tasks)
+			w.checkIdle()
+			if err != nil || len(w.tasks) == 0 {
+				return Task{}, false, err
+			}
+			return w.waitRound(ctx)
+		}
+		w.tasks = append(w.tasks, task)
+		w.next = len(w.tasks)
+		w.pending[task.url] = true
+		return task, true, nil
+	}
+	defer w.mu.Unlock()
+	if w.next < len(w.tasks) {
+		return w.hand(), true, nil
+	}
+	return w.waitRound(ctx)
+}
+
+// waitRound は今回の巡回が終わり、その開始から interval が経つのを待って次の巡回を始める。
+// w.mu を持った状態で呼ぶ。
+func (w *Watcher) waitRound(ctx context.Context) (Task, bool, error) {
+	idle, started := w.idle, w.started
+	w.mu.Unlock()
+	ok := waitFor(ctx, w.stopped, idle) &&
+		waitFor(ctx, w.stopped, w.after(w.interval-w.now().Sub(started)))
+	w.mu.Lock()
+	if !ok {
+		return Task{}, false, nil
+	}
+	w.startRound()
+	return w.hand(), true, nil
+}
+
+// waitFor は c を受信したらtrue、先に ctx が終わるか stopped が閉じたらfalseを返す
+func waitFor[T any](ctx context.Context, stopped <-chan struct{}, c <-chan T) bool {
+	select {
+	case <-c:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-stopped:
+		return false
+	}
+}
+
+// startRound は w.mu を持った状態で呼ぶ
+func (w *Watcher) startRound() {
+	w.round++
+	w.next = 0
+	w.started = w.now()
+	w.counts = roundCounts{}
+	w.idle = make(chan struct{})
+}
+
+// hand は次のタスクを渡す。w.mu を持った状態で呼ぶ
+func (w *Watcher) hand() Task {
+	task := w.tasks[w.next]
+	w.next++
+	w.pending[task.url] = true
+	return task
+}
+
+// checkIdle は全てのタスクを渡し終えて完了していれば巡回を終える。w.mu を持った状態で呼ぶ
+func (w *Watcher) checkIdle() {
+	if !w.srcDone || w.next < len(w.tasks) || len(w.pending) > 0 {
+		return
+	}
+	select {
+	case <-w.idle:
+		return
+	default:
+	}
+	close(w.idle)
+	c := w.counts
+	fmt.Fprintf(w.w, "%s round %d: %d changed, %d new, %d unchanged, %d failed\n",
+		w.now().Format(time.DateTime), w.round, c.changed, c.saved-c.changed, c.unchanged, c.failed)
+}
+
+// HandleEvent implements pubsub.Subscriber.
+func (w *Watcher) HandleEvent(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var url string
+	switch e := event.(type) {
+	case EventChanged:
+		w.counts.changed++
+		line := fmt.Sprintf("%s changed %s -> %s", w.now().Format(time.DateTime), e.URL, e.Path)
+		if e.Previous != "" {
+			line += fmt.Sprintf(" (previous version: %s)", e.Previous)
+		}
+		fmt.Fprintln(w.w, line)
+		return
+	case EventEnd:
+		w.counts.saved++
+		url = e.URL
+	case EventUnchanged:
+		w.counts.unchanged++
+		url = e.URL
+	case EventAbort:
+		w.counts.failed++
+		url = e.URL
+	case EventDiskFull:
+		// ディスクが空くまで巡回しても失敗するだけなので終える
+		w.counts.failed++
+		url = e.URL
+		w.Stop()
+	default:
+		return
+	}
+	if w.pending[url] {
+		delete(w.pending, url)
+		w.checkIdle()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/no-yan/tmp/downloader/internal/pubsub"
+)
+
+func TestVersionedSaver(t *testing.T) {
+	dir := t.TempDir()
+	s := NewVersionedSaver(NewFileSaver(dir, NewOSFS()), 1)
+	url := "https://example.com/a"
+	path := s.Path(url)
+
+	save := func(content string, mtime time.Time) (Change, string) {
+		t.Helper()
+		_, change, previous, err := s.SaveVersion(strings.NewReader(content), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 前の版の名前は保存した時刻なので、版ごとにずらす
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return change, previous
+	}
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	if change, _ := save("v1", day); change != ChangeNew {
+		t.Errorf("first save = %d, want ChangeNew", change)
+	}
+	if change, previous := save("v1", day); change != ChangeNone || previous != "" {
+		t.Errorf("same content = %d, %q; want ChangeNone", change, previous)
+	}
+	if _, err := os.Stat(path + partSuffix); !os.IsNotExist(err) {
+		t.Errorf("unchanged download left %s", path+partSuffix)
+	}
+
+	change, previous := save("v2", day.Add(time.Hour))
+	if change != ChangeModified || previous != path+".20261001T000000Z" {
+		t.Errorf("changed content = %d, %q", change, previous)
+	}
+	if b, _ := os.ReadFile(previous); string(b) != "v1" {
+		t.Errorf("previous version = %q, want v1", b)
+	}
+
+	// keep=1 なので v1 は消え、v2 だけが残る
+	_, previous = save("v3", day.Add(2*time.Hour))
+	versions, err := s.Versions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0] != previous {
+		t.Errorf("versions = %v, want only %s", versions, previous)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "v3" {
+		t.Errorf("current = %q, want v3", b)
+	}
+}
+
+// syncBuffer は Watcher のログをワーカーとテストの両方から扱う
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatcher(t *testing.T) {
+	var content atomic.Value
+	content.Store("a")
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(content.Load().(string)))
+	}))
+	defer ts.Close()
+
+	var log syncBuffer
+	watcher := NewWatcher(NewSliceSource(*NewTask(ts.URL + "/a"), *NewTask(ts.URL + "/b")), time.Minute, &log)
+	// 巡回の間の待ちをテストから進める
+	waits := make(chan chan time.Time)
+	watcher.after = func(time.Duration) <-chan time.Time {
+		c := make(chan time.Time)
+		waits <- c
+		return c
+	}
+
+	rec := &eventRecorder{}
+	pub := pubsub.NewPublisher[Event]()
+	pub.Register(rec)
+	pub.Register(watcher)
+	saver := NewVersionedSaver(NewFileSaver(t.TempDir(), NewOSFS()), 0)
+	dc := NewDownloadController(watcher, &defaultPolicy, pub, saver, 2)
+	errc := make(chan error)
+	go func() { errc <- dc.Run(context.Background()) }()
+
+	// 2巡目は同じ内容、3巡目は変わった内容を返す
+	for _, next := range []string{"a", "b"} {
+		wait := <-waits
+		content.Store(next)
+		wait <- time.Now()
+	}
+	<-waits
+	watcher.Stop()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := requests.Load(); got != 6 {
+		t.Errorf("%d requests, want 2 URLs in 3 rounds", got)
+	}
+	if got := rec.count(EventTypeUnchanged); got != 2 {
+		t.Errorf("%d EventUnchanged, want 2", got)
+	}
+	if got := rec.count(EventTypeChanged); got != 2 {
+		t.Errorf("%d EventChanged, want 2", got)
+	}
+	for _, want := range []string{
+		"round 1: 0 changed, 2 new, 0 unchanged, 0 failed",
+		"round 2: 0 changed, 0 new, 2 unchanged, 0 failed",
+		"changed " + ts.URL + "/a -> ",
+		"round 3: 2 changed, 0 new, 0 unchanged, 0 failed",
+	} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, log.String())
+		}
+	}
+}